@@ -0,0 +1,238 @@
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"http/components/headers"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Redirects followed before Do gives up
+const DEFAULT_MAX_REDIRECTS = 10
+
+const DEFAULT_DIAL_TIMEOUT = 30 * time.Second
+
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+type Client struct {
+	// whole exchange: connection, request, response headers and body
+	timeout     time.Duration
+	dialTimeout time.Duration
+	// from the end of the request to the end of the response headers
+	headerTimeout time.Duration
+	maxRedirects  int
+	tlsConfig     *tls.Config
+	pool          *pool
+}
+
+type Option func(*Client)
+
+// WithTimeout limits the whole exchange, reading the body included. Zero means no timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithResponseHeaderTimeout limits the wait for the response headers once the request is sent,
+// the body can then take as long as WithTimeout allows
+func WithResponseHeaderTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.headerTimeout = d
+	}
+}
+
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.dialTimeout = d
+	}
+}
+
+// WithMaxRedirects sets how many redirects are followed, with 0 the 3xx response is returned
+func WithMaxRedirects(n int) Option {
+	return func(c *Client) {
+		c.maxRedirects = n
+	}
+}
+
+// WithIdleConns sets how many idle connections are kept per host and for how long
+func WithIdleConns(perHost int, timeout time.Duration) Option {
+	return func(c *Client) {
+		c.pool.maxIdlePerHost = perHost
+		c.pool.idleTimeout = timeout
+	}
+}
+
+// WithTLSConfig is used for https URLs
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = config
+	}
+}
+
+func New(opts ...Option) *Client {
+	c := &Client{
+		dialTimeout:  DEFAULT_DIAL_TIMEOUT,
+		maxRedirects: DEFAULT_MAX_REDIRECTS,
+		pool:         newPool(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Request is a request to send, the Host header and the framing of the body are set by the client
+type Request struct {
+	Method  string
+	URL     *url.URL
+	Headers *headers.Headers
+	// Body is sent with a Content-Length when its size is known (ContentLength >= 0), otherwise chunked
+	Body          io.Reader
+	ContentLength int64
+	// Trailers are sent after the last chunk of a chunked body. They are read once Body has returned io.EOF,
+	// so they can be filled while the body is streamed (e.g. the trailers of an incoming request).
+	Trailers *headers.Headers
+	// Addr is dialed instead of the host of URL when it's set ("ip:port"), e.g. an address already resolved
+	// and checked by a proxy. The Host header and the TLS server name still come from URL.
+	Addr string
+	// getBody returns a fresh copy of the body to repeat it on a redirect (307 and 308)
+	getBody func() io.Reader
+}
+
+// NewRequest creates a request, the size of a bytes.Buffer, bytes.Reader or strings.Reader body is known
+func NewRequest(method string, rawURL string, body io.Reader) (*Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in URL: %s", rawURL)
+	}
+	req := &Request{Method: method, URL: u, Headers: headers.NewHeaders(), Body: body, ContentLength: -1}
+
+	var data []byte
+	switch b := body.(type) {
+	case nil:
+		req.ContentLength = 0
+	case *bytes.Buffer:
+		data = b.Bytes()
+	case *bytes.Reader:
+		data, _ = io.ReadAll(b)
+	case *strings.Reader:
+		data, _ = io.ReadAll(b)
+	}
+	if data != nil {
+		req.ContentLength = int64(len(data))
+		req.getBody = func() io.Reader { return bytes.NewReader(data) }
+		req.Body = req.getBody()
+	}
+	return req, nil
+}
+
+func (c *Client) Get(url string) (*Response, error) {
+	req, err := NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func (c *Client) Head(url string) (*Response, error) {
+	req, err := NewRequest("HEAD", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func (c *Client) Post(url string, contentType string, body io.Reader) (*Response, error) {
+	req, err := NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Headers.Set(headers.CONTENT_TYPE, contentType)
+	return c.Do(req)
+}
+
+// Do sends the request and returns the response once its headers are read, following redirects.
+// The caller must close the Body so that the connection can be reused.
+func (c *Client) Do(req *Request) (*Response, error) {
+	var deadline time.Time
+	if c.timeout > 0 {
+		deadline = time.Now().Add(c.timeout)
+	}
+
+	for redirects := 0; ; redirects++ {
+		resp, err := c.send(req, deadline)
+		if err != nil {
+			return nil, err
+		}
+		next, err := c.redirect(req, resp)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if next == nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if redirects >= c.maxRedirects {
+			return nil, fmt.Errorf("%w: %d", ErrTooManyRedirects, redirects)
+		}
+		req = next
+	}
+}
+
+// redirect returns the request that follows a 3xx response, or nil when the response is final.
+// 303 (and 301/302 after a POST) become a GET without body, 307 and 308 repeat the request.
+func (c *Client) redirect(req *Request, resp *Response) (*Request, error) {
+	location := resp.Headers.Get("Location")
+	if c.maxRedirects == 0 || location == "" {
+		return nil, nil
+	}
+	switch resp.StatusCode {
+	case 301, 302, 303, 307, 308:
+	default:
+		return nil, nil
+	}
+
+	next := &Request{Method: req.Method, Headers: req.Headers.Clone(), ContentLength: 0}
+	if resp.StatusCode == 303 || (resp.StatusCode < 303 && req.Method == "POST") {
+		if req.Method != "HEAD" {
+			next.Method = "GET"
+		}
+		next.Headers.Del(headers.CONTENT_TYPE)
+	} else if req.Body != nil {
+		// a streamed body can't be sent again
+		if req.getBody == nil {
+			return nil, nil
+		}
+		next.Body, next.ContentLength, next.getBody = req.getBody(), req.ContentLength, req.getBody
+	}
+
+	u, err := req.URL.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redirect location %q: %w", location, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported redirect scheme: %q", u.Scheme)
+	}
+	// credentials are not sent to another host, nor in cleartext after https
+	if u.Host != req.URL.Host || (req.URL.Scheme == "https" && u.Scheme == "http") {
+		next.Headers.Del("Authorization")
+		next.Headers.Del("Cookie")
+	} else if u.Scheme == req.URL.Scheme {
+		next.Addr = req.Addr
+	}
+	next.URL = u
+	return next, nil
+}
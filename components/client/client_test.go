@@ -0,0 +1,358 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler server.Handler, opts ...server.Option) string {
+	t.Helper()
+	s, err := server.Serve(0, handler, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return "http://" + s.Addr().String()
+}
+
+// rawServer answers every connection with the same bytes and counts the connections
+func rawServer(t *testing.T, reply string) (string, *atomic.Int32) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	var conns atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == "\r\n" {
+						break
+					}
+				}
+				io.WriteString(conn, reply)
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String(), &conns
+}
+
+func readBody(t *testing.T, resp *Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return string(body)
+}
+
+var (
+	FOUND              = response.StatusCode{Reason: "Found", Code: 302}
+	SEE_OTHER          = response.StatusCode{Reason: "See Other", Code: 303}
+	TEMPORARY_REDIRECT = response.StatusCode{Reason: "Temporary Redirect", Code: 307}
+)
+
+func testHandler(res *response.Response, req *request.Request) *server.HandlerError {
+	switch req.URL.Path {
+	case "/text":
+		res.Header().Set("X-Test", "yes")
+		res.Write([]byte("hello"))
+	case "/chunked":
+		res.Header().Set(headers.TRAILER, "X-Sum")
+		for range 3 {
+			res.Write([]byte(strings.Repeat("a", 2000)))
+		}
+		res.Trailer().Set("X-Sum", "6000")
+	case "/echo":
+		body, _ := io.ReadAll(req.Body)
+		fmt.Fprintf(res, "%s %s %s", req.RequestLine.Method, req.Headers.Get(headers.TRANSFER_ENCODING), body)
+	case "/slow":
+		time.Sleep(200 * time.Millisecond)
+		res.Write([]byte("late"))
+	case "/slow-body":
+		res.Flush()
+		time.Sleep(100 * time.Millisecond)
+		res.Write([]byte("late body"))
+	case "/found":
+		res.SetStatus(&FOUND)
+		res.Header().Set("Location", "/text")
+	case "/see-other":
+		res.SetStatus(&SEE_OTHER)
+		res.Header().Set("Location", "/echo")
+	case "/temporary":
+		res.SetStatus(&TEMPORARY_REDIRECT)
+		res.Header().Set("Location", "/echo")
+	case "/loop":
+		res.SetStatus(&FOUND)
+		res.Header().Set("Location", "/loop")
+	default:
+		return &server.HandlerError{StatusCode: &response.NOT_FOUND}
+	}
+	return nil
+}
+
+func TestClientGet(t *testing.T) {
+	base := startServer(t, testHandler)
+	c := New()
+
+	resp, err := c.Get(base + "/text")
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "OK", resp.Reason)
+	assert.Equal(t, "1.1", resp.Proto)
+	assert.Equal(t, "yes", resp.Headers.Get("X-Test"))
+	assert.Equal(t, "hello", readBody(t, resp))
+
+	resp, err = c.Get(base + "/missing")
+	require.NoError(t, err)
+	assert.Equal(t, 404, resp.StatusCode)
+	readBody(t, resp)
+}
+
+func TestClientChunkedTrailers(t *testing.T) {
+	base := startServer(t, testHandler)
+	resp, err := New().Get(base + "/chunked")
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("a", 6000), readBody(t, resp))
+	assert.Equal(t, "6000", resp.Trailers.Get("X-Sum"))
+}
+
+func TestClientHead(t *testing.T) {
+	base := startServer(t, testHandler)
+	resp, err := New().Head(base + "/text")
+	require.NoError(t, err)
+	assert.Equal(t, "5", resp.Headers.Get(headers.CONTENT_LENGTH))
+	assert.Empty(t, readBody(t, resp))
+}
+
+func TestClientRequestBody(t *testing.T) {
+	base := startServer(t, testHandler)
+	c := New()
+
+	resp, err := c.Post(base+"/echo", "text/plain", strings.NewReader("known size"))
+	require.NoError(t, err)
+	assert.Equal(t, "POST  known size", readBody(t, resp))
+
+	// the size of a pipe is unknown, the body is sent chunked
+	pr, pw := io.Pipe()
+	go func() {
+		io.WriteString(pw, "streamed ")
+		io.WriteString(pw, "body")
+		pw.Close()
+	}()
+	resp, err = c.Post(base+"/echo", "text/plain", pr)
+	require.NoError(t, err)
+	assert.Equal(t, "POST chunked streamed body", readBody(t, resp))
+}
+
+func TestClientReadUntilClose(t *testing.T) {
+	base, _ := rawServer(t, "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nuntil the end")
+	resp, err := New().Get(base + "/")
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", resp.Proto)
+	assert.Equal(t, "until the end", readBody(t, resp))
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	base, conns := rawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	c := New()
+
+	resp, err := c.Get(base + "/")
+	require.NoError(t, err)
+	readBody(t, resp)
+	assert.Len(t, c.pool.idle, 1)
+
+	// the raw server answers once per connection: the pooled one is closed by now,
+	// the request is retried on a new connection
+	resp, err = c.Get(base + "/")
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readBody(t, resp))
+	assert.Equal(t, int32(2), conns.Load())
+
+	// a POST may have been processed: it's only retried with an Idempotency-Key
+	req, err := NewRequest("POST", base+"/", nil)
+	require.NoError(t, err)
+	_, err = c.Do(req)
+	assert.Error(t, err)
+
+	resp, err = c.Get(base + "/")
+	require.NoError(t, err)
+	readBody(t, resp)
+	req.Headers.Set("Idempotency-Key", "42")
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readBody(t, resp))
+}
+
+func TestClientConnectionReuse(t *testing.T) {
+	base := startServer(t, testHandler)
+	c := New()
+
+	var first *persistConn
+	for i := range 3 {
+		resp, err := c.Get(base + "/text")
+		require.NoError(t, err)
+		assert.Equal(t, "hello", readBody(t, resp))
+
+		key := resp.Request.URL.Scheme + "://" + hostPort(resp.Request.URL)
+		require.Len(t, c.pool.idle[key], 1)
+		if i == 0 {
+			first = c.pool.idle[key][0]
+		}
+		assert.Same(t, first, c.pool.idle[key][0])
+	}
+
+	t.Run("unread body is drained on Close", func(t *testing.T) {
+		resp, err := c.Get(base + "/chunked")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		resp, err = c.Get(base + "/text")
+		require.NoError(t, err)
+		assert.Equal(t, "hello", readBody(t, resp))
+	})
+}
+
+func TestClientStaleConnection(t *testing.T) {
+	base := startServer(t, testHandler, server.WithIdleTimeout(50*time.Millisecond))
+	c := New()
+
+	resp, err := c.Get(base + "/text")
+	require.NoError(t, err)
+	readBody(t, resp)
+
+	time.Sleep(150 * time.Millisecond)
+	resp, err = c.Get(base + "/text")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readBody(t, resp))
+}
+
+func TestClientTimeout(t *testing.T) {
+	base := startServer(t, testHandler)
+	_, err := New(WithTimeout(50 * time.Millisecond)).Get(base + "/slow")
+	require.Error(t, err)
+	var nErr net.Error
+	require.ErrorAs(t, err, &nErr)
+	assert.True(t, nErr.Timeout())
+}
+
+func TestClientResponseHeaderTimeout(t *testing.T) {
+	base := startServer(t, testHandler)
+	c := New(WithResponseHeaderTimeout(50 * time.Millisecond))
+
+	_, err := c.Get(base + "/slow")
+	var nErr net.Error
+	require.ErrorAs(t, err, &nErr)
+	assert.True(t, nErr.Timeout())
+
+	// the body is not limited once the headers are in
+	resp, err := c.Get(base + "/slow-body")
+	require.NoError(t, err)
+	assert.Equal(t, "late body", readBody(t, resp))
+}
+
+func TestClientRedirects(t *testing.T) {
+	base := startServer(t, testHandler)
+	c := New()
+
+	t.Run("302 is followed", func(t *testing.T) {
+		resp, err := c.Get(base + "/found")
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "/text", resp.Request.URL.Path)
+		assert.Equal(t, "hello", readBody(t, resp))
+	})
+
+	t.Run("303 becomes a GET", func(t *testing.T) {
+		resp, err := c.Post(base+"/see-other", "text/plain", strings.NewReader("data"))
+		require.NoError(t, err)
+		assert.Equal(t, "GET  ", readBody(t, resp))
+	})
+
+	t.Run("307 repeats the body", func(t *testing.T) {
+		resp, err := c.Post(base+"/temporary", "text/plain", strings.NewReader("data"))
+		require.NoError(t, err)
+		assert.Equal(t, "POST  data", readBody(t, resp))
+	})
+
+	t.Run("too many redirects", func(t *testing.T) {
+		_, err := New(WithMaxRedirects(3)).Get(base + "/loop")
+		assert.ErrorIs(t, err, ErrTooManyRedirects)
+	})
+
+	t.Run("credentials are dropped for another host or a downgrade", func(t *testing.T) {
+		for location, kept := range map[string]bool{
+			"https://example.com/b":   true,
+			"https://other.test/b":    false,
+			"http://example.com/b":    false,
+			"http://example.com:80/b": false,
+		} {
+			req, err := NewRequest("GET", "https://example.com/a", nil)
+			require.NoError(t, err)
+			req.Headers.Set("Authorization", "Bearer secret")
+			req.Headers.Set("Cookie", "session=1")
+			resp := &Response{StatusCode: 302, Headers: headers.NewHeaders()}
+			resp.Headers.Set("Location", location)
+
+			next, err := c.redirect(req, resp)
+			require.NoError(t, err)
+			assert.Equal(t, kept, next.Headers.Has("Authorization"), location)
+			assert.Equal(t, kept, next.Headers.Has("Cookie"), location)
+		}
+	})
+
+	t.Run("redirects disabled", func(t *testing.T) {
+		resp, err := New(WithMaxRedirects(0)).Get(base + "/found")
+		require.NoError(t, err)
+		assert.Equal(t, 302, resp.StatusCode)
+		assert.Equal(t, "/text", resp.Headers.Get("Location"))
+		readBody(t, resp)
+	})
+}
+
+func TestParseStatusLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		proto  string
+		code   int
+		reason string
+		err    bool
+	}{
+		{"HTTP/1.1 200 OK", "1.1", 200, "OK", false},
+		{"HTTP/1.0 404 Not Found", "1.0", 404, "Not Found", false},
+		{"HTTP/1.1 204 ", "1.1", 204, "", false},
+		{"HTTP/1.1 204", "1.1", 204, "", false},
+		{"HTTP/1.1 20 OK", "", 0, "", true},
+		{"HTTP/1.1 abc OK", "", 0, "", true},
+		{"HTTP/11 200 OK", "", 0, "", true},
+		{"200 OK", "", 0, "", true},
+	}
+	for _, tt := range tests {
+		proto, code, reason, err := parseStatusLine([]byte(tt.line))
+		if tt.err {
+			assert.Error(t, err, tt.line)
+			continue
+		}
+		require.NoError(t, err, tt.line)
+		assert.Equal(t, tt.proto, proto)
+		assert.Equal(t, tt.code, code)
+		assert.Equal(t, tt.reason, reason)
+	}
+}
@@ -0,0 +1,311 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"http/components/headers"
+	"http/components/request"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const DEFAULT_MAX_IDLE_PER_HOST = 2
+
+// Idle connections are closed after this time, the server would close them anyway
+const DEFAULT_IDLE_CONN_TIMEOUT = 90 * time.Second
+
+// Request bodies of unknown size are sent in chunks of this size
+const CHUNK_SIZE = 32 << 10
+
+// persistConn is a connection with the reader that keeps its leftover bytes between responses
+type persistConn struct {
+	conn   net.Conn
+	reader *request.Reader
+	key    string
+	idleAt time.Time
+}
+
+// pool keeps the idle keep-alive connections of each host ("scheme://host:port")
+type pool struct {
+	mu             sync.Mutex
+	idle           map[string][]*persistConn
+	maxIdlePerHost int
+	idleTimeout    time.Duration
+}
+
+func newPool() *pool {
+	return &pool{
+		idle:           map[string][]*persistConn{},
+		maxIdlePerHost: DEFAULT_MAX_IDLE_PER_HOST,
+		idleTimeout:    DEFAULT_IDLE_CONN_TIMEOUT,
+	}
+}
+
+// get returns the most recently used idle connection, expired ones are closed
+func (p *pool) get(key string) *persistConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conns := p.idle[key]; len(conns) > 0; conns = p.idle[key] {
+		pc := conns[len(conns)-1]
+		p.idle[key] = conns[:len(conns)-1]
+		if p.idleTimeout > 0 && time.Since(pc.idleAt) > p.idleTimeout {
+			pc.conn.Close()
+			continue
+		}
+		return pc
+	}
+	return nil
+}
+
+func (p *pool) put(pc *persistConn) {
+	pc.conn.SetDeadline(time.Time{})
+	pc.idleAt = time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[pc.key]) >= p.maxIdlePerHost {
+		pc.conn.Close()
+		return
+	}
+	p.idle[pc.key] = append(p.idle[pc.key], pc)
+}
+
+func (p *pool) closeIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, conns := range p.idle {
+		for _, pc := range conns {
+			pc.conn.Close()
+		}
+		delete(p.idle, key)
+	}
+}
+
+// CloseIdleConnections closes the connections kept for reuse
+func (c *Client) CloseIdleConnections() {
+	c.pool.closeIdle()
+}
+
+// send runs a single exchange on a pooled or new connection. An idempotent request without body
+// is retried on a new connection when a reused one turns out to be closed by the server.
+func (c *Client) send(req *Request, deadline time.Time) (*Response, error) {
+	key := req.URL.Scheme + "://" + hostPort(req.URL)
+	if req.Addr != "" {
+		// a connection to another address of the host can't be reused
+		key += "@" + req.Addr
+	}
+	for {
+		pc, reused := c.pool.get(key), true
+		if pc == nil {
+			var err error
+			if pc, err = c.dial(req.URL, req.Addr, key, deadline); err != nil {
+				return nil, err
+			}
+			reused = false
+		}
+		pc.conn.SetDeadline(deadline)
+
+		resp, err := c.roundTrip(pc, req, deadline)
+		if err != nil {
+			pc.conn.Close()
+			if reused && req.Body == nil && idempotent(req) && isClosedConn(err) {
+				continue
+			}
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+// dial connects to addr, or to the host of u when addr is empty
+func (c *Client) dial(u *url.URL, addr string, key string, deadline time.Time) (*persistConn, error) {
+	dialer := &net.Dialer{Timeout: c.dialTimeout, Deadline: deadline}
+	if addr == "" {
+		addr = hostPort(u)
+	}
+	var conn net.Conn
+	var err error
+	if u.Scheme == "https" {
+		config := &tls.Config{}
+		if c.tlsConfig != nil {
+			config = c.tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &persistConn{conn: conn, reader: request.NewReader(conn), key: key}, nil
+}
+
+func (c *Client) roundTrip(pc *persistConn, req *Request, deadline time.Time) (*Response, error) {
+	if err := writeRequest(pc.conn, req); err != nil {
+		return nil, err
+	}
+	if c.headerTimeout > 0 {
+		if headerDeadline := time.Now().Add(c.headerTimeout); deadline.IsZero() || headerDeadline.Before(deadline) {
+			pc.conn.SetReadDeadline(headerDeadline)
+		}
+	}
+	resp, err := readResponse(pc.reader, req)
+	if err != nil {
+		return nil, err
+	}
+	pc.conn.SetReadDeadline(deadline)
+
+	if resp.keepAlive && resp.Body == request.NoBody {
+		c.pool.put(pc)
+		return resp, nil
+	}
+	resp.Body = &bodyReader{body: resp.Body, pc: pc, pool: c.pool, keepAlive: resp.keepAlive}
+	return resp, nil
+}
+
+// writeRequest writes the request line, the headers and the body. The framing is chosen by the client:
+// Content-Length when the size is known, chunked otherwise.
+func writeRequest(conn net.Conn, req *Request) error {
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+
+	h := headers.NewHeaders()
+	h.Set("Host", req.URL.Host)
+	if req.Headers != nil {
+		req.Headers.ForEach(func(k, v string) {
+			switch k {
+			case "host", "content-length", "transfer-encoding":
+				return
+			}
+			h.Add(k, v)
+		})
+	}
+	switch {
+	case req.Body == nil:
+	case req.ContentLength >= 0:
+		h.Set(headers.CONTENT_LENGTH, fmt.Sprint(req.ContentLength))
+	default:
+		h.Set(headers.TRANSFER_ENCODING, "chunked")
+	}
+	h.ForEach(func(k, v string) {
+		fmt.Fprintf(w, "%s: %s\r\n", k, v)
+	})
+	w.WriteString("\r\n")
+
+	if req.Body != nil {
+		if err := writeBody(w, req); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func writeBody(w *bufio.Writer, req *Request) error {
+	if req.ContentLength >= 0 {
+		n, err := io.CopyN(w, req.Body, req.ContentLength)
+		if err != nil {
+			return fmt.Errorf("request body shorter than ContentLength (%d of %d bytes): %w", n, req.ContentLength, err)
+		}
+		return nil
+	}
+	buf := make([]byte, CHUNK_SIZE)
+	for {
+		n, err := req.Body.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	w.WriteString("0\r\n")
+	if req.Trailers != nil {
+		req.Trailers.ForEach(func(k, v string) {
+			fmt.Fprintf(w, "%s: %s\r\n", k, v)
+		})
+	}
+	_, err := w.WriteString("\r\n")
+	return err
+}
+
+// bodyReader gives the connection back to the pool once the body has been read to the end,
+// or closes it when the body is broken or the connection can't be reused
+type bodyReader struct {
+	body      io.ReadCloser
+	pc        *persistConn
+	pool      *pool
+	keepAlive bool
+	released  bool
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.released {
+		return 0, request.ErrBodyClosed
+	}
+	n, err := b.body.Read(p)
+	if err != nil {
+		b.release(errors.Is(err, io.EOF))
+	}
+	return n, err
+}
+
+// Close discards a small unread rest of the body to reuse the connection
+func (b *bodyReader) Close() error {
+	if b.released {
+		return nil
+	}
+	b.release(b.keepAlive && b.body.Close() == nil)
+	return nil
+}
+
+func (b *bodyReader) release(reuse bool) {
+	if b.released {
+		return
+	}
+	b.released = true
+	if reuse && b.keepAlive {
+		b.pool.put(b.pc)
+	} else {
+		b.pc.conn.Close()
+	}
+}
+
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// idempotent reports whether the request can be sent again without changing its effect (RFC 9110 section 9.2.2),
+// the server may have processed it before closing the connection
+func idempotent(req *Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return req.Headers != nil && req.Headers.Has("Idempotency-Key")
+}
+
+// isClosedConn reports errors of a connection closed by the server before the response
+func isClosedConn(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
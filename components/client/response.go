@@ -0,0 +1,112 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"http/components/headers"
+	"http/components/request"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type Response struct {
+	StatusCode int
+	Reason     string
+	// Proto is the HTTP version, e.g. "1.1"
+	Proto   string
+	Headers *headers.Headers
+	// Trailers of a chunked body, available once the body has been read to the end
+	Trailers *headers.Headers
+	Body     io.ReadCloser
+	// Request is the last request sent, after the redirects
+	Request *Request
+
+	keepAlive bool
+}
+
+// readResponse parses the status line and the headers, interim responses (1xx) are skipped.
+// The body framing follows RFC 9112 section 6.3.
+func readResponse(rd *request.Reader, req *Request) (*Response, error) {
+	for {
+		line, err := rd.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		resp := &Response{Headers: headers.NewHeaders(), Trailers: headers.NewHeaders(), Request: req}
+		if resp.Proto, resp.StatusCode, resp.Reason, err = parseStatusLine(line); err != nil {
+			return nil, err
+		}
+		if err := rd.ReadHeaders(resp.Headers); err != nil {
+			return nil, fmt.Errorf("malformed response headers: %w", err)
+		}
+		if resp.StatusCode < 200 && resp.StatusCode != 101 {
+			continue
+		}
+
+		length, chunked, err := framing(req, resp)
+		if err != nil {
+			return nil, err
+		}
+		resp.keepAlive = keepAlive(resp) && (length >= 0 || chunked)
+		resp.Body = rd.NewBody(length, chunked, resp.Trailers)
+		return resp, nil
+	}
+}
+
+// framing returns the Content-Length of the body (-1 when it's delimited by closing the connection)
+// or whether it's chunked
+func framing(req *Request, resp *Response) (int64, bool, error) {
+	code := resp.StatusCode
+	if req.Method == "HEAD" || code < 200 || code == 204 || code == 304 {
+		return 0, false, nil
+	}
+	if resp.Headers.Has(headers.TRANSFER_ENCODING) {
+		codings := strings.Split(resp.Headers.Get(headers.TRANSFER_ENCODING), ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return 0, true, nil
+		}
+		return -1, false, nil
+	}
+	if resp.Headers.Has(headers.CONTENT_LENGTH) {
+		length, err := resp.Headers.GetContentLength()
+		if err != nil {
+			return 0, false, err
+		}
+		return int64(length), false, nil
+	}
+	return -1, false, nil
+}
+
+func keepAlive(resp *Response) bool {
+	if resp.Headers.HasToken(headers.CONNECTION, "close") {
+		return false
+	}
+	if resp.Proto == "1.0" {
+		return resp.Headers.HasToken(headers.CONNECTION, "keep-alive")
+	}
+	return true
+}
+
+// parseStatusLine parses "HTTP/1.1 200 OK", the reason phrase can be empty
+func parseStatusLine(line []byte) (proto string, code int, reason string, err error) {
+	parts := bytes.SplitN(line, []byte{' '}, 3)
+	if len(parts) < 2 {
+		return "", 0, "", fmt.Errorf("malformed status line: %q", line)
+	}
+	version := string(parts[0])
+	if len(version) != 8 || !strings.HasPrefix(version, "HTTP/") || version[6] != '.' {
+		return "", 0, "", fmt.Errorf("invalid HTTP version in status line: %q", line)
+	}
+	if len(parts[1]) != 3 {
+		return "", 0, "", fmt.Errorf("invalid status code in status line: %q", line)
+	}
+	code, err = strconv.Atoi(string(parts[1]))
+	if err != nil || code < 100 {
+		return "", 0, "", fmt.Errorf("invalid status code in status line: %q", line)
+	}
+	if len(parts) == 3 {
+		reason = string(parts[2])
+	}
+	return strings.TrimPrefix(version, "HTTP/"), code, reason, nil
+}
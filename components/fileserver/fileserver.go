@@ -0,0 +1,323 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Dates of Last-Modified and If-Modified-Since (IMF-fixdate, RFC 9110 section 5.6.7)
+const TIME_FORMAT = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+const INDEX_FILE = "index.html"
+
+// Bytes read to guess the type of a file without a known extension
+const SNIFF_SIZE = 512
+
+type fileServer struct {
+	root    string
+	index   bool
+	listing bool
+}
+
+type Option func(*fileServer)
+
+// WithIndex serves the index.html of a directory
+func WithIndex() Option {
+	return func(fs *fileServer) {
+		fs.index = true
+	}
+}
+
+// WithListing lists the content of a directory without an index.html
+func WithListing() Option {
+	return func(fs *fileServer) {
+		fs.listing = true
+	}
+}
+
+// FileServer serves the files under root. Mounted on a wildcard route (e.g. "/static/*") the path
+// comes from the wildcard, otherwise from the request path. Directories are not listed unless WithListing.
+func FileServer(root string, opts ...Option) server.Handler {
+	fsrv := &fileServer{root: root}
+	for _, opt := range opts {
+		opt(fsrv)
+	}
+	return fsrv.serve
+}
+
+func (fsrv *fileServer) serve(res *response.Response, req *request.Request) *server.HandlerError {
+	if hErr := checkMethod(req); hErr != nil {
+		return hErr
+	}
+	name, ok := req.LookupPathValue("*")
+	if !ok {
+		name = req.URL.Path
+	}
+	name, hErr := cleanPath(name)
+	if hErr != nil {
+		return hErr
+	}
+
+	fullPath := filepath.Join(fsrv.root, filepath.FromSlash(name))
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return statError(err)
+	}
+	if !info.IsDir() {
+		return ServeFile(res, req, fullPath)
+	}
+
+	// relative links of the index and of the listing need the trailing slash
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		// cleaned so that "//host" can't become a protocol-relative redirect to another site
+		location := path.Clean("/"+req.URL.RawPath) + "/"
+		if req.URL.RawQuery != "" {
+			location += "?" + req.URL.RawQuery
+		}
+		res.SetStatus(&response.MOVED_PERMANENTLY)
+		res.Header().Set("Location", location)
+		return nil
+	}
+	if fsrv.index {
+		index := filepath.Join(fullPath, INDEX_FILE)
+		if info, err := os.Stat(index); err == nil && !info.IsDir() {
+			return ServeFile(res, req, index)
+		}
+	}
+	if fsrv.listing {
+		return listDirectory(res, req, fullPath)
+	}
+	return &server.HandlerError{StatusCode: &response.NOT_FOUND, Message: []byte("Not Found")}
+}
+
+// ServeFile sends a single file with its validators (Last-Modified and ETag) answering
+// conditional requests (304) and Range requests (206)
+func ServeFile(res *response.Response, req *request.Request, name string) *server.HandlerError {
+	if hErr := checkMethod(req); hErr != nil {
+		return hErr
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return statError(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return statError(err)
+	}
+	if info.IsDir() {
+		return &server.HandlerError{StatusCode: &response.NOT_FOUND, Message: []byte("Not Found")}
+	}
+
+	modTime := info.ModTime().UTC().Truncate(time.Second)
+	etag := fmt.Sprintf("\"%x-%x\"", info.Size(), info.ModTime().UnixNano())
+	h := res.Header()
+	h.Set("Last-Modified", modTime.Format(TIME_FORMAT))
+	h.Set("ETag", etag)
+	h.Set("Accept-Ranges", "bytes")
+
+	if notModified(req, etag, modTime) {
+		res.SetStatus(&response.NOT_MODIFIED)
+		return nil
+	}
+
+	contentType, err := detectType(file, name)
+	if err != nil {
+		return &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte(err.Error())}
+	}
+	size := info.Size()
+
+	rangeHeader := req.Headers.Get("Range")
+	if rangeHeader != "" && !ifRangeMatches(req.Headers.Get("If-Range"), etag, modTime) {
+		rangeHeader = ""
+	}
+	ranges, err := parseRange(rangeHeader, size)
+	if errors.Is(err, errUnsatisfiable) {
+		unsatisfiable := headers.NewHeaders()
+		unsatisfiable.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return &server.HandlerError{StatusCode: &response.RANGE_NOT_SATISFIABLE, Message: []byte(err.Error()), Headers: unsatisfiable}
+	}
+	if err != nil {
+		// an invalid Range is ignored, the whole file is sent
+		ranges = nil
+	}
+
+	switch len(ranges) {
+	case 0:
+		h.Set(headers.CONTENT_TYPE, contentType)
+		h.Set(headers.CONTENT_LENGTH, fmt.Sprint(size))
+		return sendBody(res, req, file)
+	case 1:
+		r := ranges[0]
+		res.SetStatus(&response.PARTIAL_CONTENT)
+		h.Set(headers.CONTENT_TYPE, contentType)
+		h.Set("Content-Range", r.contentRange(size))
+		h.Set(headers.CONTENT_LENGTH, fmt.Sprint(r.length))
+		return sendBody(res, req, io.NewSectionReader(file, r.start, r.length))
+	default:
+		res.SetStatus(&response.PARTIAL_CONTENT)
+		mp := newMultipart(ranges, contentType, size)
+		h.Set(headers.CONTENT_TYPE, "multipart/byteranges; boundary="+mp.boundary)
+		h.Set(headers.CONTENT_LENGTH, fmt.Sprint(mp.length()))
+		if req.RequestLine.Method == "HEAD" {
+			return nil
+		}
+		if err := mp.write(contextWriter{req.Context(), res}, file); err != nil {
+			return &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte(err.Error())}
+		}
+		return nil
+	}
+}
+
+func sendBody(res *response.Response, req *request.Request, body io.Reader) *server.HandlerError {
+	if req.RequestLine.Method == "HEAD" {
+		return nil
+	}
+	if _, err := io.Copy(contextWriter{req.Context(), res}, body); err != nil {
+		return &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte(err.Error())}
+	}
+	return nil
+}
+
+// contextWriter stops the copy of a file once the request context is cancelled (e.g. the client went away)
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw contextWriter) Write(p []byte) (int, error) {
+	if err := context.Cause(cw.ctx); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
+
+func checkMethod(req *request.Request) *server.HandlerError {
+	if m := req.RequestLine.Method; m == "GET" || m == "HEAD" {
+		return nil
+	}
+	allow := headers.NewHeaders()
+	allow.Set("Allow", "GET, HEAD")
+	return &server.HandlerError{StatusCode: &response.METHOD_NOT_ALLOWED, Message: []byte("Method Not Allowed"), Headers: allow}
+}
+
+// cleanPath resolves the request path against "/", a ".." segment is rejected
+// instead of being resolved so that it can't reach the parent of the root
+func cleanPath(name string) (string, *server.HandlerError) {
+	if strings.Contains(name, "\x00") || strings.Contains(name, "\\") {
+		return "", &server.HandlerError{StatusCode: &response.BAD_REQUEST, Message: []byte("invalid path")}
+	}
+	if slices.Contains(strings.Split(name, "/"), "..") {
+		return "", &server.HandlerError{StatusCode: &response.BAD_REQUEST, Message: []byte("invalid path")}
+	}
+	return path.Clean("/" + name), nil
+}
+
+func statError(err error) *server.HandlerError {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return &server.HandlerError{StatusCode: &response.NOT_FOUND, Message: []byte("Not Found")}
+	case errors.Is(err, fs.ErrPermission):
+		return &server.HandlerError{StatusCode: &response.FORBIDDEN, Message: []byte("Forbidden")}
+	default:
+		return &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte(err.Error())}
+	}
+}
+
+// detectType uses the extension of the file, otherwise the first bytes tell text from binary data
+func detectType(file *os.File, name string) (string, error) {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t, nil
+	}
+	buf := make([]byte, SNIFF_SIZE)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	buf = buf[:n]
+	// a multi-byte character can be cut at the end of the buffer
+	for i := 0; i < utf8.UTFMax && len(buf) > 0 && !utf8.Valid(buf); i++ {
+		buf = buf[:len(buf)-1]
+	}
+	if utf8.Valid(buf) && !slices.Contains(buf, 0) {
+		return "text/plain; charset=utf-8", nil
+	}
+	return "application/octet-stream", nil
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since when If-None-Match is missing (RFC 9110 section 13.2.2)
+func notModified(req *request.Request, etag string, modTime time.Time) bool {
+	if inm := req.Headers.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			// weak comparison
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := req.Headers.Get("If-Modified-Since"); ims != "" {
+		t, err := time.Parse(TIME_FORMAT, ims)
+		return err == nil && !modTime.After(t)
+	}
+	return false
+}
+
+// ifRangeMatches reports whether the Range can be applied: If-Range holds an entity-tag that must
+// be strongly equal to the current one or a date that must be the Last-Modified (RFC 9110 section 13.1.5)
+func ifRangeMatches(ifRange string, etag string, modTime time.Time) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") || strings.HasPrefix(ifRange, "W/") {
+		return !strings.HasPrefix(ifRange, "W/") && ifRange == etag
+	}
+	t, err := time.Parse(TIME_FORMAT, ifRange)
+	return err == nil && t.Equal(modTime)
+}
+
+func listDirectory(res *response.Response, req *request.Request, dir string) *server.HandlerError {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return statError(err)
+	}
+
+	res.Header().Set(headers.CONTENT_TYPE, "text/html; charset=utf-8")
+	if req.RequestLine.Method == "HEAD" {
+		return nil
+	}
+	title := html.EscapeString(req.URL.Path)
+	fmt.Fprintf(res, "<!DOCTYPE html>\n<html>\n<head><title>Index of %s</title></head>\n<body>\n<h1>Index of %s</h1>\n<ul>\n", title, title)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		link := (&url.URL{Path: name}).EscapedPath()
+		// "a:b" would be read as a scheme
+		if strings.Contains(strings.SplitN(name, "/", 2)[0], ":") {
+			link = "./" + link
+		}
+		fmt.Fprintf(res, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(link), html.EscapeString(name))
+	}
+	fmt.Fprint(res, "</ul>\n</body>\n</html>\n")
+	return nil
+}
@@ -0,0 +1,309 @@
+package fileserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRoot creates a tree with a file whose size is not a multiple of the copy buffers
+func newRoot(t *testing.T) (string, []byte) {
+	t.Helper()
+	root := t.TempDir()
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(root, "data.txt"), data, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "blob"), []byte{0, 1, 2, 3}, 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "docs"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "docs", "index.html"), []byte("<h1>docs</h1>"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "empty"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "empty", "<b>.txt"), []byte("x"), 0o644))
+	return root, data
+}
+
+// serve runs the handler like the server does and parses the raw response
+func serve(t *testing.T, handler server.Handler, method string, target string, extraHeaders ...string) *http.Response {
+	t.Helper()
+	raw := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: localhost\r\n", method, target)
+	for _, h := range extraHeaders {
+		raw += h + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	res := &response.Response{Writer: &buf, KeepAlive: true, Head: method == "HEAD"}
+	if hErr := handler(res, req); hErr != nil {
+		require.NoError(t, res.Reset())
+		require.NoError(t, hErr.Write(res))
+	}
+	require.NoError(t, res.Finish())
+	assert.Equal(t, response.ResponseDone, res.State())
+
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), &http.Request{Method: method})
+	require.NoError(t, err)
+	return resp
+}
+
+func body(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestFileServer(t *testing.T) {
+	root, data := newRoot(t)
+	fsrv := FileServer(root)
+
+	t.Run("whole file", func(t *testing.T) {
+		resp := serve(t, fsrv, "GET", "/data.txt")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, int64(len(data)), resp.ContentLength)
+		assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+		assert.NotEmpty(t, resp.Header.Get("ETag"))
+		assert.NotEmpty(t, resp.Header.Get("Last-Modified"))
+		assert.Equal(t, string(data), body(t, resp))
+	})
+
+	t.Run("type of a file without extension", func(t *testing.T) {
+		resp := serve(t, fsrv, "GET", "/blob")
+		assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "\x00\x01\x02\x03", body(t, resp))
+	})
+
+	t.Run("HEAD has no body", func(t *testing.T) {
+		resp := serve(t, fsrv, "HEAD", "/data.txt")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, int64(len(data)), resp.ContentLength)
+		assert.Empty(t, body(t, resp))
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		assert.Equal(t, 404, serve(t, fsrv, "GET", "/missing.txt").StatusCode)
+	})
+
+	t.Run("other methods", func(t *testing.T) {
+		resp := serve(t, fsrv, "POST", "/data.txt")
+		assert.Equal(t, 405, resp.StatusCode)
+		assert.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+	})
+
+	t.Run("traversal is rejected", func(t *testing.T) {
+		for _, target := range []string{"/../secret", "/docs/../../secret", "/%2e%2e/secret", "/docs/..%2f..%2fsecret"} {
+			resp := serve(t, fsrv, "GET", target)
+			assert.Equal(t, 400, resp.StatusCode, target)
+		}
+	})
+
+	t.Run("directory without trailing slash is redirected", func(t *testing.T) {
+		resp := serve(t, fsrv, "GET", "/docs?x=1")
+		assert.Equal(t, 301, resp.StatusCode)
+		assert.Equal(t, "/docs/?x=1", resp.Header.Get("Location"))
+
+		// not a protocol-relative URL to another host
+		for _, target := range []string{"//docs", "///docs", "/./docs"} {
+			resp = serve(t, fsrv, "GET", target)
+			assert.Equal(t, 301, resp.StatusCode, target)
+			assert.Equal(t, "/docs/", resp.Header.Get("Location"), target)
+		}
+	})
+
+	t.Run("directory without index and listing", func(t *testing.T) {
+		assert.Equal(t, 404, serve(t, fsrv, "GET", "/docs/").StatusCode)
+	})
+}
+
+func TestFileServerDirectories(t *testing.T) {
+	root, _ := newRoot(t)
+	fsrv := FileServer(root, WithIndex(), WithListing())
+
+	t.Run("index.html", func(t *testing.T) {
+		resp := serve(t, fsrv, "GET", "/docs/")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "<h1>docs</h1>", body(t, resp))
+	})
+
+	t.Run("listing", func(t *testing.T) {
+		resp := serve(t, fsrv, "GET", "/")
+		assert.Equal(t, 200, resp.StatusCode)
+		listing := body(t, resp)
+		assert.Contains(t, listing, `<a href="data.txt">data.txt</a>`)
+		assert.Contains(t, listing, `<a href="docs/">docs/</a>`)
+	})
+
+	t.Run("names are escaped", func(t *testing.T) {
+		listing := body(t, serve(t, fsrv, "GET", "/empty/"))
+		assert.Contains(t, listing, `<a href="%3Cb%3E.txt">&lt;b&gt;.txt</a>`)
+	})
+}
+
+func TestFileServerWildcardRoute(t *testing.T) {
+	root, data := newRoot(t)
+	fsrv := FileServer(root)
+
+	req, err := request.RequestFromReader(strings.NewReader("GET /static/data.txt HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	req.SetPathValue("*", "data.txt")
+
+	var buf bytes.Buffer
+	res := &response.Response{Writer: &buf}
+	require.Nil(t, fsrv(res, req))
+	require.NoError(t, res.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), string(data)))
+}
+
+func TestServeFileConditional(t *testing.T) {
+	root, _ := newRoot(t)
+	name := filepath.Join(root, "data.txt")
+	handler := func(res *response.Response, req *request.Request) *server.HandlerError {
+		return ServeFile(res, req, name)
+	}
+	first := serve(t, handler, "GET", "/")
+	etag := first.Header.Get("ETag")
+	lastModified := first.Header.Get("Last-Modified")
+
+	t.Run("If-None-Match", func(t *testing.T) {
+		resp := serve(t, handler, "GET", "/", "If-None-Match: "+etag)
+		assert.Equal(t, 304, resp.StatusCode)
+		assert.Equal(t, etag, resp.Header.Get("ETag"))
+		assert.Empty(t, body(t, resp))
+
+		resp = serve(t, handler, "GET", "/", `If-None-Match: "other", W/`+etag)
+		assert.Equal(t, 304, resp.StatusCode)
+
+		resp = serve(t, handler, "GET", "/", `If-None-Match: "other"`)
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+
+	t.Run("If-Modified-Since", func(t *testing.T) {
+		resp := serve(t, handler, "GET", "/", "If-Modified-Since: "+lastModified)
+		assert.Equal(t, 304, resp.StatusCode)
+
+		past := time.Now().Add(-48 * time.Hour).UTC().Format(TIME_FORMAT)
+		require.NoError(t, os.Chtimes(name, time.Now(), time.Now()))
+		resp = serve(t, handler, "GET", "/", "If-Modified-Since: "+past)
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+
+	t.Run("If-None-Match wins over If-Modified-Since", func(t *testing.T) {
+		future := time.Now().Add(48 * time.Hour).UTC().Format(TIME_FORMAT)
+		resp := serve(t, handler, "GET", "/", `If-None-Match: "other"`, "If-Modified-Since: "+future)
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+}
+
+func TestServeFileRange(t *testing.T) {
+	root, data := newRoot(t)
+	name := filepath.Join(root, "data.txt")
+	handler := func(res *response.Response, req *request.Request) *server.HandlerError {
+		return ServeFile(res, req, name)
+	}
+	size := len(data)
+
+	t.Run("single range", func(t *testing.T) {
+		resp := serve(t, handler, "GET", "/", "Range: bytes=10-19")
+		assert.Equal(t, 206, resp.StatusCode)
+		assert.Equal(t, fmt.Sprintf("bytes 10-19/%d", size), resp.Header.Get("Content-Range"))
+		assert.Equal(t, int64(10), resp.ContentLength)
+		assert.Equal(t, string(data[10:20]), body(t, resp))
+	})
+
+	t.Run("open and suffix ranges", func(t *testing.T) {
+		resp := serve(t, handler, "GET", "/", "Range: bytes=4990-")
+		assert.Equal(t, string(data[4990:]), body(t, resp))
+
+		resp = serve(t, handler, "GET", "/", "Range: bytes=-5")
+		assert.Equal(t, fmt.Sprintf("bytes %d-%d/%d", size-5, size-1, size), resp.Header.Get("Content-Range"))
+		assert.Equal(t, string(data[size-5:]), body(t, resp))
+
+		resp = serve(t, handler, "GET", "/", "Range: bytes=4000-99999")
+		assert.Equal(t, string(data[4000:]), body(t, resp))
+	})
+
+	t.Run("multiple ranges", func(t *testing.T) {
+		resp := serve(t, handler, "GET", "/", "Range: bytes=0-4, 100-109, -3")
+		assert.Equal(t, 206, resp.StatusCode)
+		mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		require.NoError(t, err)
+		assert.Equal(t, "multipart/byteranges", mediaType)
+
+		raw := body(t, resp)
+		assert.Equal(t, resp.ContentLength, int64(len(raw)))
+		reader := multipart.NewReader(strings.NewReader(raw), params["boundary"])
+		expected := []struct{ contentRange, data string }{
+			{fmt.Sprintf("bytes 0-4/%d", size), string(data[0:5])},
+			{fmt.Sprintf("bytes 100-109/%d", size), string(data[100:110])},
+			{fmt.Sprintf("bytes %d-%d/%d", size-3, size-1, size), string(data[size-3:])},
+		}
+		for _, e := range expected {
+			part, err := reader.NextPart()
+			require.NoError(t, err)
+			assert.Equal(t, e.contentRange, part.Header.Get("Content-Range"))
+			assert.Equal(t, "text/plain; charset=utf-8", part.Header.Get("Content-Type"))
+			partData, _ := io.ReadAll(part)
+			assert.Equal(t, e.data, string(partData))
+		}
+		_, err = reader.NextPart()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("unsatisfiable range", func(t *testing.T) {
+		resp := serve(t, handler, "GET", "/", "Range: bytes=9000-9100")
+		assert.Equal(t, 416, resp.StatusCode)
+		assert.Equal(t, fmt.Sprintf("bytes */%d", size), resp.Header.Get("Content-Range"))
+	})
+
+	t.Run("invalid range is ignored", func(t *testing.T) {
+		resp := serve(t, handler, "GET", "/", "Range: bytes=abc")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, string(data), body(t, resp))
+	})
+
+	t.Run("If-Range", func(t *testing.T) {
+		etag := serve(t, handler, "GET", "/").Header.Get("ETag")
+
+		resp := serve(t, handler, "GET", "/", "Range: bytes=0-9", "If-Range: "+etag)
+		assert.Equal(t, 206, resp.StatusCode)
+
+		resp = serve(t, handler, "GET", "/", "Range: bytes=0-9", `If-Range: "stale"`)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, string(data), body(t, resp))
+	})
+}
+
+func TestServeFileCanceled(t *testing.T) {
+	root, _ := newRoot(t)
+	req, err := request.RequestFromReader(strings.NewReader("GET /data.txt HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(server.ErrClientGone)
+	req.SetContext(ctx)
+
+	// the copy stops at the first write
+	var buf bytes.Buffer
+	hErr := ServeFile(&response.Response{Writer: &buf}, req, filepath.Join(root, "data.txt"))
+	require.NotNil(t, hErr)
+	assert.Contains(t, string(hErr.Message), server.ErrClientGone.Error())
+	assert.Zero(t, buf.Len())
+}
@@ -0,0 +1,148 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A Range with more parts is ignored and the whole file is sent
+const MAX_RANGES = 32
+
+var errUnsatisfiable = errors.New("range not satisfiable")
+
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses "bytes=0-99, 200-, -50" (RFC 9110 section 14.1.2). Ranges beyond the end
+// of the file are dropped, errUnsatisfiable is returned when none is left.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	if header == "" {
+		return nil, nil
+	}
+	unit, set, ok := strings.Cut(header, "=")
+	if !ok || strings.TrimSpace(unit) != "bytes" {
+		return nil, fmt.Errorf("unsupported range unit: %s", header)
+	}
+	specs := strings.Split(set, ",")
+	if len(specs) > MAX_RANGES {
+		return nil, fmt.Errorf("too many ranges: %d", len(specs))
+	}
+
+	var ranges []byteRange
+	var total int64
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid range: %s", spec)
+		}
+		var r byteRange
+		if first == "" {
+			// suffix range: the last n bytes
+			n, err := parseOffset(last)
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = byteRange{size - n, n}
+		} else {
+			start, err := parseOffset(first)
+			if err != nil {
+				return nil, err
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = parseOffset(last); err != nil {
+					return nil, err
+				}
+				if end < start {
+					return nil, fmt.Errorf("invalid range: %s", spec)
+				}
+			}
+			if start >= size {
+				continue
+			}
+			end = min(end, size-1)
+			r = byteRange{start, end - start + 1}
+		}
+		ranges = append(ranges, r)
+		total += r.length
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	// overlapping ranges that add up to more than the file are cheaper to send as a whole
+	if total > size {
+		return nil, fmt.Errorf("ranges overlap: %s", header)
+	}
+	return ranges, nil
+}
+
+func parseOffset(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid range offset: %q", s)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// multipart/byteranges body (RFC 9110 section 14.6), the part headers are known
+// in advance so the length of the whole body can be sent as Content-Length
+type multipartRanges struct {
+	boundary string
+	parts    []string
+	ranges   []byteRange
+}
+
+func newMultipart(ranges []byteRange, contentType string, size int64) *multipartRanges {
+	b := make([]byte, 16)
+	rand.Read(b)
+	mp := &multipartRanges{boundary: hex.EncodeToString(b), ranges: ranges}
+	for _, r := range ranges {
+		mp.parts = append(mp.parts, fmt.Sprintf("\r\n--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", mp.boundary, contentType, r.contentRange(size)))
+	}
+	return mp
+}
+
+func (mp *multipartRanges) closing() string {
+	return "\r\n--" + mp.boundary + "--\r\n"
+}
+
+func (mp *multipartRanges) length() int64 {
+	n := int64(len(mp.closing()))
+	for i, part := range mp.parts {
+		n += int64(len(part)) + mp.ranges[i].length
+	}
+	return n
+}
+
+func (mp *multipartRanges) write(w io.Writer, file io.ReaderAt) error {
+	for i, part := range mp.parts {
+		if _, err := io.WriteString(w, part); err != nil {
+			return err
+		}
+		r := mp.ranges[i]
+		if _, err := io.Copy(w, io.NewSectionReader(file, r.start, r.length)); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, mp.closing())
+	return err
+}
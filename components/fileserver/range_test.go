@@ -0,0 +1,47 @@
+package fileserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []byteRange
+		err    bool
+	}{
+		{"", nil, false},
+		{"bytes=0-0", []byteRange{{0, 1}}, false},
+		{"bytes=0-99", []byteRange{{0, 100}}, false},
+		{"bytes=900-", []byteRange{{900, 100}}, false},
+		{"bytes=-100", []byteRange{{900, 100}}, false},
+		{"bytes=-5000", []byteRange{{0, 1000}}, false},
+		{"bytes=990-5000", []byteRange{{990, 10}}, false},
+		{"bytes= 0-1 , 5-6", []byteRange{{0, 2}, {5, 2}}, false},
+		// the unsatisfiable part is dropped
+		{"bytes=0-1, 2000-3000", []byteRange{{0, 2}}, false},
+		{"bytes=5-1", nil, true},
+		{"bytes=a-b", nil, true},
+		{"bytes=+1-2", nil, true},
+		{"bytes=1", nil, true},
+		{"items=0-1", nil, true},
+		{"bytes=0-999, 0-999", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRange(tt.header, 1000)
+		if tt.err {
+			assert.Error(t, err, tt.header)
+			continue
+		}
+		require.NoError(t, err, tt.header)
+		assert.Equal(t, tt.want, got, tt.header)
+	}
+
+	_, err := parseRange("bytes=1000-", 1000)
+	assert.ErrorIs(t, err, errUnsatisfiable)
+	_, err = parseRange("bytes=-0", 1000)
+	assert.ErrorIs(t, err, errUnsatisfiable)
+}
@@ -14,41 +14,159 @@ const CR_DELIMETER = '\r'
 const LN_DELIMETER = '\n'
 
 var (
-	CONTENT_LENGTH = "Content-length"
-	CONTENT_TYPE   = "Content-type"
+	CONTENT_LENGTH    = "Content-length"
+	CONTENT_TYPE      = "Content-type"
+	CONNECTION        = "Connection"
+	TRANSFER_ENCODING = "Transfer-encoding"
+	TRAILER           = "Trailer"
+	CONTENT_ENCODING  = "Content-encoding"
+	ACCEPT_ENCODING   = "Accept-encoding"
+	VARY              = "Vary"
 )
 
+// Field that can't be combined in a single comma-separated value (RFC 9110 section 5.3)
+const SET_COOKIE = "Set-cookie"
+
+// Headers stores field names lowercase, each name can have several values.
+// Iteration follows the insertion order of the names.
 type Headers struct {
-	headers map[string]string
+	headers map[string][]string
+	order   []string
 }
 
 func NewHeaders() *Headers {
 	return &Headers{
-		headers: map[string]string{},
+		headers: map[string][]string{},
 	}
 }
 
+// Get returns the values of the field joined by ", ", use Values for Set-Cookie
 func (h *Headers) Get(v string) string {
-	return h.headers[strings.ToLower(v)]
+	return strings.Join(h.headers[strings.ToLower(v)], ", ")
+}
+
+// Values returns a copy of every value of the field
+func (h *Headers) Values(k string) []string {
+	return append([]string(nil), h.headers[strings.ToLower(k)]...)
 }
 
-func (h *Headers) GetContentLength() int {
-	len := h.Get(CONTENT_LENGTH)
-	if len == "" {
-		return 0
+func (h *Headers) Has(k string) bool {
+	_, ok := h.headers[strings.ToLower(k)]
+	return ok
+}
+
+// GetContentLength returns 0 when the field is missing. Repeated fields (e.g. "5, 5") are accepted
+// only if they have the same value, signs, spaces, empty and non-digit values are errors (RFC 9110 section 8.6)
+func (h *Headers) GetContentLength() (int, error) {
+	if !h.Has(CONTENT_LENGTH) {
+		return 0, nil
+	}
+	values := h.Get(CONTENT_LENGTH)
+	length := -1
+	for _, v := range strings.Split(values, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" || strings.TrimLeft(v, "0123456789") != "" {
+			return 0, fmt.Errorf("invalid Content-Length: %q", values)
+		}
+		val, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid Content-Length: %q", values)
+		}
+		if length != -1 && val != length {
+			return 0, fmt.Errorf("conflicting Content-Length values: %q", values)
+		}
+		length = val
 	}
-	val, _ := strconv.Atoi(len)
-	return val
+	return length, nil
 }
 
+// Len returns the number of distinct fields
+func (h *Headers) Len() int {
+	return len(h.headers)
+}
+
+// HasToken reports whether the comma-separated value of k contains token (case-insensitive),
+// e.g. HasToken("Connection", "close") for "Connection: keep-alive, close"
+func (h *Headers) HasToken(k string, token string) bool {
+	for _, t := range strings.Split(h.Get(k), ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Set replaces the values of the field
 func (h *Headers) Set(k string, v string) bool {
 	if k != "" && v != "" {
-		h.headers[strings.ToLower(k)] = v
+		k = strings.ToLower(k)
+		if _, ok := h.headers[k]; !ok {
+			h.order = append(h.order, k)
+		}
+		h.headers[k] = []string{v}
 		return true
 	}
 	return false
 }
 
+// Add appends a value to the field, each value is written in its own field line
+func (h *Headers) Add(k string, v string) bool {
+	if k != "" && v != "" {
+		k = strings.ToLower(k)
+		if _, ok := h.headers[k]; !ok {
+			h.order = append(h.order, k)
+		}
+		h.headers[k] = append(h.headers[k], v)
+		return true
+	}
+	return false
+}
+
+func (h *Headers) Del(k string) {
+	k = strings.ToLower(k)
+	if _, ok := h.headers[k]; !ok {
+		return
+	}
+	delete(h.headers, k)
+	for i, name := range h.order {
+		if name == k {
+			h.order = append(h.order[:i:i], h.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (h *Headers) Clone() *Headers {
+	clone := NewHeaders()
+	for _, k := range h.order {
+		clone.order = append(clone.order, k)
+		clone.headers[k] = append([]string(nil), h.headers[k]...)
+	}
+	return clone
+}
+
+// combine adds a parsed field line: repeated fields are combined in a comma-separated
+// value as required by RFC 9110 section 5.3, except Set-Cookie that keeps its values separated.
+// Empty values are dropped, except for the framing fields: an empty Content-Length or
+// Transfer-Encoding is invalid (RFC 9112 section 6.3) and must not read as a missing field.
+func (h *Headers) combine(k string, v string) {
+	k = strings.ToLower(k)
+	framing := k == strings.ToLower(CONTENT_LENGTH) || k == strings.ToLower(TRANSFER_ENCODING)
+	values, ok := h.headers[k]
+	if !ok || k == strings.ToLower(SET_COOKIE) {
+		if v == "" && framing {
+			h.order = append(h.order, k)
+			h.headers[k] = []string{""}
+			return
+		}
+		h.Add(k, v)
+		return
+	}
+	if v != "" || framing {
+		values[0] += ", " + v
+	}
+}
+
 // Parse bytes that should contains valid field-value and line-separator (\r\n)
 func (h *Headers) ParseAll(data []byte) (read int, done bool, er error) {
 
@@ -61,7 +179,7 @@ func (h *Headers) ParseAll(data []byte) (read int, done bool, er error) {
 
 	for i := range data {
 
-		if data[i] == CR_DELIMETER && data[(i+1)%len(data)] == LN_DELIMETER {
+		if data[i] == CR_DELIMETER && i+1 < len(data) && data[i+1] == LN_DELIMETER {
 			endId = i
 		} else {
 			continue
@@ -69,7 +187,7 @@ func (h *Headers) ParseAll(data []byte) (read int, done bool, er error) {
 
 		if k, v, err = parseHeader(data[startId:endId]); err == nil {
 			if k != nil {
-				h.Set(string(k), string(v))
+				h.combine(string(k), string(v))
 			} else {
 				// HEADER is EMPTY, so we assume there are no more headers to parse
 				dne = true
@@ -78,6 +196,11 @@ func (h *Headers) ParseAll(data []byte) (read int, done bool, er error) {
 			break
 		}
 		startId = endId + 2
+
+		// anything after the empty line belongs to the body (or to the next request)
+		if dne {
+			break
+		}
 	}
 	return startId, dne, err
 }
@@ -92,15 +215,18 @@ func (h *Headers) Parse(data []byte) (read int, er error) {
 	)
 
 	if k, v, err = parseHeader(data); err == nil {
-		h.Set(string(k), string(v))
+		h.combine(string(k), string(v))
 	}
 
 	return rd, err
 }
 
+// ForEach calls cb for each value in insertion order, a field with several values is visited once per value
 func (h *Headers) ForEach(cb func(k, v string)) {
-	for k, v := range h.headers {
-		cb(k, v)
+	for _, k := range h.order {
+		for _, v := range h.headers[k] {
+			cb(k, v)
+		}
 	}
 }
 
@@ -108,17 +234,28 @@ func parseHeader(line []byte) ([]byte, []byte, error) {
 	if len(line) == 0 {
 		return nil, nil, nil
 	}
+	// obs-fold (a line continuing the previous field) is deprecated and ambiguous (RFC 9112 section 5.2)
+	if line[0] == ' ' || line[0] == '\t' {
+		return nil, nil, fmt.Errorf("obsolete line folding is not allowed")
+	}
 	splt := bytes.SplitN(line, []byte{':'}, 2)
 
-	if len(splt) != 2 || bytes.HasSuffix(splt[0], []byte{' '}) {
+	// no whitespace is allowed between the field name and the colon (RFC 9112 section 5.1)
+	if len(splt) != 2 || bytes.HasSuffix(splt[0], []byte{' '}) || bytes.HasSuffix(splt[0], []byte{'\t'}) {
 		return nil, nil, fmt.Errorf("malformed Header")
 	}
 
-	k, v := bytes.TrimSpace(splt[0]), bytes.TrimSpace(splt[1])
+	k, v := splt[0], bytes.Trim(splt[1], " \t")
 
-	if ok, c := isToken(k); !ok {
+	if ok, c := IsToken(k); !ok {
 		return nil, nil, fmt.Errorf("field-value header doesn't contains a valid characters: %c", c)
 	}
+	// bare CR, bare LF and other control characters could split the field downstream
+	for _, c := range v {
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return nil, nil, fmt.Errorf("invalid character in field-value of %s: %q", k, c)
+		}
+	}
 
 	return k, v, nil
 }
@@ -126,7 +263,8 @@ func parseHeader(line []byte) ([]byte, []byte, error) {
 // field-value VALIDATOR
 var specialChars = []byte{'!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~'}
 
-func isToken(chars []byte) (bool, byte) {
+// IsToken reports whether chars is a valid token (RFC 9110 section 5.6.2), otherwise it returns the first invalid character
+func IsToken(chars []byte) (bool, byte) {
 	for _, c := range chars {
 		if !(bytes.Contains(specialChars, []byte{c}) ||
 			'a' <= c && c <= 'z' ||
@@ -35,3 +35,52 @@ func TestHeaderParse(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
+
+func TestHeaderMultipleValues(t *testing.T) {
+	// Test: repeated fields are combined, Set-Cookie is kept separated
+	headers := NewHeaders()
+	data := []byte("Accept: text/html\r\nSet-Cookie: a=1; Expires=Wed, 21 Oct 2025 07:28:00 GMT\r\nAccept: application/json\r\nSet-Cookie: b=2\r\n\r\n")
+	_, done, err := headers.ParseAll(data)
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, "text/html, application/json", headers.Get("accept"))
+	assert.Equal(t, []string{"text/html, application/json"}, headers.Values("Accept"))
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2025 07:28:00 GMT", "b=2"}, headers.Values("Set-Cookie"))
+	assert.Equal(t, 2, headers.Len())
+
+	// Test: Add, Set, Del, Has
+	headers = NewHeaders()
+	headers.Add("Via", "1.1 a")
+	headers.Add("via", "1.1 b")
+	assert.Equal(t, []string{"1.1 a", "1.1 b"}, headers.Values("Via"))
+	assert.Equal(t, "1.1 a, 1.1 b", headers.Get("Via"))
+	headers.Set("Via", "1.1 c")
+	assert.Equal(t, []string{"1.1 c"}, headers.Values("Via"))
+	assert.True(t, headers.Has("VIA"))
+	headers.Del("Via")
+	assert.False(t, headers.Has("Via"))
+	assert.Empty(t, headers.Values("Via"))
+
+	// Test: Clone doesn't share values
+	headers.Add("X-A", "1")
+	clone := headers.Clone()
+	clone.Add("X-A", "2")
+	assert.Equal(t, []string{"1"}, headers.Values("X-A"))
+	assert.Equal(t, []string{"1", "2"}, clone.Values("X-A"))
+}
+
+func TestHeaderOrder(t *testing.T) {
+	headers := NewHeaders()
+	headers.Set("Zeta", "1")
+	headers.Add("Alpha", "2")
+	headers.Set("Mid", "3")
+	headers.Add("Zeta", "4")
+	headers.Del("Mid")
+	headers.Set("Mid", "5")
+
+	var fields []string
+	headers.ForEach(func(k, v string) {
+		fields = append(fields, k+": "+v)
+	})
+	assert.Equal(t, []string{"zeta: 1", "zeta: 4", "alpha: 2", "mid: 5"}, fields)
+}
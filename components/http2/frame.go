@@ -0,0 +1,353 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// CLIENT_PREFACE starts every HTTP/2 connection, it's followed by a SETTINGS frame (RFC 9113 section 3.4)
+const CLIENT_PREFACE = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Length, type, flags and stream identifier
+const FRAME_HEADER_LEN = 9
+
+// Frame payloads are bounded by SETTINGS_MAX_FRAME_SIZE, which can't go below or above these values
+const (
+	DEFAULT_MAX_FRAME_SIZE = 1 << 14
+	MAX_FRAME_SIZE_LIMIT   = 1<<24 - 1
+)
+
+// Flow-control windows start at DEFAULT_INITIAL_WINDOW_SIZE and can't exceed MAX_WINDOW_SIZE
+const (
+	DEFAULT_INITIAL_WINDOW_SIZE = 65535
+	MAX_WINDOW_SIZE             = 1<<31 - 1
+)
+
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+func (t FrameType) String() string {
+	names := []string{"DATA", "HEADERS", "PRIORITY", "RST_STREAM", "SETTINGS", "PUSH_PROMISE", "PING", "GOAWAY", "WINDOW_UPDATE", "CONTINUATION"}
+	if int(t) < len(names) {
+		return names[t]
+	}
+	return fmt.Sprintf("UNKNOWN_FRAME_0x%x", uint8(t))
+}
+
+type Flags uint8
+
+const (
+	// DATA and HEADERS
+	FlagEndStream Flags = 0x1
+	// SETTINGS and PING
+	FlagAck Flags = 0x1
+	// HEADERS, PUSH_PROMISE and CONTINUATION
+	FlagEndHeaders Flags = 0x4
+	// DATA, HEADERS and PUSH_PROMISE
+	FlagPadded Flags = 0x8
+	// HEADERS
+	FlagPriority Flags = 0x20
+)
+
+// ErrorCode is sent in RST_STREAM and GOAWAY frames (RFC 9113 section 7)
+type ErrorCode uint32
+
+const (
+	ErrCodeNo                 ErrorCode = 0x0
+	ErrCodeProtocol           ErrorCode = 0x1
+	ErrCodeInternal           ErrorCode = 0x2
+	ErrCodeFlowControl        ErrorCode = 0x3
+	ErrCodeSettingsTimeout    ErrorCode = 0x4
+	ErrCodeStreamClosed       ErrorCode = 0x5
+	ErrCodeFrameSize          ErrorCode = 0x6
+	ErrCodeRefusedStream      ErrorCode = 0x7
+	ErrCodeCancel             ErrorCode = 0x8
+	ErrCodeCompression        ErrorCode = 0x9
+	ErrCodeConnect            ErrorCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrorCode = 0xb
+	ErrCodeInadequateSecurity ErrorCode = 0xc
+	ErrCodeHTTP11Required     ErrorCode = 0xd
+)
+
+func (c ErrorCode) String() string {
+	names := []string{"NO_ERROR", "PROTOCOL_ERROR", "INTERNAL_ERROR", "FLOW_CONTROL_ERROR", "SETTINGS_TIMEOUT", "STREAM_CLOSED", "FRAME_SIZE_ERROR",
+		"REFUSED_STREAM", "CANCEL", "COMPRESSION_ERROR", "CONNECT_ERROR", "ENHANCE_YOUR_CALM", "INADEQUATE_SECURITY", "HTTP_1_1_REQUIRED"}
+	if int(c) < len(names) {
+		return names[c]
+	}
+	return fmt.Sprintf("UNKNOWN_ERROR_0x%x", uint32(c))
+}
+
+// ConnError is a connection error: GOAWAY is sent with Code and the connection is closed
+type ConnError struct {
+	Code   ErrorCode
+	Reason string
+}
+
+func (e *ConnError) Error() string {
+	return fmt.Sprintf("http2: connection error %v: %s", e.Code, e.Reason)
+}
+
+// StreamError is a stream error: the stream is reset with Code, the connection keeps serving the other ones
+type StreamError struct {
+	StreamID uint32
+	Code     ErrorCode
+	Reason   string
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %v: %s", e.StreamID, e.Code, e.Reason)
+}
+
+func connError(code ErrorCode, format string, args ...any) *ConnError {
+	return &ConnError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+func streamError(id uint32, code ErrorCode, format string, args ...any) *StreamError {
+	return &StreamError{StreamID: id, Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Frame (RFC 9113 section 4.1):
+//
+//	length (24) | type (8) | flags (8) | R (1) stream identifier (31) | payload
+type Frame struct {
+	Type     FrameType
+	Flags    Flags
+	StreamID uint32
+	Payload  []byte
+}
+
+func (f *Frame) Has(flag Flags) bool {
+	return f.Flags&flag != 0
+}
+
+// ReadFrame decodes a frame and checks the fields every frame of its type must respect.
+// A payload bigger than maxSize is rejected before reading it. Unknown types are returned as they are,
+// the receiver must ignore them.
+func ReadFrame(r io.Reader, maxSize uint32) (*Frame, error) {
+	var head [FRAME_HEADER_LEN]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	length := uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2])
+	f := &Frame{
+		Type:     FrameType(head[3]),
+		Flags:    Flags(head[4]),
+		StreamID: binary.BigEndian.Uint32(head[5:]) & (1<<31 - 1),
+	}
+	if length > maxSize {
+		return nil, connError(ErrCodeFrameSize, "%v frame of %d bytes, limit %d", f.Type, length, maxSize)
+	}
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return f, f.validate()
+}
+
+// validate applies the rules of RFC 9113 section 6 that don't depend on the state of the connection
+func (f *Frame) validate() error {
+	onStream := f.StreamID != 0
+	switch f.Type {
+	case FrameData, FrameHeaders, FrameContinuation, FramePushPromise:
+		if !onStream {
+			return connError(ErrCodeProtocol, "%v frame on stream 0", f.Type)
+		}
+	case FramePriority:
+		if !onStream {
+			return connError(ErrCodeProtocol, "PRIORITY frame on stream 0")
+		}
+		if len(f.Payload) != 5 {
+			return streamError(f.StreamID, ErrCodeFrameSize, "PRIORITY frame of %d bytes", len(f.Payload))
+		}
+	case FrameRSTStream:
+		if !onStream {
+			return connError(ErrCodeProtocol, "RST_STREAM frame on stream 0")
+		}
+		if len(f.Payload) != 4 {
+			return connError(ErrCodeFrameSize, "RST_STREAM frame of %d bytes", len(f.Payload))
+		}
+	case FrameSettings:
+		if onStream {
+			return connError(ErrCodeProtocol, "SETTINGS frame on stream %d", f.StreamID)
+		}
+		if f.Has(FlagAck) && len(f.Payload) > 0 {
+			return connError(ErrCodeFrameSize, "SETTINGS acknowledgment with a payload")
+		}
+		if len(f.Payload)%6 != 0 {
+			return connError(ErrCodeFrameSize, "SETTINGS frame of %d bytes", len(f.Payload))
+		}
+	case FramePing:
+		if onStream {
+			return connError(ErrCodeProtocol, "PING frame on stream %d", f.StreamID)
+		}
+		if len(f.Payload) != 8 {
+			return connError(ErrCodeFrameSize, "PING frame of %d bytes", len(f.Payload))
+		}
+	case FrameGoAway:
+		if onStream {
+			return connError(ErrCodeProtocol, "GOAWAY frame on stream %d", f.StreamID)
+		}
+		if len(f.Payload) < 8 {
+			return connError(ErrCodeFrameSize, "GOAWAY frame of %d bytes", len(f.Payload))
+		}
+	case FrameWindowUpdate:
+		if len(f.Payload) != 4 {
+			return connError(ErrCodeFrameSize, "WINDOW_UPDATE frame of %d bytes", len(f.Payload))
+		}
+	}
+	return nil
+}
+
+// WriteFrame encodes f, the payload must fit in the SETTINGS_MAX_FRAME_SIZE of the peer
+func WriteFrame(w io.Writer, f *Frame) error {
+	length := len(f.Payload)
+	if length > MAX_FRAME_SIZE_LIMIT {
+		return fmt.Errorf("http2: %v payload of %d bytes", f.Type, length)
+	}
+	buf := make([]byte, FRAME_HEADER_LEN, FRAME_HEADER_LEN+length)
+	buf[0], buf[1], buf[2] = byte(length>>16), byte(length>>8), byte(length)
+	buf[3], buf[4] = byte(f.Type), byte(f.Flags)
+	binary.BigEndian.PutUint32(buf[5:], f.StreamID&(1<<31-1))
+	_, err := w.Write(append(buf, f.Payload...))
+	return err
+}
+
+// Data returns the content of a DATA frame without the padding
+func (f *Frame) Data() ([]byte, error) {
+	return f.unpad(f.Payload)
+}
+
+// HeaderBlock returns the field block fragment of a HEADERS or CONTINUATION frame,
+// without the padding and the priority fields
+func (f *Frame) HeaderBlock() ([]byte, error) {
+	if f.Type == FrameContinuation {
+		return f.Payload, nil
+	}
+	block, err := f.unpad(f.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if f.Has(FlagPriority) {
+		if len(block) < 5 {
+			return nil, connError(ErrCodeProtocol, "HEADERS frame too short for the priority fields")
+		}
+		// the priority signaling of RFC 7540 is deprecated, only the self-dependency is checked
+		if binary.BigEndian.Uint32(block)&(1<<31-1) == f.StreamID {
+			return nil, streamError(f.StreamID, ErrCodeProtocol, "stream depends on itself")
+		}
+		block = block[5:]
+	}
+	return block, nil
+}
+
+// unpad removes the Pad Length field and the padding, the padding can't cover the whole payload
+func (f *Frame) unpad(p []byte) ([]byte, error) {
+	if !f.Has(FlagPadded) {
+		return p, nil
+	}
+	if len(p) == 0 || int(p[0]) >= len(p) {
+		return nil, connError(ErrCodeProtocol, "%v frame with invalid padding", f.Type)
+	}
+	return p[1 : len(p)-int(p[0])], nil
+}
+
+// SettingID identifies a parameter of a SETTINGS frame (RFC 9113 section 6.5.2)
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+type Setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+// Settings returns the parameters of a SETTINGS frame, out of range values are connection errors
+func (f *Frame) Settings() ([]Setting, error) {
+	settings := make([]Setting, 0, len(f.Payload)/6)
+	for p := f.Payload; len(p) >= 6; p = p[6:] {
+		s := Setting{ID: SettingID(binary.BigEndian.Uint16(p)), Value: binary.BigEndian.Uint32(p[2:])}
+		switch {
+		case s.ID == SettingEnablePush && s.Value > 1:
+			return nil, connError(ErrCodeProtocol, "SETTINGS_ENABLE_PUSH %d", s.Value)
+		case s.ID == SettingInitialWindowSize && s.Value > MAX_WINDOW_SIZE:
+			return nil, connError(ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE %d", s.Value)
+		case s.ID == SettingMaxFrameSize && (s.Value < DEFAULT_MAX_FRAME_SIZE || s.Value > MAX_FRAME_SIZE_LIMIT):
+			return nil, connError(ErrCodeProtocol, "SETTINGS_MAX_FRAME_SIZE %d", s.Value)
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
+
+func SettingsFrame(settings ...Setting) *Frame {
+	payload := make([]byte, 0, 6*len(settings))
+	for _, s := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(s.ID))
+		payload = binary.BigEndian.AppendUint32(payload, s.Value)
+	}
+	return &Frame{Type: FrameSettings, Payload: payload}
+}
+
+// WindowIncrement returns the increment of a WINDOW_UPDATE frame, it can't be zero
+func (f *Frame) WindowIncrement() (uint32, error) {
+	incr := binary.BigEndian.Uint32(f.Payload) & (1<<31 - 1)
+	if incr == 0 {
+		if f.StreamID == 0 {
+			return 0, connError(ErrCodeProtocol, "WINDOW_UPDATE with a zero increment")
+		}
+		return 0, streamError(f.StreamID, ErrCodeProtocol, "WINDOW_UPDATE with a zero increment")
+	}
+	return incr, nil
+}
+
+func WindowUpdateFrame(streamID uint32, incr uint32) *Frame {
+	return &Frame{Type: FrameWindowUpdate, StreamID: streamID, Payload: binary.BigEndian.AppendUint32(nil, incr)}
+}
+
+// ErrorCode returns the error code of a RST_STREAM or GOAWAY frame
+func (f *Frame) ErrorCode() ErrorCode {
+	if f.Type == FrameGoAway {
+		return ErrorCode(binary.BigEndian.Uint32(f.Payload[4:]))
+	}
+	return ErrorCode(binary.BigEndian.Uint32(f.Payload))
+}
+
+func RSTStreamFrame(streamID uint32, code ErrorCode) *Frame {
+	return &Frame{Type: FrameRSTStream, StreamID: streamID, Payload: binary.BigEndian.AppendUint32(nil, uint32(code))}
+}
+
+// LastStreamID returns the last stream a GOAWAY sender has processed or might process
+func (f *Frame) LastStreamID() uint32 {
+	return binary.BigEndian.Uint32(f.Payload) & (1<<31 - 1)
+}
+
+// GoAwayFrame tells the peer that streams after lastStreamID won't be processed, debug is opaque diagnostic data
+func GoAwayFrame(lastStreamID uint32, code ErrorCode, debug string) *Frame {
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	return &Frame{Type: FrameGoAway, Payload: append(payload, debug...)}
+}
@@ -0,0 +1,125 @@
+package http2
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func assertConnError(t *testing.T, err error, code ErrorCode, msgAndArgs ...any) {
+	var cErr *ConnError
+	require.ErrorAs(t, err, &cErr, msgAndArgs...)
+	assert.Equal(t, code, cErr.Code, msgAndArgs...)
+}
+
+func TestFrame(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		frames := []*Frame{
+			{Type: FrameData, Flags: FlagEndStream, StreamID: 1, Payload: []byte("hello")},
+			{Type: FrameHeaders, Flags: FlagEndHeaders, StreamID: 3, Payload: []byte{0x82}},
+			SettingsFrame(Setting{SettingMaxFrameSize, 1 << 20}, Setting{SettingEnablePush, 0}),
+			WindowUpdateFrame(5, 1000),
+			RSTStreamFrame(7, ErrCodeCancel),
+			GoAwayFrame(9, ErrCodeProtocol, "bye"),
+			{Type: FramePing, Payload: make([]byte, 8)},
+		}
+		var buf bytes.Buffer
+		for _, f := range frames {
+			require.NoError(t, WriteFrame(&buf, f))
+		}
+		for _, want := range frames {
+			f, err := ReadFrame(&buf, DEFAULT_MAX_FRAME_SIZE)
+			require.NoError(t, err)
+			assert.Equal(t, want.Type, f.Type)
+			assert.Equal(t, want.Flags, f.Flags)
+			assert.Equal(t, want.StreamID, f.StreamID)
+			assert.Equal(t, len(want.Payload), len(f.Payload))
+		}
+	})
+
+	t.Run("payload helpers", func(t *testing.T) {
+		settings, err := SettingsFrame(Setting{SettingInitialWindowSize, 1 << 16}).Settings()
+		require.NoError(t, err)
+		assert.Equal(t, []Setting{{SettingInitialWindowSize, 1 << 16}}, settings)
+
+		incr, err := WindowUpdateFrame(1, 42).WindowIncrement()
+		require.NoError(t, err)
+		assert.Equal(t, uint32(42), incr)
+
+		goAway := GoAwayFrame(11, ErrCodeEnhanceYourCalm, "")
+		assert.Equal(t, uint32(11), goAway.LastStreamID())
+		assert.Equal(t, ErrCodeEnhanceYourCalm, goAway.ErrorCode())
+		assert.Equal(t, ErrCodeCancel, RSTStreamFrame(1, ErrCodeCancel).ErrorCode())
+	})
+
+	t.Run("padding and priority", func(t *testing.T) {
+		data := &Frame{Type: FrameData, Flags: FlagPadded, StreamID: 1, Payload: []byte{2, 'h', 'i', 0, 0}}
+		p, err := data.Data()
+		require.NoError(t, err)
+		assert.Equal(t, "hi", string(p))
+
+		headers := &Frame{Type: FrameHeaders, Flags: FlagPadded | FlagPriority, StreamID: 1, Payload: []byte{1, 0, 0, 0, 3, 16, 0x82, 0}}
+		block, err := headers.HeaderBlock()
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x82}, block)
+
+		data.Payload = []byte{5, 'h', 'i'}
+		_, err = data.Data()
+		assertConnError(t, err, ErrCodeProtocol)
+
+		selfDependent := &Frame{Type: FrameHeaders, Flags: FlagPriority, StreamID: 1, Payload: []byte{0, 0, 0, 1, 16}}
+		_, err = selfDependent.HeaderBlock()
+		var sErr *StreamError
+		assert.ErrorAs(t, err, &sErr)
+	})
+
+	t.Run("frame size", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, WriteFrame(&buf, &Frame{Type: FrameData, StreamID: 1, Payload: make([]byte, DEFAULT_MAX_FRAME_SIZE+1)}))
+		_, err := ReadFrame(&buf, DEFAULT_MAX_FRAME_SIZE)
+		assertConnError(t, err, ErrCodeFrameSize)
+	})
+
+	t.Run("invalid frames", func(t *testing.T) {
+		tests := map[string]struct {
+			frame *Frame
+			code  ErrorCode
+		}{
+			"DATA on stream 0":          {&Frame{Type: FrameData}, ErrCodeProtocol},
+			"SETTINGS on a stream":      {&Frame{Type: FrameSettings, StreamID: 1}, ErrCodeProtocol},
+			"SETTINGS ack with payload": {&Frame{Type: FrameSettings, Flags: FlagAck, Payload: make([]byte, 6)}, ErrCodeFrameSize},
+			"SETTINGS partial":          {&Frame{Type: FrameSettings, Payload: make([]byte, 5)}, ErrCodeFrameSize},
+			"PING length":               {&Frame{Type: FramePing, Payload: make([]byte, 4)}, ErrCodeFrameSize},
+			"GOAWAY on a stream":        {&Frame{Type: FrameGoAway, StreamID: 1, Payload: make([]byte, 8)}, ErrCodeProtocol},
+			"RST_STREAM length":         {&Frame{Type: FrameRSTStream, StreamID: 1, Payload: make([]byte, 3)}, ErrCodeFrameSize},
+			"WINDOW_UPDATE length":      {&Frame{Type: FrameWindowUpdate, Payload: make([]byte, 5)}, ErrCodeFrameSize},
+		}
+		for name, tt := range tests {
+			var buf bytes.Buffer
+			require.NoError(t, WriteFrame(&buf, tt.frame))
+			_, err := ReadFrame(&buf, DEFAULT_MAX_FRAME_SIZE)
+			assertConnError(t, err, tt.code, name)
+		}
+	})
+
+	t.Run("invalid settings", func(t *testing.T) {
+		tests := map[string]struct {
+			setting Setting
+			code    ErrorCode
+		}{
+			"enable push": {Setting{SettingEnablePush, 2}, ErrCodeProtocol},
+			"window size": {Setting{SettingInitialWindowSize, MAX_WINDOW_SIZE + 1}, ErrCodeFlowControl},
+			"small frame": {Setting{SettingMaxFrameSize, DEFAULT_MAX_FRAME_SIZE - 1}, ErrCodeProtocol},
+			"huge frame":  {Setting{SettingMaxFrameSize, MAX_FRAME_SIZE_LIMIT + 1}, ErrCodeProtocol},
+		}
+		for name, tt := range tests {
+			_, err := SettingsFrame(tt.setting).Settings()
+			assertConnError(t, err, tt.code, name)
+		}
+
+		_, err := WindowUpdateFrame(0, 0).WindowIncrement()
+		assertConnError(t, err, ErrCodeProtocol)
+	})
+}
@@ -0,0 +1,416 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Size of the dynamic table until the peer changes it with SETTINGS_HEADER_TABLE_SIZE
+const DEFAULT_HEADER_TABLE_SIZE = 4096
+
+// Every table entry costs 32 bytes on top of its name and value (RFC 7541 section 4.1)
+const ENTRY_OVERHEAD = 32
+
+var ErrCompression = errors.New("hpack: invalid header block")
+
+// ErrHeaderListTooLarge is returned once the whole block is decoded, so the table stays in sync with the peer
+var ErrHeaderListTooLarge = errors.New("hpack: header list too large")
+
+// HeaderField is a name-value pair of a header block. A Sensitive field (e.g. a token) is never indexed,
+// neither by this encoder nor by the intermediaries that forward it.
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool
+}
+
+// Size is what the field costs in a table and in SETTINGS_MAX_HEADER_LIST_SIZE
+func (f HeaderField) Size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + ENTRY_OVERHEAD)
+}
+
+// RFC 7541 Appendix A
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// headerTable is the dynamic table, its indexes follow the static table and the newest entry comes first
+type headerTable struct {
+	entries []HeaderField // oldest first
+	size    uint32
+	maxSize uint32
+}
+
+func (t *headerTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.Size()
+	t.evict()
+}
+
+func (t *headerTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict()
+}
+
+// evict drops the oldest entries until the table fits, an entry bigger than the table empties it
+func (t *headerTable) evict() {
+	n := 0
+	for t.size > t.maxSize && n < len(t.entries) {
+		t.size -= t.entries[n].Size()
+		n++
+	}
+	if n > 0 {
+		t.entries = append(t.entries[:0], t.entries[n:]...)
+	}
+}
+
+// field returns the entry at index i, starting at 1 with the static table
+func (t *headerTable) field(i uint64) (HeaderField, bool) {
+	switch {
+	case i == 0:
+		return HeaderField{}, false
+	case i <= uint64(len(staticTable)):
+		return staticTable[i-1], true
+	case i-uint64(len(staticTable)) <= uint64(len(t.entries)):
+		return t.entries[len(t.entries)-int(i-uint64(len(staticTable)))], true
+	}
+	return HeaderField{}, false
+}
+
+// search returns the index of an entry matching f, nameOnly when only the name matches (0 when nothing does)
+func (t *headerTable) search(f HeaderField) (index uint64, nameOnly bool) {
+	for i, e := range staticTable {
+		if e.Name != f.Name {
+			continue
+		}
+		if e.Value == f.Value {
+			return uint64(i + 1), false
+		}
+		if index == 0 {
+			index = uint64(i + 1)
+		}
+	}
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		e := t.entries[i]
+		if e.Name != f.Name {
+			continue
+		}
+		dynIndex := uint64(len(staticTable) + len(t.entries) - i)
+		if e.Value == f.Value {
+			return dynIndex, false
+		}
+		if index == 0 {
+			index = dynIndex
+		}
+	}
+	return index, index != 0
+}
+
+// Encoder compresses the header blocks of a connection, the blocks must be sent in the order they are encoded
+type Encoder struct {
+	table headerTable
+	// smallest size set since the last block, both sizes are announced when it's smaller than the current one
+	minSize uint32
+	update  bool
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{table: headerTable{maxSize: DEFAULT_HEADER_TABLE_SIZE}}
+}
+
+// SetMaxTableSize applies the SETTINGS_HEADER_TABLE_SIZE of the peer, the table never grows beyond
+// DEFAULT_HEADER_TABLE_SIZE. The change is announced at the start of the next block.
+func (e *Encoder) SetMaxTableSize(n uint32) {
+	n = min(n, DEFAULT_HEADER_TABLE_SIZE)
+	if n == e.table.maxSize {
+		return
+	}
+	if !e.update {
+		e.minSize = e.table.maxSize
+		e.update = true
+	}
+	e.minSize = min(e.minSize, n)
+	e.table.setMaxSize(n)
+}
+
+// Encode returns the header block of fields: known fields are indexed, the other ones are added
+// to the table unless they are sensitive or bigger than the table
+func (e *Encoder) Encode(fields []HeaderField) []byte {
+	var dst []byte
+	if e.update {
+		if e.minSize < e.table.maxSize {
+			dst = appendInt(dst, 0x20, 5, uint64(e.minSize))
+		}
+		dst = appendInt(dst, 0x20, 5, uint64(e.table.maxSize))
+		e.update = false
+	}
+	for _, f := range fields {
+		index, nameOnly := e.table.search(f)
+		switch {
+		case f.Sensitive:
+			// literal never indexed
+			dst = appendLiteral(dst, 0x10, 4, index, f)
+		case index != 0 && !nameOnly:
+			dst = appendInt(dst, 0x80, 7, index)
+		case f.Size() <= e.table.maxSize:
+			// literal with incremental indexing
+			dst = appendLiteral(dst, 0x40, 6, index, f)
+			e.table.add(f)
+		default:
+			// literal without indexing
+			dst = appendLiteral(dst, 0x00, 4, index, f)
+		}
+	}
+	return dst
+}
+
+// Decoder decompresses the header blocks of a connection, in the order they are received
+type Decoder struct {
+	// MaxHeaderListSize bounds the sum of the field sizes, 0 means no limit
+	MaxHeaderListSize uint32
+
+	table headerTable
+	// the SETTINGS_HEADER_TABLE_SIZE sent to the peer, its size updates can't exceed it
+	maxTableSize uint32
+}
+
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{table: headerTable{maxSize: maxTableSize}, maxTableSize: maxTableSize}
+}
+
+// Decode returns the fields of a complete header block (HEADERS and its CONTINUATION frames).
+// Any error but ErrHeaderListTooLarge breaks the table, the connection can't be used anymore.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var (
+		fields   []HeaderField
+		count    int
+		listSize uint32
+		tooLarge bool
+	)
+	for len(block) > 0 {
+		var (
+			f   HeaderField
+			err error
+		)
+		b := block[0]
+		switch {
+		case b&0x80 != 0:
+			// indexed field
+			var index uint64
+			if index, block, err = readInt(block, 7); err != nil {
+				return nil, err
+			}
+			var ok bool
+			if f, ok = d.table.field(index); !ok {
+				return nil, fmt.Errorf("%w: index %d out of the tables", ErrCompression, index)
+			}
+		case b&0xc0 == 0x40:
+			// literal with incremental indexing
+			if f, block, err = d.readLiteral(block, 6); err != nil {
+				return nil, err
+			}
+			d.table.add(f)
+		case b&0xe0 == 0x20:
+			// dynamic table size update, only at the start of a block
+			var size uint64
+			if size, block, err = readInt(block, 5); err != nil {
+				return nil, err
+			}
+			if count > 0 {
+				return nil, fmt.Errorf("%w: table size update after a field", ErrCompression)
+			}
+			if size > uint64(d.maxTableSize) {
+				return nil, fmt.Errorf("%w: table size %d over the limit %d", ErrCompression, size, d.maxTableSize)
+			}
+			d.table.setMaxSize(uint32(size))
+			continue
+		default:
+			// literal without indexing (0000) or never indexed (0001)
+			sensitive := b&0x10 != 0
+			if f, block, err = d.readLiteral(block, 4); err != nil {
+				return nil, err
+			}
+			f.Sensitive = sensitive
+		}
+
+		count++
+		listSize += f.Size()
+		if d.MaxHeaderListSize > 0 && listSize > d.MaxHeaderListSize {
+			// keep decoding to update the table, the fields are dropped
+			tooLarge = true
+			fields = nil
+		}
+		if !tooLarge {
+			fields = append(fields, f)
+		}
+	}
+	if tooLarge {
+		return nil, ErrHeaderListTooLarge
+	}
+	return fields, nil
+}
+
+// readLiteral reads a literal field whose name is either indexed or a string literal
+func (d *Decoder) readLiteral(block []byte, prefix uint8) (HeaderField, []byte, error) {
+	var (
+		f     HeaderField
+		index uint64
+		err   error
+	)
+	if index, block, err = readInt(block, prefix); err != nil {
+		return f, nil, err
+	}
+	if index != 0 {
+		named, ok := d.table.field(index)
+		if !ok {
+			return f, nil, fmt.Errorf("%w: index %d out of the tables", ErrCompression, index)
+		}
+		f.Name = named.Name
+	} else if f.Name, block, err = readString(block); err != nil {
+		return f, nil, err
+	}
+	if f.Value, block, err = readString(block); err != nil {
+		return f, nil, err
+	}
+	return f, block, nil
+}
+
+// appendLiteral appends a literal field with the representation pattern in the bits above prefix
+func appendLiteral(dst []byte, pattern byte, prefix uint8, nameIndex uint64, f HeaderField) []byte {
+	dst = appendInt(dst, pattern, prefix, nameIndex)
+	if nameIndex == 0 {
+		dst = appendString(dst, f.Name)
+	}
+	return appendString(dst, f.Value)
+}
+
+// appendInt appends v with an N-bit prefix, the bits above the prefix hold pattern (RFC 7541 section 5.1)
+func appendInt(dst []byte, pattern byte, prefix uint8, v uint64) []byte {
+	limit := uint64(1)<<prefix - 1
+	if v < limit {
+		return append(dst, pattern|byte(v))
+	}
+	dst = append(dst, pattern|byte(limit))
+	for v -= limit; v >= 0x80; v >>= 7 {
+		dst = append(dst, byte(v)|0x80)
+	}
+	return append(dst, byte(v))
+}
+
+// readInt reads an integer with an N-bit prefix, values that don't fit in 32 bits are rejected
+func readInt(src []byte, prefix uint8) (uint64, []byte, error) {
+	limit := uint64(1)<<prefix - 1
+	v := uint64(src[0]) & limit
+	src = src[1:]
+	if v < limit {
+		return v, src, nil
+	}
+	for shift := 0; ; shift += 7 {
+		if len(src) == 0 {
+			return 0, nil, fmt.Errorf("%w: truncated integer", ErrCompression)
+		}
+		b := src[0]
+		src = src[1:]
+		v += uint64(b&0x7f) << shift
+		if v > 1<<32 {
+			return 0, nil, fmt.Errorf("%w: integer overflow", ErrCompression)
+		}
+		if b&0x80 == 0 {
+			return v, src, nil
+		}
+	}
+}
+
+// appendString appends a string literal, Huffman-encoded when that's shorter
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return huffmanEncode(dst, s)
+	}
+	dst = appendInt(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func readString(src []byte) (string, []byte, error) {
+	if len(src) == 0 {
+		return "", nil, fmt.Errorf("%w: missing string literal", ErrCompression)
+	}
+	huffman := src[0]&0x80 != 0
+	length, src, err := readInt(src, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(src)) {
+		return "", nil, fmt.Errorf("%w: truncated string literal", ErrCompression)
+	}
+	raw := src[:length]
+	src = src[length:]
+	if !huffman {
+		return string(raw), src, nil
+	}
+	decoded, err := huffmanDecode(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %w", ErrCompression, err)
+	}
+	return string(decoded), src, nil
+}
@@ -0,0 +1,128 @@
+package http2
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+// requests of RFC 7541 Appendix C.3 (plain strings) and C.4 (Huffman), sent on the same connection
+var rfcRequests = []struct {
+	fields  []HeaderField
+	plain   string
+	huffman string
+}{
+	{
+		fields:  []HeaderField{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: ":authority", Value: "www.example.com"}},
+		plain:   "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+		huffman: "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+	},
+	{
+		fields:  []HeaderField{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: ":authority", Value: "www.example.com"}, {Name: "cache-control", Value: "no-cache"}},
+		plain:   "8286 84be 5808 6e6f 2d63 6163 6865",
+		huffman: "8286 84be 5886 a8eb 1064 9cbf",
+	},
+	{
+		fields:  []HeaderField{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "https"}, {Name: ":path", Value: "/index.html"}, {Name: ":authority", Value: "www.example.com"}, {Name: "custom-key", Value: "custom-value"}},
+		plain:   "8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+		huffman: "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+	},
+}
+
+func TestHpack(t *testing.T) {
+	t.Run("RFC 7541 plain requests", func(t *testing.T) {
+		dec := NewDecoder(DEFAULT_HEADER_TABLE_SIZE)
+		for _, r := range rfcRequests {
+			fields, err := dec.Decode(unhex(t, r.plain))
+			require.NoError(t, err)
+			assert.Equal(t, r.fields, fields)
+		}
+		assert.Equal(t, uint32(164), dec.table.size)
+	})
+
+	t.Run("RFC 7541 Huffman requests", func(t *testing.T) {
+		enc := NewEncoder()
+		dec := NewDecoder(DEFAULT_HEADER_TABLE_SIZE)
+		for _, r := range rfcRequests {
+			block := enc.Encode(r.fields)
+			assert.Equal(t, unhex(t, r.huffman), block)
+			fields, err := dec.Decode(block)
+			require.NoError(t, err)
+			assert.Equal(t, r.fields, fields)
+		}
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		enc := NewEncoder()
+		dec := NewDecoder(DEFAULT_HEADER_TABLE_SIZE)
+		enc.SetMaxTableSize(100)
+		for i := range 10 {
+			fields := []HeaderField{{Name: "x-count", Value: strings.Repeat("n", i)}}
+			decoded, err := dec.Decode(enc.Encode(fields))
+			require.NoError(t, err)
+			assert.Equal(t, fields, decoded)
+		}
+		assert.LessOrEqual(t, dec.table.size, uint32(100))
+		assert.Equal(t, enc.table.entries, dec.table.entries)
+	})
+
+	t.Run("sensitive fields are never indexed", func(t *testing.T) {
+		enc := NewEncoder()
+		block := enc.Encode([]HeaderField{{Name: "authorization", Value: "secret", Sensitive: true}})
+		assert.Equal(t, byte(0x10), block[0]&0xf0)
+		assert.Empty(t, enc.table.entries)
+
+		fields, err := NewDecoder(DEFAULT_HEADER_TABLE_SIZE).Decode(block)
+		require.NoError(t, err)
+		assert.True(t, fields[0].Sensitive)
+	})
+
+	t.Run("header list size", func(t *testing.T) {
+		enc := NewEncoder()
+		dec := NewDecoder(DEFAULT_HEADER_TABLE_SIZE)
+		dec.MaxHeaderListSize = 64
+		_, err := dec.Decode(enc.Encode([]HeaderField{{Name: "x-big", Value: strings.Repeat("v", 64)}}))
+		assert.ErrorIs(t, err, ErrHeaderListTooLarge)
+
+		// the table is still in sync: the next block refers to the field added by the previous one
+		dec.MaxHeaderListSize = 0
+		fields, err := dec.Decode(enc.Encode([]HeaderField{{Name: "x-big", Value: strings.Repeat("v", 64)}}))
+		require.NoError(t, err)
+		assert.Equal(t, "x-big", fields[0].Name)
+	})
+
+	t.Run("invalid blocks", func(t *testing.T) {
+		tests := map[string]string{
+			"index out of the tables": "ff 00",
+			"index zero":              "80",
+			"truncated string":        "40 05 61",
+			"truncated integer":       "ff",
+			"size update after field": "82 3f e1 1f",
+			"size over the setting":   "3f e2 1f",
+			"EOS padding too long":    "40 82 ff ff 00",
+		}
+		for name, block := range tests {
+			_, err := NewDecoder(DEFAULT_HEADER_TABLE_SIZE).Decode(unhex(t, block))
+			assert.ErrorIs(t, err, ErrCompression, name)
+		}
+	})
+}
+
+func TestHuffman(t *testing.T) {
+	for _, s := range []string{"", "www.example.com", "no-cache", "Mon, 21 Oct 2013 20:13:21 GMT", "\x00\xff\x7f binary"} {
+		encoded := huffmanEncode(nil, s)
+		assert.Len(t, encoded, huffmanEncodedLen(s))
+		decoded, err := huffmanDecode(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, s, string(decoded))
+	}
+}
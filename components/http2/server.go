@@ -0,0 +1,1134 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol identifiers of HTTP/2 over TLS (negotiated with ALPN) and over cleartext TCP (Upgrade: h2c)
+const (
+	ALPN_PROTOCOL = "h2"
+	H2C_PROTOCOL  = "h2c"
+)
+
+// Values advertised in the SETTINGS of the server unless changed in Config
+const (
+	DEFAULT_MAX_CONCURRENT_STREAMS = 100
+	DEFAULT_STREAM_WINDOW_SIZE     = 1 << 20
+	DEFAULT_CONN_WINDOW_SIZE       = 4 << 20
+)
+
+// The client must acknowledge the SETTINGS of the server within this time
+const SETTINGS_TIMEOUT = 10 * time.Second
+
+// After GOAWAY the connection is closed once the client stops sending, or after this time
+const GOAWAY_TIMEOUT = 1 * time.Second
+
+// A header block split in CONTINUATION frames can't grow beyond this size
+const MAX_HEADER_BLOCK_SIZE = 1 << 20
+
+// The streams reset by the server are remembered up to this number, the frames the client sent
+// before getting the RST_STREAM are ignored for them
+const MAX_RESET_STREAMS = 1000
+
+var ErrStreamReset = errors.New("http2: stream reset")
+
+var ErrConnClosed = errors.New("http2: connection closed")
+
+// Handler serves a stream, the response is complete when it returns
+type Handler func(res *response.Response, req *request.Request)
+
+type Config struct {
+	// MaxConcurrentStreams bounds the streams open at the same time, the next ones are refused
+	MaxConcurrentStreams uint32
+	// StreamWindowSize is how much request body a stream can receive before the handler reads it
+	StreamWindowSize uint32
+	// ConnWindowSize is the same for all the streams of the connection
+	ConnWindowSize uint32
+	// MaxFrameSize is the largest frame payload accepted
+	MaxFrameSize uint32
+	// Limits bounds the header list (MaxHeaderBytes) and the body (MaxBodyBytes) of every request
+	Limits request.Limits
+	// PrefaceTimeout bounds the wait for the client preface, a zero value disables it
+	PrefaceTimeout time.Duration
+	// IdleTimeout closes the connection when no stream is open for this time, a zero value disables it
+	IdleTimeout time.Duration
+	// WriteTimeout bounds the write of each frame, a zero value disables it
+	WriteTimeout time.Duration
+	// Context is the parent of the request contexts (e.g. cancelled when the server shuts down)
+	Context context.Context
+}
+
+// ServerConn serves the streams of an HTTP/2 connection, each one runs the handler in its own goroutine
+type ServerConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	config  Config
+	handler Handler
+	// cancelled when the connection is closed, the contexts of the streams derive from it
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	// the write lock covers the encoder too, header blocks must be sent in the order they are encoded
+	wmu          sync.Mutex
+	bw           *bufio.Writer
+	enc          *Encoder
+	maxFrameSize uint32 // SETTINGS_MAX_FRAME_SIZE of the client
+
+	// read loop only
+	dec     *Decoder
+	pending *Frame // HEADERS waiting for its CONTINUATION frames
+	block   []byte
+	upgrade *request.Request
+
+	mu sync.Mutex
+	// signaled when a send window grows, a request body gets data or a stream ends
+	cond          *sync.Cond
+	streams       map[uint32]*stream
+	lastStreamID  uint32
+	resetIDs      map[uint32]bool // closed streams the server has sent RST_STREAM for
+	resetOrder    []uint32
+	sendWindow    int64
+	initialWindow int64 // SETTINGS_INITIAL_WINDOW_SIZE of the client
+	recvWindow    int64
+	unacked       int64 // body bytes consumed and not returned to the connection window yet
+	ready         bool  // the SETTINGS of the server are sent, GOAWAY can follow
+	goAway        bool
+	closed        bool
+	idleTimer     *time.Timer
+	settingsTimer *time.Timer
+	handlers      sync.WaitGroup
+}
+
+// NewServerConn prepares a connection whose bytes are read from rd (e.g. conn itself, or the bytes
+// buffered by an HTTP/1.1 reader followed by conn)
+func NewServerConn(conn net.Conn, rd io.Reader, config Config, handler Handler) *ServerConn {
+	if config.MaxConcurrentStreams == 0 {
+		config.MaxConcurrentStreams = DEFAULT_MAX_CONCURRENT_STREAMS
+	}
+	if config.StreamWindowSize == 0 {
+		config.StreamWindowSize = DEFAULT_STREAM_WINDOW_SIZE
+	}
+	if config.ConnWindowSize == 0 {
+		config.ConnWindowSize = DEFAULT_CONN_WINDOW_SIZE
+	}
+	config.StreamWindowSize = min(config.StreamWindowSize, MAX_WINDOW_SIZE)
+	config.ConnWindowSize = min(max(config.ConnWindowSize, DEFAULT_INITIAL_WINDOW_SIZE), MAX_WINDOW_SIZE)
+	config.MaxFrameSize = min(max(config.MaxFrameSize, DEFAULT_MAX_FRAME_SIZE), MAX_FRAME_SIZE_LIMIT)
+
+	sc := &ServerConn{
+		conn:          conn,
+		br:            bufio.NewReader(rd),
+		config:        config,
+		handler:       handler,
+		bw:            bufio.NewWriter(conn),
+		enc:           NewEncoder(),
+		maxFrameSize:  DEFAULT_MAX_FRAME_SIZE,
+		dec:           NewDecoder(DEFAULT_HEADER_TABLE_SIZE),
+		streams:       map[uint32]*stream{},
+		resetIDs:      map[uint32]bool{},
+		sendWindow:    DEFAULT_INITIAL_WINDOW_SIZE,
+		initialWindow: DEFAULT_INITIAL_WINDOW_SIZE,
+		recvWindow:    int64(config.ConnWindowSize),
+	}
+	sc.dec.MaxHeaderListSize = uint32(config.Limits.MaxHeaderBytes)
+	parent := config.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	sc.ctx, sc.cancel = context.WithCancelCause(parent)
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc
+}
+
+// Upgrade makes req, an HTTP/1.1 request with "Upgrade: h2c" and no body, the stream 1 of the connection.
+// settings is the HTTP2-Settings header of the request. It must be called before Serve, once the
+// 101 Switching Protocols response has been sent.
+func (sc *ServerConn) Upgrade(req *request.Request, settings string) error {
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(settings, "="))
+	if err != nil {
+		return fmt.Errorf("http2: invalid HTTP2-Settings: %w", err)
+	}
+	if err := sc.applySettings(&Frame{Type: FrameSettings, Payload: payload}); err != nil {
+		return err
+	}
+	req.RequestLine.HttpVersion = "2.0"
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.lastStreamID = 1
+	st := sc.newStream(1, -1)
+	st.remoteDone = true
+	st.body.err = io.EOF
+	sc.streams[1] = st
+	req.SetContext(st.ctx)
+	// the handler starts once the SETTINGS of the server are sent
+	sc.upgrade = req
+	return nil
+}
+
+// Serve sends the SETTINGS of the server, reads the client preface and serves the streams until
+// the connection is closed. Protocol errors are sent to the client with GOAWAY before returning.
+func (sc *ServerConn) Serve() error {
+	defer func() {
+		sc.close()
+		// handlers blocked on the connection are woken up by close
+		sc.handlers.Wait()
+	}()
+
+	settings := []Setting{
+		{SettingMaxConcurrentStreams, sc.config.MaxConcurrentStreams},
+		{SettingInitialWindowSize, sc.config.StreamWindowSize},
+		{SettingMaxFrameSize, sc.config.MaxFrameSize},
+	}
+	if sc.dec.MaxHeaderListSize > 0 {
+		settings = append(settings, Setting{SettingMaxHeaderListSize, sc.dec.MaxHeaderListSize})
+	}
+	if err := sc.writeFrame(SettingsFrame(settings...)); err != nil {
+		return err
+	}
+	if incr := sc.config.ConnWindowSize - DEFAULT_INITIAL_WINDOW_SIZE; incr > 0 {
+		if err := sc.writeFrame(WindowUpdateFrame(0, incr)); err != nil {
+			return err
+		}
+	}
+	sc.mu.Lock()
+	sc.settingsTimer = time.AfterFunc(SETTINGS_TIMEOUT, func() {
+		sc.fail(connError(ErrCodeSettingsTimeout, "SETTINGS not acknowledged"))
+	})
+	if sc.upgrade != nil {
+		sc.startHandler(sc.streams[1], sc.upgrade)
+	}
+	sc.ready = true
+	// Shutdown may have been called before the SETTINGS were sent
+	shutdown := sc.goAway
+	sc.goAway = false
+	sc.mu.Unlock()
+	if shutdown {
+		sc.Shutdown()
+	}
+
+	if err := sc.readPreface(); err != nil {
+		sc.fail(err)
+		return err
+	}
+	sc.updateIdle()
+
+	for {
+		f, err := ReadFrame(sc.br, sc.config.MaxFrameSize)
+		if err == nil {
+			err = sc.processFrame(f)
+		}
+		var sErr *StreamError
+		if errors.As(err, &sErr) {
+			sc.resetStream(sErr)
+			continue
+		}
+		if err != nil {
+			sc.fail(err)
+			return err
+		}
+	}
+}
+
+// readPreface reads the client preface, the first frame must be SETTINGS
+func (sc *ServerConn) readPreface() error {
+	if sc.config.PrefaceTimeout > 0 {
+		sc.conn.SetReadDeadline(time.Now().Add(sc.config.PrefaceTimeout))
+		defer sc.conn.SetReadDeadline(time.Time{})
+	}
+	preface := make([]byte, len(CLIENT_PREFACE))
+	if _, err := io.ReadFull(sc.br, preface); err != nil {
+		return err
+	}
+	if string(preface) != CLIENT_PREFACE {
+		return connError(ErrCodeProtocol, "invalid client preface")
+	}
+	f, err := ReadFrame(sc.br, sc.config.MaxFrameSize)
+	if err != nil {
+		return err
+	}
+	if f.Type != FrameSettings || f.Has(FlagAck) {
+		return connError(ErrCodeProtocol, "client preface followed by %v instead of SETTINGS", f.Type)
+	}
+	return sc.processFrame(f)
+}
+
+// Shutdown sends GOAWAY: the streams already open are served, the next ones are ignored
+// and the connection is closed once the last stream ends
+func (sc *ServerConn) Shutdown() {
+	sc.mu.Lock()
+	if sc.goAway || sc.closed {
+		sc.mu.Unlock()
+		return
+	}
+	sc.goAway = true
+	if !sc.ready {
+		// GOAWAY is sent by Serve after the SETTINGS
+		sc.mu.Unlock()
+		return
+	}
+	last, idle := sc.lastStreamID, len(sc.streams) == 0
+	sc.mu.Unlock()
+
+	sc.writeFrame(GoAwayFrame(last, ErrCodeNo, ""))
+	if idle {
+		sc.closeWrite()
+	}
+}
+
+// closeWrite ends a connection after GOAWAY: the write side is closed and the frames still coming
+// are read for a while, closing a socket with unread bytes would reset it and the client could lose
+// the last responses. Serve closes the connection when the read fails.
+func (sc *ServerConn) closeWrite() {
+	cw, ok := sc.conn.(interface{ CloseWrite() error })
+	if !ok {
+		sc.close()
+		return
+	}
+	sc.wmu.Lock()
+	cw.CloseWrite()
+	sc.wmu.Unlock()
+	sc.conn.SetReadDeadline(time.Now().Add(GOAWAY_TIMEOUT))
+}
+
+// fail sends GOAWAY for a connection error and closes the connection
+func (sc *ServerConn) fail(err error) {
+	var cErr *ConnError
+	if errors.As(err, &cErr) {
+		slog.Info("HTTP/2 connection error", "addr", sc.conn.RemoteAddr(), "err", err)
+		sc.mu.Lock()
+		last := sc.lastStreamID
+		sc.mu.Unlock()
+		sc.writeFrame(GoAwayFrame(last, cErr.Code, cErr.Reason))
+	}
+	sc.close()
+}
+
+func (sc *ServerConn) close() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.closed {
+		return
+	}
+	sc.closed = true
+	for _, t := range []*time.Timer{sc.idleTimer, sc.settingsTimer} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	for _, st := range sc.streams {
+		st.body.fail(ErrConnClosed)
+	}
+	sc.cancel(ErrConnClosed)
+	sc.cond.Broadcast()
+	sc.conn.Close()
+}
+
+func (sc *ServerConn) processFrame(f *Frame) error {
+	if sc.pending != nil && f.Type != FrameContinuation {
+		return connError(ErrCodeProtocol, "%v frame while a header block is incomplete", f.Type)
+	}
+	switch f.Type {
+	case FrameData:
+		return sc.processData(f)
+	case FrameHeaders, FrameContinuation:
+		return sc.processHeaders(f)
+	case FrameRSTStream:
+		return sc.processReset(f)
+	case FrameSettings:
+		if f.Has(FlagAck) {
+			sc.mu.Lock()
+			if sc.settingsTimer != nil {
+				sc.settingsTimer.Stop()
+			}
+			sc.mu.Unlock()
+			return nil
+		}
+		if err := sc.applySettings(f); err != nil {
+			return err
+		}
+		return sc.writeFrame(&Frame{Type: FrameSettings, Flags: FlagAck})
+	case FramePing:
+		if f.Has(FlagAck) {
+			return nil
+		}
+		return sc.writeFrame(&Frame{Type: FramePing, Flags: FlagAck, Payload: f.Payload})
+	case FrameGoAway:
+		// the client won't open other streams, the ones it has already opened are completed
+		sc.mu.Lock()
+		sc.goAway = true
+		idle := len(sc.streams) == 0
+		sc.mu.Unlock()
+		if idle {
+			return io.EOF
+		}
+		return nil
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	case FramePushPromise:
+		return connError(ErrCodeProtocol, "PUSH_PROMISE from a client")
+	}
+	// PRIORITY and unknown frames
+	return nil
+}
+
+// applySettings applies the SETTINGS of the client, a new initial window size changes the window of every stream
+func (sc *ServerConn) applySettings(f *Frame) error {
+	settings, err := f.Settings()
+	if err != nil {
+		return err
+	}
+	for _, s := range settings {
+		switch s.ID {
+		case SettingHeaderTableSize:
+			sc.wmu.Lock()
+			sc.enc.SetMaxTableSize(s.Value)
+			sc.wmu.Unlock()
+		case SettingMaxFrameSize:
+			sc.wmu.Lock()
+			sc.maxFrameSize = s.Value
+			sc.wmu.Unlock()
+		case SettingInitialWindowSize:
+			sc.mu.Lock()
+			delta := int64(s.Value) - sc.initialWindow
+			sc.initialWindow = int64(s.Value)
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > MAX_WINDOW_SIZE {
+					sc.mu.Unlock()
+					return connError(ErrCodeFlowControl, "window of stream %d over the limit", st.id)
+				}
+			}
+			sc.cond.Broadcast()
+			sc.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// streamClosed reports whether id belongs to a stream that has been opened and is already closed
+func (sc *ServerConn) streamClosed(id uint32) bool {
+	_, open := sc.streams[id]
+	return !open && id <= sc.lastStreamID
+}
+
+// markReset remembers a stream the server has sent RST_STREAM for, it must be called with the lock held
+func (sc *ServerConn) markReset(id uint32) {
+	if sc.resetIDs[id] {
+		return
+	}
+	if len(sc.resetOrder) >= MAX_RESET_STREAMS {
+		delete(sc.resetIDs, sc.resetOrder[0])
+		sc.resetOrder = sc.resetOrder[1:]
+	}
+	sc.resetIDs[id] = true
+	sc.resetOrder = append(sc.resetOrder, id)
+}
+
+func (sc *ServerConn) processData(f *Frame) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	size := int64(len(f.Payload))
+	if size > sc.recvWindow {
+		return connError(ErrCodeFlowControl, "DATA beyond the connection window")
+	}
+	sc.recvWindow -= size
+	data, err := f.Data()
+	if err != nil {
+		return err
+	}
+
+	st := sc.streams[f.StreamID]
+	if st == nil || st.remoteDone || st.reset {
+		// the bytes won't be read, they are returned to the connection window
+		sc.credit(nil, size)
+		if st == nil && !sc.streamClosed(f.StreamID) {
+			return connError(ErrCodeProtocol, "DATA on idle stream %d", f.StreamID)
+		}
+		if st != nil && st.remoteDone {
+			return streamError(f.StreamID, ErrCodeStreamClosed, "DATA after END_STREAM")
+		}
+		return nil
+	}
+	if size > st.recvWindow {
+		sc.credit(nil, size)
+		return streamError(st.id, ErrCodeFlowControl, "DATA beyond the stream window")
+	}
+	st.recvWindow -= size
+	// the padding is never read
+	if padding := size - int64(len(data)); padding > 0 {
+		sc.credit(st, padding)
+	}
+
+	st.received += int64(len(data))
+	if st.declared >= 0 && st.received > st.declared {
+		sc.credit(nil, int64(len(data)))
+		return streamError(st.id, ErrCodeProtocol, "body longer than content-length %d", st.declared)
+	}
+	if limit := sc.config.Limits.MaxBodyBytes; limit > 0 && st.received > limit {
+		// the handler can still answer 413, the rest of the body is dropped
+		sc.credit(nil, int64(len(data)))
+		st.body.fail(fmt.Errorf("%w: more than %d bytes", request.ErrBodyTooLarge, limit))
+	} else if !st.body.write(data) {
+		sc.credit(nil, int64(len(data)))
+	}
+
+	if f.Has(FlagEndStream) {
+		if st.declared >= 0 && st.received != st.declared {
+			return streamError(st.id, ErrCodeProtocol, "body of %d bytes, content-length %d", st.received, st.declared)
+		}
+		st.remoteDone = true
+		st.body.fail(io.EOF)
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+// credit returns consumed body bytes to the flow-control windows: a WINDOW_UPDATE is sent once half of a window
+// has been consumed, so the client isn't flooded with small updates. A nil st credits the connection only.
+func (sc *ServerConn) credit(st *stream, n int64) {
+	sc.unacked += n
+	if st != nil {
+		st.unacked += n
+	}
+	var frames []*Frame
+	if sc.unacked >= int64(sc.config.ConnWindowSize)/2 {
+		frames = append(frames, WindowUpdateFrame(0, uint32(sc.unacked)))
+		sc.recvWindow += sc.unacked
+		sc.unacked = 0
+	}
+	if st != nil && !st.remoteDone && st.unacked >= int64(sc.config.StreamWindowSize)/2 {
+		frames = append(frames, WindowUpdateFrame(st.id, uint32(st.unacked)))
+		st.recvWindow += st.unacked
+		st.unacked = 0
+	}
+	if len(frames) > 0 {
+		// writes don't take the lock, the frames are sent by another goroutine to keep the lock order
+		go func() {
+			for _, f := range frames {
+				sc.writeFrame(f)
+			}
+		}()
+	}
+}
+
+func (sc *ServerConn) processHeaders(f *Frame) error {
+	if f.Type == FrameContinuation {
+		if sc.pending == nil || f.StreamID != sc.pending.StreamID {
+			return connError(ErrCodeProtocol, "unexpected CONTINUATION on stream %d", f.StreamID)
+		}
+	} else {
+		if f.StreamID%2 == 0 {
+			return connError(ErrCodeProtocol, "HEADERS on server stream %d", f.StreamID)
+		}
+		sc.pending, sc.block = f, nil
+	}
+	fragment, err := f.HeaderBlock()
+	if err != nil {
+		sc.pending = nil
+		return err
+	}
+	sc.block = append(sc.block, fragment...)
+	if len(sc.block) > MAX_HEADER_BLOCK_SIZE {
+		return connError(ErrCodeEnhanceYourCalm, "header block over %d bytes", MAX_HEADER_BLOCK_SIZE)
+	}
+	if !f.Has(FlagEndHeaders) {
+		return nil
+	}
+	head := sc.pending
+	sc.pending = nil
+
+	// the block is decoded even when the stream is refused, the tables must stay in sync
+	fields, err := sc.dec.Decode(sc.block)
+	tooLarge := errors.Is(err, ErrHeaderListTooLarge)
+	if err != nil && !tooLarge {
+		return connError(ErrCodeCompression, "%v", err)
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[head.StreamID]
+	switch {
+	case st != nil:
+		sc.mu.Unlock()
+		return sc.processTrailers(st, head, fields, tooLarge)
+	case head.StreamID <= sc.lastStreamID:
+		// a stream reset by the server may still get the frames the client sent in the meantime,
+		// otherwise the stream is closed or was skipped by the client (RFC 9113 section 5.1)
+		reset := sc.resetIDs[head.StreamID]
+		sc.mu.Unlock()
+		if reset {
+			return nil
+		}
+		return connError(ErrCodeProtocol, "HEADERS on closed stream %d", head.StreamID)
+	}
+	sc.lastStreamID = head.StreamID
+	if sc.goAway {
+		sc.mu.Unlock()
+		return nil
+	}
+	if uint32(len(sc.streams)) >= sc.config.MaxConcurrentStreams {
+		sc.mu.Unlock()
+		return streamError(head.StreamID, ErrCodeRefusedStream, "more than %d concurrent streams", sc.config.MaxConcurrentStreams)
+	}
+	sc.mu.Unlock()
+
+	if tooLarge {
+		sc.mu.Lock()
+		st = sc.newStream(head.StreamID, 0)
+		st.remoteDone = head.Has(FlagEndStream)
+		sc.streams[st.id] = st
+		sc.refuse(st, &response.REQUEST_HEADER_FIELDS_TOO_LARGE, ErrHeaderListTooLarge)
+		sc.mu.Unlock()
+		return nil
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st = sc.newStream(head.StreamID, -1)
+	st.remoteDone = head.Has(FlagEndStream)
+	req, err := newRequest(st, fields)
+	if err != nil {
+		return err
+	}
+	sc.streams[st.id] = st
+	if limit := sc.config.Limits.MaxBodyBytes; limit > 0 && st.declared > limit {
+		sc.refuse(st, &response.CONTENT_TOO_LARGE, fmt.Errorf("%w: %d bytes, limit %d", request.ErrBodyTooLarge, st.declared, limit))
+		return nil
+	}
+	sc.startHandler(st, req)
+	return nil
+}
+
+// processTrailers handles a HEADERS frame on an open stream, it ends the request body with the trailer fields
+func (sc *ServerConn) processTrailers(st *stream, f *Frame, fields []HeaderField, tooLarge bool) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	switch {
+	case st.remoteDone:
+		return streamError(st.id, ErrCodeStreamClosed, "HEADERS after END_STREAM")
+	case !f.Has(FlagEndStream):
+		return streamError(st.id, ErrCodeProtocol, "trailers without END_STREAM")
+	case tooLarge:
+		return streamError(st.id, ErrCodeProtocol, "trailer section too large")
+	}
+	for _, field := range fields {
+		if strings.HasPrefix(field.Name, ":") {
+			return streamError(st.id, ErrCodeProtocol, "pseudo-header %s in trailers", field.Name)
+		}
+		if err := validField(field); err != nil {
+			return streamError(st.id, ErrCodeProtocol, "%v", err)
+		}
+		st.body.trailers.Add(field.Name, field.Value)
+	}
+	if st.declared >= 0 && st.received != st.declared {
+		return streamError(st.id, ErrCodeProtocol, "body of %d bytes, content-length %d", st.received, st.declared)
+	}
+	st.remoteDone = true
+	st.body.fail(io.EOF)
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *ServerConn) processReset(f *Frame) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st := sc.streams[f.StreamID]
+	if st == nil {
+		if !sc.streamClosed(f.StreamID) {
+			return connError(ErrCodeProtocol, "RST_STREAM on idle stream %d", f.StreamID)
+		}
+		return nil
+	}
+	// the handler sees the reset on its next read or write
+	st.reset = true
+	err := fmt.Errorf("%w by the client: %v", ErrStreamReset, f.ErrorCode())
+	st.body.fail(err)
+	st.cancel(err)
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *ServerConn) processWindowUpdate(f *Frame) error {
+	incr, err := f.WindowIncrement()
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.StreamID == 0 {
+		sc.sendWindow += int64(incr)
+		if sc.sendWindow > MAX_WINDOW_SIZE {
+			return connError(ErrCodeFlowControl, "connection window over the limit")
+		}
+	} else if st := sc.streams[f.StreamID]; st != nil {
+		st.sendWindow += int64(incr)
+		if st.sendWindow > MAX_WINDOW_SIZE {
+			return streamError(st.id, ErrCodeFlowControl, "stream window over the limit")
+		}
+	} else if !sc.streamClosed(f.StreamID) {
+		return connError(ErrCodeProtocol, "WINDOW_UPDATE on idle stream %d", f.StreamID)
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+// resetStream sends RST_STREAM for a stream error, the handler (if any) sees the reset on its next read or write
+func (sc *ServerConn) resetStream(err *StreamError) {
+	slog.Info("HTTP/2 stream error", "addr", sc.conn.RemoteAddr(), "err", err)
+	sc.mu.Lock()
+	if st := sc.streams[err.StreamID]; st != nil {
+		if st.reset {
+			sc.mu.Unlock()
+			return
+		}
+		st.reset = true
+		st.body.fail(err)
+		st.cancel(err)
+		sc.cond.Broadcast()
+	}
+	sc.markReset(err.StreamID)
+	sc.mu.Unlock()
+	sc.writeFrame(RSTStreamFrame(err.StreamID, err.Code))
+}
+
+// refuse answers a request that can't reach the handler, it must be called with the lock held
+func (sc *ServerConn) refuse(st *stream, status *response.StatusCode, err error) {
+	st.body.closed = true
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		defer sc.endStream(st)
+		res := &response.Response{Framer: st}
+		body := fmt.Appendf(nil, "{\"statusCode\":%d, \"errorMessage\":\"%s\"}\n", status.Code, err)
+		if err := res.WriteResponse(status, nil, body); err != nil {
+			slog.Error("Writing HTTP/2 error response", "err", err)
+		}
+	}()
+}
+
+// newStream must be called with the lock held, length is the declared content-length (-1 when missing)
+func (sc *ServerConn) newStream(id uint32, length int64) *stream {
+	st := &stream{
+		id:         id,
+		sc:         sc,
+		sendWindow: sc.initialWindow,
+		recvWindow: int64(sc.config.StreamWindowSize),
+		declared:   length,
+	}
+	st.body = &requestBody{st: st}
+	st.ctx, st.cancel = context.WithCancelCause(sc.ctx)
+	if sc.idleTimer != nil {
+		sc.idleTimer.Stop()
+	}
+	return st
+}
+
+// startHandler must be called with the lock held
+func (sc *ServerConn) startHandler(st *stream, req *request.Request) {
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		defer sc.endStream(st)
+		res := &response.Response{Framer: st, KeepAlive: true, Head: req.RequestLine.Method == "HEAD"}
+		sc.handler(res, req)
+	}()
+}
+
+// endStream runs when the handler returns: an incomplete response is reset, a request body still
+// being sent is cancelled (RFC 9113 section 8.1) and the connection may become idle
+func (sc *ServerConn) endStream(st *stream) {
+	sc.mu.Lock()
+	var code ErrorCode
+	reset := !st.reset
+	switch {
+	case !st.localDone:
+		code = ErrCodeInternal
+	case !st.remoteDone:
+		code = ErrCodeNo
+	default:
+		reset = false
+	}
+	st.reset = true
+	st.body.fail(ErrStreamReset)
+	st.cancel(nil)
+	delete(sc.streams, st.id)
+	// unread body bytes are returned to the connection window
+	if st.body.buf.Len() > 0 {
+		sc.credit(nil, int64(st.body.buf.Len()))
+		st.body.buf.Reset()
+	}
+	if reset {
+		sc.markReset(st.id)
+	}
+	closing := sc.goAway && len(sc.streams) == 0
+	sc.mu.Unlock()
+
+	if reset {
+		sc.writeFrame(RSTStreamFrame(st.id, code))
+	}
+	if closing {
+		sc.closeWrite()
+	}
+	sc.updateIdle()
+}
+
+// updateIdle starts the idle timer when no stream is open
+func (sc *ServerConn) updateIdle() {
+	if sc.config.IdleTimeout <= 0 {
+		return
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if len(sc.streams) > 0 || sc.closed {
+		return
+	}
+	if sc.idleTimer == nil {
+		sc.idleTimer = time.AfterFunc(sc.config.IdleTimeout, func() {
+			sc.mu.Lock()
+			idle := len(sc.streams) == 0
+			sc.mu.Unlock()
+			if idle {
+				slog.Info("Closing connection", "addr", sc.conn.RemoteAddr(), "reason", "idle timeout")
+				sc.Shutdown()
+			}
+		})
+	} else {
+		sc.idleTimer.Reset(sc.config.IdleTimeout)
+	}
+}
+
+func (sc *ServerConn) writeFrame(f *Frame) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	return sc.writeLocked(f)
+}
+
+// writeLocked sends f and flushes it, the write lock must be held
+func (sc *ServerConn) writeLocked(f *Frame) error {
+	if sc.config.WriteTimeout > 0 {
+		sc.conn.SetWriteDeadline(time.Now().Add(sc.config.WriteTimeout))
+	}
+	if err := WriteFrame(sc.bw, f); err != nil {
+		return err
+	}
+	return sc.bw.Flush()
+}
+
+// writeHeaderBlock encodes fields and sends them in a HEADERS frame followed by the CONTINUATION
+// frames needed to respect the frame size of the client
+func (sc *ServerConn) writeHeaderBlock(id uint32, fields []HeaderField, endStream bool) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	block := sc.enc.Encode(fields)
+	typ, flags := FrameHeaders, Flags(0)
+	if endStream {
+		flags = FlagEndStream
+	}
+	for first := true; first || len(block) > 0; first = false {
+		n := min(len(block), int(sc.maxFrameSize))
+		f := &Frame{Type: typ, Flags: flags, StreamID: id, Payload: block[:n]}
+		block = block[n:]
+		if len(block) == 0 {
+			f.Flags |= FlagEndHeaders
+		}
+		if err := sc.writeLocked(f); err != nil {
+			return err
+		}
+		typ, flags = FrameContinuation, 0
+	}
+	return nil
+}
+
+// stream is the server side of a request, it implements response.Framer for the handler
+type stream struct {
+	id uint32
+	sc *ServerConn
+	// fields below are guarded by the connection lock
+	sendWindow int64
+	recvWindow int64
+	unacked    int64
+	declared   int64 // content-length of the request, -1 when missing
+	received   int64
+	remoteDone bool // END_STREAM received
+	localDone  bool // END_STREAM sent
+	reset      bool // RST_STREAM sent or received, no frame can be sent anymore
+	body       *requestBody
+	// context of the request, cancelled by a reset or when the handler returns
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+func (st *stream) WriteHeader(status *response.StatusCode, h *headers.Headers, endStream bool) error {
+	fields := []HeaderField{{Name: ":status", Value: strconv.Itoa(int(status.Code))}}
+	h.ForEach(func(k, v string) {
+		if !connectionSpecific(k) {
+			fields = append(fields, HeaderField{Name: k, Value: v, Sensitive: k == "set-cookie"})
+		}
+	})
+	return st.writeHeaders(fields, endStream)
+}
+
+func (st *stream) WriteTrailers(h *headers.Headers) error {
+	if h.Len() == 0 {
+		_, err := st.WriteData(nil, true)
+		return err
+	}
+	var fields []HeaderField
+	h.ForEach(func(k, v string) {
+		if !connectionSpecific(k) {
+			fields = append(fields, HeaderField{Name: k, Value: v})
+		}
+	})
+	return st.writeHeaders(fields, true)
+}
+
+func (st *stream) writeHeaders(fields []HeaderField, endStream bool) error {
+	sc := st.sc
+	sc.mu.Lock()
+	if err := st.writable(); err != nil {
+		sc.mu.Unlock()
+		return err
+	}
+	st.localDone = endStream
+	sc.mu.Unlock()
+	return sc.writeHeaderBlock(st.id, fields, endStream)
+}
+
+// WriteData sends p in DATA frames as the flow-control windows allow, it blocks until the client
+// makes room for the whole p or the stream is reset
+func (st *stream) WriteData(p []byte, endStream bool) (int, error) {
+	sc := st.sc
+	written := 0
+	for first := true; first || written < len(p); first = false {
+		sc.mu.Lock()
+		for {
+			if err := st.writable(); err != nil {
+				sc.mu.Unlock()
+				return written, err
+			}
+			if written == len(p) || (st.sendWindow > 0 && sc.sendWindow > 0) {
+				break
+			}
+			sc.cond.Wait()
+		}
+		sc.wmu.Lock()
+		n := min(int64(len(p)-written), st.sendWindow, sc.sendWindow, int64(sc.maxFrameSize))
+		st.sendWindow -= n
+		sc.sendWindow -= n
+		f := &Frame{Type: FrameData, StreamID: st.id, Payload: p[written : written+int(n)]}
+		if endStream && written+int(n) == len(p) {
+			f.Flags = FlagEndStream
+			st.localDone = true
+		}
+		sc.mu.Unlock()
+		err := sc.writeLocked(f)
+		sc.wmu.Unlock()
+		if err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+	return written, nil
+}
+
+// writable must be called with the connection lock held
+func (st *stream) writable() error {
+	switch {
+	case st.sc.closed:
+		return ErrConnClosed
+	case st.reset:
+		return ErrStreamReset
+	case st.localDone:
+		return fmt.Errorf("%w: write after the end of the stream", response.ErrWriteOrder)
+	}
+	return nil
+}
+
+// requestBody is the body of a request, filled by the DATA frames. Reads return the consumed bytes
+// to the flow-control windows. Its fields are guarded by the connection lock.
+type requestBody struct {
+	st       *stream
+	buf      bytes.Buffer
+	err      error // io.EOF after END_STREAM
+	closed   bool
+	trailers *headers.Headers
+}
+
+// write must be called with the lock held, it returns false when the body is not read anymore
+func (b *requestBody) write(p []byte) bool {
+	if b.closed || b.err != nil {
+		return false
+	}
+	b.buf.Write(p)
+	return true
+}
+
+// fail must be called with the lock held, the first error wins
+func (b *requestBody) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	sc := b.st.sc
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for b.buf.Len() == 0 && b.err == nil && !b.closed {
+		sc.cond.Wait()
+	}
+	if b.closed {
+		return 0, request.ErrBodyClosed
+	}
+	if b.buf.Len() == 0 {
+		return 0, b.err
+	}
+	n, _ := b.buf.Read(p)
+	sc.credit(b.st, int64(n))
+	return n, nil
+}
+
+// Close drops the unread bytes, the ones still coming are dropped as they arrive
+func (b *requestBody) Close() error {
+	sc := b.st.sc
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if n := b.buf.Len(); n > 0 {
+		b.buf.Reset()
+		sc.credit(nil, int64(n))
+	}
+	sc.cond.Broadcast()
+	if errors.Is(b.err, request.ErrBodyTooLarge) {
+		return b.err
+	}
+	return nil
+}
+
+// connectionSpecific fields are meaningless in HTTP/2, the framing replaces them (RFC 9113 section 8.2.2)
+func connectionSpecific(name string) bool {
+	switch name {
+	case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+		return true
+	}
+	return false
+}
+
+// validField rejects what HTTP/2 forbids in a field: uppercase names and connection-specific fields
+func validField(f HeaderField) error {
+	for i := 0; i < len(f.Name); i++ {
+		if c := f.Name[i]; 'A' <= c && c <= 'Z' {
+			return fmt.Errorf("uppercase field name %q", f.Name)
+		}
+	}
+	if ok, c := headers.IsToken([]byte(f.Name)); !ok || f.Name == "" {
+		return fmt.Errorf("invalid character %q in field name", c)
+	}
+	if strings.ContainsAny(f.Value, "\r\n\x00") {
+		return fmt.Errorf("invalid character in the value of %s", f.Name)
+	}
+	if connectionSpecific(f.Name) {
+		return fmt.Errorf("connection-specific field %s", f.Name)
+	}
+	if f.Name == "te" && f.Value != "trailers" {
+		return fmt.Errorf("te field with a value other than trailers")
+	}
+	return nil
+}
+
+// newRequest builds a request from the fields of a HEADERS frame (RFC 9113 section 8.3.1),
+// a malformed request is a stream error. It returns the declared content-length, -1 when missing.
+func newRequest(st *stream, fields []HeaderField) (*request.Request, error) {
+	id := st.id
+	pseudo := map[string]string{}
+	h := headers.NewHeaders()
+	regular := false
+	for _, f := range fields {
+		if name, ok := strings.CutPrefix(f.Name, ":"); ok {
+			if regular {
+				return nil, streamError(id, ErrCodeProtocol, "pseudo-header %s after a regular field", f.Name)
+			}
+			if _, dup := pseudo[name]; dup {
+				return nil, streamError(id, ErrCodeProtocol, "repeated pseudo-header %s", f.Name)
+			}
+			switch name {
+			case "method", "scheme", "path", "authority":
+			default:
+				return nil, streamError(id, ErrCodeProtocol, "unknown pseudo-header %s", f.Name)
+			}
+			pseudo[name] = f.Value
+			continue
+		}
+		regular = true
+		if err := validField(f); err != nil {
+			return nil, streamError(id, ErrCodeProtocol, "%v", err)
+		}
+		// repeated fields are combined like the HTTP/1.1 parser does, cookies with their own separator
+		if prior := h.Get(f.Name); prior != "" {
+			sep := ", "
+			if f.Name == "cookie" {
+				sep = "; "
+			}
+			h.Set(f.Name, prior+sep+f.Value)
+		} else {
+			h.Add(f.Name, f.Value)
+		}
+	}
+
+	method := pseudo["method"]
+	target := pseudo["path"]
+	if method == "CONNECT" {
+		if _, ok := pseudo["scheme"]; ok || target != "" || pseudo["authority"] == "" {
+			return nil, streamError(id, ErrCodeProtocol, "CONNECT requires only :method and :authority")
+		}
+		target = pseudo["authority"]
+	} else if method == "" || pseudo["scheme"] == "" || target == "" {
+		return nil, streamError(id, ErrCodeProtocol, "missing :method, :scheme or :path")
+	}
+	if authority := pseudo["authority"]; authority != "" && !h.Has("Host") {
+		h.Set("Host", authority)
+	}
+
+	if h.Has(headers.CONTENT_LENGTH) {
+		n, err := h.GetContentLength()
+		if err != nil {
+			return nil, streamError(id, ErrCodeProtocol, "%v", err)
+		}
+		st.declared = int64(n)
+		if st.remoteDone && n != 0 {
+			return nil, streamError(id, ErrCodeProtocol, "content-length %d without a body", n)
+		}
+	}
+
+	var body io.ReadCloser = st.body
+	if st.remoteDone {
+		body = request.NoBody
+		st.body.err = io.EOF
+	}
+	line := &request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "2.0"}
+	req, err := request.NewFramedRequest(line, h, body, st.declared)
+	if err != nil {
+		return nil, streamError(id, ErrCodeProtocol, "%v", err)
+	}
+	st.body.trailers = req.Trailers
+	req.SetContext(st.ctx)
+	return req, nil
+}
@@ -0,0 +1,440 @@
+package http2
+
+import (
+	"bufio"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	enc  *Encoder
+	dec  *Decoder
+}
+
+type testResponse struct {
+	status   string
+	header   map[string]string
+	body     string
+	trailers map[string]string
+	// frames of the stream, in the order they were received
+	frames []*Frame
+	reset  ErrorCode
+}
+
+// startConn serves a connection with handler, the response is finished when the handler returns
+// like the server does. The client sends the preface with settings and acknowledges the server SETTINGS.
+func startConn(t *testing.T, config Config, handler Handler, settings ...Setting) (*ServerConn, *testClient) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	conns := make(chan *ServerConn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		sc := NewServerConn(conn, conn, config, func(res *response.Response, req *request.Request) {
+			handler(res, req)
+			res.Finish()
+		})
+		conns <- sc
+		sc.Serve()
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	c := &testClient{t: t, conn: conn, br: bufio.NewReader(conn), enc: NewEncoder(), dec: NewDecoder(DEFAULT_HEADER_TABLE_SIZE)}
+
+	_, err = io.WriteString(conn, CLIENT_PREFACE)
+	require.NoError(t, err)
+	c.write(SettingsFrame(settings...))
+	f := c.read()
+	require.Equal(t, FrameSettings, f.Type)
+	require.False(t, f.Has(FlagAck))
+	c.write(&Frame{Type: FrameSettings, Flags: FlagAck})
+	return <-conns, c
+}
+
+func (c *testClient) write(f *Frame) {
+	require.NoError(c.t, WriteFrame(c.conn, f))
+}
+
+func (c *testClient) read() *Frame {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f, err := ReadFrame(c.br, MAX_FRAME_SIZE_LIMIT)
+	require.NoError(c.t, err)
+	return f
+}
+
+// readFrame skips the frames of the connection (SETTINGS ack, WINDOW_UPDATE, ...) until one of type typ
+func (c *testClient) readFrame(typ FrameType) *Frame {
+	for {
+		if f := c.read(); f.Type == typ {
+			return f
+		}
+	}
+}
+
+func (c *testClient) request(id uint32, endStream bool, fields ...HeaderField) {
+	flags := FlagEndHeaders
+	if endStream {
+		flags |= FlagEndStream
+	}
+	c.write(&Frame{Type: FrameHeaders, Flags: flags, StreamID: id, Payload: c.enc.Encode(fields)})
+}
+
+func (c *testClient) get(id uint32, path string, extra ...HeaderField) {
+	fields := []HeaderField{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: path}, {Name: ":authority", Value: "localhost"}}
+	c.request(id, true, append(fields, extra...)...)
+}
+
+// response reads the frames of stream id until END_STREAM or RST_STREAM
+func (c *testClient) response(id uint32) *testResponse {
+	res := &testResponse{header: map[string]string{}, trailers: map[string]string{}}
+	for {
+		f := c.read()
+		if f.StreamID != id {
+			continue
+		}
+		res.frames = append(res.frames, f)
+		switch f.Type {
+		case FrameHeaders:
+			block, err := f.HeaderBlock()
+			require.NoError(c.t, err)
+			for !f.Has(FlagEndHeaders) {
+				f = c.read()
+				require.Equal(c.t, FrameContinuation, f.Type)
+				block = append(block, f.Payload...)
+			}
+			fields, err := c.dec.Decode(block)
+			require.NoError(c.t, err)
+			dst := res.header
+			if res.status != "" {
+				dst = res.trailers
+			}
+			for _, field := range fields {
+				if field.Name == ":status" {
+					res.status = field.Value
+				} else {
+					dst[field.Name] = field.Value
+				}
+			}
+		case FrameData:
+			data, err := f.Data()
+			require.NoError(c.t, err)
+			res.body += string(data)
+		case FrameRSTStream:
+			res.reset = f.ErrorCode()
+			return res
+		}
+		if f.Has(FlagEndStream) {
+			return res
+		}
+	}
+}
+
+func TestServerConn(t *testing.T) {
+	t.Run("request and response", func(t *testing.T) {
+		_, c := startConn(t, Config{}, func(res *response.Response, req *request.Request) {
+			res.Header().Set("X-Method", req.RequestLine.Method)
+			res.Header().Set("X-Host", req.Headers.Get("Host"))
+			res.Write([]byte("path " + req.URL.Path + " query " + req.URL.Query.Get("q")))
+		})
+		c.get(1, "/hello?q=world")
+		res := c.response(1)
+		assert.Equal(t, "200", res.status)
+		assert.Equal(t, "GET", res.header["x-method"])
+		assert.Equal(t, "localhost", res.header["x-host"])
+		assert.Equal(t, "path /hello query world", res.body)
+		assert.Equal(t, "23", res.header["content-length"])
+		// connection-specific fields are dropped
+		assert.NotContains(t, res.header, "connection")
+	})
+
+	t.Run("streaming body and trailers", func(t *testing.T) {
+		_, c := startConn(t, Config{}, func(res *response.Response, req *request.Request) {
+			res.Header().Set(headers.TRAILER, "x-checksum")
+			res.Flush()
+			for i := range 3 {
+				res.Write([]byte(strings.Repeat(string(rune('a'+i)), 10)))
+			}
+			res.Trailer().Set("X-Checksum", "abc")
+		})
+		c.get(1, "/chunked")
+		res := c.response(1)
+		assert.Equal(t, strings.Repeat("a", 10)+strings.Repeat("b", 10)+strings.Repeat("c", 10), res.body)
+		assert.NotContains(t, res.header, "transfer-encoding")
+		assert.Equal(t, map[string]string{"x-checksum": "abc"}, res.trailers)
+
+		// HEADERS, a DATA frame per write, trailing HEADERS that ends the stream
+		require.Len(t, res.frames, 5)
+		for _, f := range res.frames[1:4] {
+			assert.Equal(t, FrameData, f.Type)
+			assert.False(t, f.Has(FlagEndStream))
+		}
+		last := res.frames[4]
+		assert.Equal(t, FrameHeaders, last.Type)
+		assert.True(t, last.Has(FlagEndStream))
+	})
+
+	t.Run("request body and trailers", func(t *testing.T) {
+		_, c := startConn(t, Config{}, func(res *response.Response, req *request.Request) {
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			res.Header().Set("X-Length", req.Headers.Get(headers.CONTENT_LENGTH))
+			res.Write(body)
+			res.Write([]byte(" " + req.Trailers.Get("x-trailer")))
+		})
+		c.request(1, false, HeaderField{Name: ":method", Value: "POST"}, HeaderField{Name: ":scheme", Value: "http"}, HeaderField{Name: ":path", Value: "/echo"})
+		c.write(&Frame{Type: FrameData, StreamID: 1, Payload: []byte("hello ")})
+		c.write(&Frame{Type: FrameData, Flags: FlagPadded, StreamID: 1, Payload: []byte{3, 'h', '2', 0, 0, 0}})
+		c.request(1, true, HeaderField{Name: "x-trailer", Value: "done"})
+		res := c.response(1)
+		assert.Equal(t, "hello h2 done", res.body)
+	})
+
+	t.Run("content-length mismatch", func(t *testing.T) {
+		_, c := startConn(t, Config{}, func(res *response.Response, req *request.Request) {
+			io.ReadAll(req.Body)
+		})
+		c.request(1, false, HeaderField{Name: ":method", Value: "POST"}, HeaderField{Name: ":scheme", Value: "http"}, HeaderField{Name: ":path", Value: "/"},
+			HeaderField{Name: "content-length", Value: "3"})
+		c.write(&Frame{Type: FrameData, Flags: FlagEndStream, StreamID: 1, Payload: []byte("toolong")})
+		assert.Equal(t, ErrCodeProtocol, c.response(1).reset)
+	})
+
+	t.Run("malformed requests", func(t *testing.T) {
+		_, c := startConn(t, Config{}, func(res *response.Response, req *request.Request) {})
+		tests := [][]HeaderField{
+			{{Name: ":method", Value: "GET"}, {Name: ":path", Value: "/"}},
+			{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: "Upper", Value: "x"}},
+			{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: "connection", Value: "keep-alive"}},
+			{{Name: ":method", Value: "GET"}, {Name: "x-first", Value: "1"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}},
+			{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: ":unknown", Value: "x"}},
+		}
+		for i, fields := range tests {
+			id := uint32(2*i + 1)
+			c.request(id, true, fields...)
+			assert.Equal(t, ErrCodeProtocol, c.response(id).reset, "request %d", i)
+		}
+	})
+
+	t.Run("multiplexed streams", func(t *testing.T) {
+		release := make(chan struct{})
+		_, c := startConn(t, Config{}, func(res *response.Response, req *request.Request) {
+			if req.URL.Path == "/slow" {
+				<-release
+			}
+			res.Write([]byte(req.URL.Path))
+		})
+		c.get(1, "/slow")
+		c.get(3, "/fast")
+		// the second stream is served while the first one waits
+		assert.Equal(t, "/fast", c.response(3).body)
+		close(release)
+		assert.Equal(t, "/slow", c.response(1).body)
+	})
+
+	t.Run("concurrent streams limit", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+		_, c := startConn(t, Config{MaxConcurrentStreams: 1}, func(res *response.Response, req *request.Request) {
+			<-release
+		})
+		c.get(1, "/")
+		c.get(3, "/")
+		assert.Equal(t, ErrCodeRefusedStream, c.response(3).reset)
+	})
+
+	t.Run("flow control", func(t *testing.T) {
+		_, c := startConn(t, Config{}, func(res *response.Response, req *request.Request) {
+			res.Write([]byte(strings.Repeat("x", 25)))
+		}, Setting{SettingInitialWindowSize, 10})
+		c.get(1, "/")
+
+		f := c.readFrame(FrameHeaders)
+		assert.Equal(t, uint32(1), f.StreamID)
+		f = c.readFrame(FrameData)
+		assert.Len(t, f.Payload, 10)
+
+		// nothing else is sent until the window grows
+		c.write(WindowUpdateFrame(1, 100))
+		f = c.readFrame(FrameData)
+		assert.Len(t, f.Payload, 15)
+		assert.True(t, f.Has(FlagEndStream))
+	})
+
+	t.Run("window updates for the request body", func(t *testing.T) {
+		body := strings.Repeat("y", DEFAULT_MAX_FRAME_SIZE)
+		_, c := startConn(t, Config{StreamWindowSize: DEFAULT_MAX_FRAME_SIZE * 2}, func(res *response.Response, req *request.Request) {
+			data, _ := io.ReadAll(req.Body)
+			res.Write([]byte{byte(len(data) / DEFAULT_MAX_FRAME_SIZE)})
+		})
+		c.request(1, false, HeaderField{Name: ":method", Value: "POST"}, HeaderField{Name: ":scheme", Value: "http"}, HeaderField{Name: ":path", Value: "/"})
+		c.write(&Frame{Type: FrameData, StreamID: 1, Payload: []byte(body)})
+		f := c.readFrame(FrameWindowUpdate)
+		for f.StreamID != 1 {
+			f = c.readFrame(FrameWindowUpdate)
+		}
+		incr, err := f.WindowIncrement()
+		require.NoError(t, err)
+		assert.Equal(t, uint32(DEFAULT_MAX_FRAME_SIZE), incr)
+
+		for range 2 {
+			c.write(&Frame{Type: FrameData, StreamID: 1, Payload: []byte(body)})
+		}
+		c.write(&Frame{Type: FrameData, Flags: FlagEndStream, StreamID: 1})
+		assert.Equal(t, "\x03", c.response(1).body)
+	})
+
+	t.Run("HEAD", func(t *testing.T) {
+		_, c := startConn(t, Config{}, func(res *response.Response, req *request.Request) {
+			res.Write([]byte("ignored"))
+		})
+		c.request(1, true, HeaderField{Name: ":method", Value: "HEAD"}, HeaderField{Name: ":scheme", Value: "http"}, HeaderField{Name: ":path", Value: "/"})
+		res := c.response(1)
+		assert.Equal(t, "7", res.header["content-length"])
+		assert.Empty(t, res.body)
+		require.Len(t, res.frames, 1)
+		assert.True(t, res.frames[0].Has(FlagEndStream))
+	})
+
+	t.Run("PING", func(t *testing.T) {
+		_, c := startConn(t, Config{}, func(res *response.Response, req *request.Request) {})
+		c.write(&Frame{Type: FramePing, Payload: []byte("12345678")})
+		f := c.readFrame(FramePing)
+		assert.True(t, f.Has(FlagAck))
+		assert.Equal(t, "12345678", string(f.Payload))
+	})
+
+	t.Run("connection errors", func(t *testing.T) {
+		tests := map[string]struct {
+			frame *Frame
+			code  ErrorCode
+		}{
+			"DATA on idle stream":     {&Frame{Type: FrameData, StreamID: 5, Payload: []byte("x")}, ErrCodeProtocol},
+			"HEADERS on even stream":  {&Frame{Type: FrameHeaders, Flags: FlagEndHeaders, StreamID: 2}, ErrCodeProtocol},
+			"PUSH_PROMISE":            {&Frame{Type: FramePushPromise, Flags: FlagEndHeaders, StreamID: 1, Payload: make([]byte, 4)}, ErrCodeProtocol},
+			"broken header block":     {&Frame{Type: FrameHeaders, Flags: FlagEndHeaders, StreamID: 1, Payload: []byte{0xff, 0x00}}, ErrCodeCompression},
+			"window overflow":         {WindowUpdateFrame(0, MAX_WINDOW_SIZE), ErrCodeFlowControl},
+			"unexpected CONTINUATION": {&Frame{Type: FrameContinuation, Flags: FlagEndHeaders, StreamID: 1}, ErrCodeProtocol},
+		}
+		for name, tt := range tests {
+			_, c := startConn(t, Config{}, func(res *response.Response, req *request.Request) {})
+			c.write(tt.frame)
+			f := c.readFrame(FrameGoAway)
+			assert.Equal(t, tt.code, f.ErrorCode(), name)
+		}
+	})
+
+	t.Run("HEADERS on a closed stream", func(t *testing.T) {
+		handler := func(res *response.Response, req *request.Request) {
+			res.Write([]byte("ok"))
+		}
+		// a stream closed by both sides
+		_, c := startConn(t, Config{}, handler)
+		c.get(1, "/")
+		assert.Equal(t, "ok", c.response(1).body)
+		c.get(1, "/")
+		assert.Equal(t, ErrCodeProtocol, c.readFrame(FrameGoAway).ErrorCode())
+
+		// a stream skipped by the client
+		_, c = startConn(t, Config{}, handler)
+		c.get(5, "/")
+		assert.Equal(t, "ok", c.response(5).body)
+		c.get(3, "/")
+		assert.Equal(t, ErrCodeProtocol, c.readFrame(FrameGoAway).ErrorCode())
+
+		// the client may still send the trailers of a stream reset by the server
+		_, c = startConn(t, Config{}, handler)
+		c.request(1, false, HeaderField{Name: ":method", Value: "POST"}, HeaderField{Name: ":path", Value: "/"})
+		assert.Equal(t, ErrCodeProtocol, c.response(1).reset)
+		c.request(1, true, HeaderField{Name: "x-checksum", Value: "abc"})
+		c.get(3, "/")
+		assert.Equal(t, "ok", c.response(3).body)
+	})
+
+	t.Run("CONTINUATION", func(t *testing.T) {
+		_, c := startConn(t, Config{}, func(res *response.Response, req *request.Request) {
+			res.Write([]byte(req.Headers.Get("x-long")))
+		})
+		long := strings.Repeat("z", 3*DEFAULT_MAX_FRAME_SIZE)
+		block := c.enc.Encode([]HeaderField{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: "x-long", Value: long}})
+		c.write(&Frame{Type: FrameHeaders, Flags: FlagEndStream, StreamID: 1, Payload: block[:100]})
+		for block = block[100:]; len(block) > 0; {
+			n := min(len(block), DEFAULT_MAX_FRAME_SIZE)
+			f := &Frame{Type: FrameContinuation, StreamID: 1, Payload: block[:n]}
+			if block = block[n:]; len(block) == 0 {
+				f.Flags = FlagEndHeaders
+			}
+			c.write(f)
+		}
+		assert.Equal(t, long, c.response(1).body)
+	})
+
+	t.Run("graceful shutdown", func(t *testing.T) {
+		release := make(chan struct{})
+		sc, c := startConn(t, Config{}, func(res *response.Response, req *request.Request) {
+			<-release
+			res.Write([]byte("done"))
+		})
+		c.get(1, "/")
+		time.Sleep(50 * time.Millisecond)
+		sc.Shutdown()
+
+		f := c.readFrame(FrameGoAway)
+		assert.Equal(t, uint32(1), f.LastStreamID())
+		assert.Equal(t, ErrCodeNo, f.ErrorCode())
+
+		// streams opened after GOAWAY are ignored, the open one completes
+		c.get(3, "/")
+		close(release)
+		assert.Equal(t, "done", c.response(1).body)
+		c.conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := ReadFrame(c.br, MAX_FRAME_SIZE_LIMIT)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		_, c := startConn(t, Config{IdleTimeout: 50 * time.Millisecond}, func(res *response.Response, req *request.Request) {})
+		f := c.readFrame(FrameGoAway)
+		assert.Equal(t, ErrCodeNo, f.ErrorCode())
+	})
+
+	t.Run("client reset", func(t *testing.T) {
+		errs := make(chan error, 1)
+		_, c := startConn(t, Config{}, func(res *response.Response, req *request.Request) {
+			res.Flush()
+			for {
+				if _, err := res.Write(make([]byte, 1024)); err != nil {
+					errs <- err
+					return
+				}
+				res.Flush()
+			}
+		}, Setting{SettingInitialWindowSize, 0})
+		c.get(1, "/")
+		c.readFrame(FrameHeaders)
+		c.write(RSTStreamFrame(1, ErrCodeCancel))
+		select {
+		case err := <-errs:
+			assert.ErrorIs(t, err, ErrStreamReset)
+		case <-time.After(2 * time.Second):
+			t.Fatal("handler not stopped by RST_STREAM")
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Responses with a Content-Length smaller than this are not compressed
+const COMPRESS_MIN_SIZE = 1024
+
+// Supported content-codings, preferred in this order when the client gives them the same weight.
+// "deflate" is the zlib format (RFC 9110 section 8.4.1.2).
+var encoders = []struct {
+	name string
+	new  func(w io.Writer) io.WriteCloser
+}{
+	{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+	{"deflate", func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }},
+}
+
+// Content types that are already compressed
+var (
+	incompressiblePrefixes = []string{"image/", "video/", "audio/", "font/woff"}
+	incompressibleTypes    = []string{
+		"application/gzip", "application/x-gzip", "application/zip", "application/zstd",
+		"application/x-bzip2", "application/x-7z-compressed", "application/x-rar-compressed",
+	}
+)
+
+// Compress encodes the response body with the coding negotiated from Accept-Encoding (gzip or deflate).
+// Streamed and chunked bodies are compressed on the fly and sent chunked, the trailers follow the compressed body.
+// Small bodies, already compressed content types and responses with a Content-Encoding are left untouched.
+func Compress() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(res *response.Response, req *request.Request) *server.HandlerError {
+			encoding := negotiateEncoding(req.Headers.Get(headers.ACCEPT_ENCODING))
+			res.AddBodyFilter(compressFilter(encoding))
+			return next(res, req)
+		}
+	}
+}
+
+func compressFilter(encoding string) response.BodyFilter {
+	return func(status *response.StatusCode, h *headers.Headers, w io.Writer) io.WriteCloser {
+		// the body depends on Accept-Encoding even when it's not compressed
+		if !h.HasToken(headers.VARY, headers.ACCEPT_ENCODING) && !h.HasToken(headers.VARY, "*") {
+			h.Add(headers.VARY, "Accept-Encoding")
+		}
+		// a partial response (206) is a range of the unencoded representation
+		if encoding == "" || status.Code == response.PARTIAL_CONTENT.Code || h.Has(headers.CONTENT_ENCODING) || !compressible(h.Get(headers.CONTENT_TYPE)) {
+			return nil
+		}
+		if h.Has(headers.CONTENT_LENGTH) {
+			if length, err := h.GetContentLength(); err != nil || length < COMPRESS_MIN_SIZE {
+				return nil
+			}
+		}
+
+		h.Set(headers.CONTENT_ENCODING, encoding)
+		// the encoded representation is not byte-for-byte the same, a strong validator becomes weak
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		for _, e := range encoders {
+			if e.name == encoding {
+				return e.new(w)
+			}
+		}
+		return nil
+	}
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+	for _, prefix := range incompressiblePrefixes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	for _, t := range incompressibleTypes {
+		if mediaType == t {
+			return false
+		}
+	}
+	return true
+}
+
+// negotiateEncoding returns the supported coding with the highest q-value in Accept-Encoding,
+// "*" matches the codings not listed and q=0 means "not acceptable" (RFC 9110 section 12.5.3).
+// An empty result means the body is sent as is.
+func negotiateEncoding(accept string) string {
+	weights := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		weight := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(param, "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(k), "q") {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil || q < 0 || q > 1 {
+				q = 0
+			}
+			weight = q
+		}
+		if name == "*" {
+			wildcard = weight
+		} else {
+			weights[name] = weight
+		}
+	}
+
+	best, bestWeight := "", 0.0
+	for _, e := range encoders {
+		weight, ok := weights[e.name]
+		if !ok {
+			weight = wildcard
+		}
+		if weight > bestWeight {
+			best, bestWeight = e.name, weight
+		}
+	}
+	return best
+}
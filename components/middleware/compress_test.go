@@ -0,0 +1,197 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"gzip, deflate, br", "gzip"},
+		{"deflate;q=1.0, gzip;q=0.5", "deflate"},
+		{"gzip;q=0, deflate", "deflate"},
+		{"gzip;q=0, deflate;q=0", ""},
+		{"br", ""},
+		{"*", "gzip"},
+		{"*;q=0.1, gzip;q=0", "deflate"},
+		{"identity, *;q=0", ""},
+		{"x-gzip", "gzip"},
+		{"GZIP ; Q=0.8", "gzip"},
+		{"gzip;q=abc, deflate;q=0.2", "deflate"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, negotiateEncoding(tt.accept), "Accept-Encoding: %q", tt.accept)
+	}
+}
+
+// compressed runs the handler behind Compress and parses the raw response
+func compressed(t *testing.T, accept string, handler server.Handler) *http.Response {
+	t.Helper()
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\n"
+	if accept != "" {
+		raw += "Accept-Encoding: " + accept + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	res := &response.Response{Writer: &buf, KeepAlive: true}
+	require.Nil(t, Compress()(handler)(res, req))
+	require.NoError(t, res.Finish())
+	assert.Equal(t, response.ResponseDone, res.State())
+
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), nil)
+	require.NoError(t, err)
+	return resp
+}
+
+func decode(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	var r io.Reader = resp.Body
+	var err error
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		r, err = gzip.NewReader(resp.Body)
+	case "deflate":
+		r, err = zlib.NewReader(resp.Body)
+	}
+	require.NoError(t, err)
+	body, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestCompress(t *testing.T) {
+	text := strings.Repeat("compress me please ", 200)
+
+	t.Run("streamed body", func(t *testing.T) {
+		for _, encoding := range []string{"gzip", "deflate"} {
+			resp := compressed(t, encoding, func(res *response.Response, req *request.Request) *server.HandlerError {
+				res.Header().Set(headers.CONTENT_TYPE, "text/plain")
+				io.WriteString(res, text)
+				return nil
+			})
+			assert.Equal(t, encoding, resp.Header.Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+			assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+			assert.Equal(t, text, decode(t, resp))
+		}
+	})
+
+	t.Run("HEAD describes the GET response", func(t *testing.T) {
+		for _, handler := range []server.Handler{
+			func(res *response.Response, req *request.Request) *server.HandlerError {
+				res.Header().Set(headers.CONTENT_TYPE, "text/plain")
+				io.WriteString(res, text)
+				return nil
+			},
+			func(res *response.Response, req *request.Request) *server.HandlerError {
+				res.WriteResponse(&response.OK, nil, []byte(text))
+				return nil
+			},
+		} {
+			req, err := request.RequestFromReader(strings.NewReader("HEAD / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n"))
+			require.NoError(t, err)
+			var buf bytes.Buffer
+			res := &response.Response{Writer: &buf, KeepAlive: true, Head: true}
+			require.Nil(t, Compress()(handler)(res, req))
+			require.NoError(t, res.Finish())
+
+			raw := buf.String()
+			resp, err := http.ReadResponse(bufio.NewReader(&buf), &http.Request{Method: "HEAD"})
+			require.NoError(t, err)
+			assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+			assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+			// nothing follows the headers
+			assert.Equal(t, len(raw), strings.Index(raw, "\r\n\r\n")+4)
+		}
+	})
+
+	t.Run("WriteResponse with a Content-Length", func(t *testing.T) {
+		resp := compressed(t, "gzip", func(res *response.Response, req *request.Request) *server.HandlerError {
+			res.WriteResponse(&response.OK, nil, []byte(text))
+			return nil
+		})
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, int64(-1), resp.ContentLength)
+		assert.Equal(t, text, decode(t, resp))
+	})
+
+	t.Run("chunked body with trailers", func(t *testing.T) {
+		resp := compressed(t, "gzip", func(res *response.Response, req *request.Request) *server.HandlerError {
+			h := headers.NewHeaders()
+			h.Set(headers.TRANSFER_ENCODING, "chunked")
+			h.Set(headers.TRAILER, "X-Checksum")
+			res.WriteResponse(&response.OK, h, nil)
+			for i := 0; i < len(text); i += 100 {
+				res.WriteChunkedBody([]byte(text[i:min(i+100, len(text))]))
+			}
+			trailers := headers.NewHeaders()
+			trailers.Set("X-Checksum", "abc")
+			res.WriteTrailers(trailers)
+			return nil
+		})
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, text, decode(t, resp))
+		assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+	})
+
+	t.Run("small body is not compressed", func(t *testing.T) {
+		resp := compressed(t, "gzip", func(res *response.Response, req *request.Request) *server.HandlerError {
+			res.Write([]byte("tiny"))
+			return nil
+		})
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+		assert.Equal(t, int64(4), resp.ContentLength)
+		assert.Equal(t, "tiny", decode(t, resp))
+	})
+
+	t.Run("compressed content type is skipped", func(t *testing.T) {
+		resp := compressed(t, "gzip", func(res *response.Response, req *request.Request) *server.HandlerError {
+			res.Header().Set(headers.CONTENT_TYPE, "image/png")
+			io.WriteString(res, text)
+			return nil
+		})
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, text, decode(t, resp))
+	})
+
+	t.Run("client without Accept-Encoding", func(t *testing.T) {
+		resp := compressed(t, "", func(res *response.Response, req *request.Request) *server.HandlerError {
+			io.WriteString(res, text)
+			return nil
+		})
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, int64(len(text)), resp.ContentLength)
+	})
+
+	t.Run("strong ETag becomes weak", func(t *testing.T) {
+		resp := compressed(t, "gzip", func(res *response.Response, req *request.Request) *server.HandlerError {
+			res.Header().Set("ETag", `"v1"`)
+			io.WriteString(res, text)
+			return nil
+		})
+		assert.Equal(t, `W/"v1"`, resp.Header.Get("ETag"))
+	})
+}
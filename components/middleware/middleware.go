@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Logger logs method, target, duration and, when the handler fails, the error status of each request
+func Logger(logger *slog.Logger) server.Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(next server.Handler) server.Handler {
+		return func(res *response.Response, req *request.Request) *server.HandlerError {
+			start := time.Now()
+			hErr := next(res, req)
+
+			attrs := []any{
+				"method", req.RequestLine.Method,
+				"target", req.RequestLine.RequestTarget,
+				"duration", time.Since(start),
+			}
+			if id := req.ID(); id != "" {
+				attrs = append(attrs, "request_id", id)
+			}
+			if hErr != nil {
+				logger.Warn("Request failed", append(attrs, "status", hErr.StatusCode.Code)...)
+			} else {
+				logger.Info("Request", attrs...)
+			}
+			return hErr
+		}
+	}
+}
+
+// Header carrying the request ID, from the client (or a proxy in front of the server) and in the response
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+// Longer request IDs sent by the client are replaced by a generated one
+const MAX_REQUEST_ID_LEN = 128
+
+// RequestID sets the ID of each request (req.ID()) from its X-Request-Id header, or a random one
+// when the client sends none, and echoes it in the response. Logger adds it to its records.
+func RequestID() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(res *response.Response, req *request.Request) *server.HandlerError {
+			id := req.Headers.Get(REQUEST_ID_HEADER)
+			if id == "" || len(id) > MAX_REQUEST_ID_LEN || strings.ContainsAny(id, ",\r\n") {
+				id = newRequestID()
+			}
+			req.SetID(id)
+			res.Header().Set(REQUEST_ID_HEADER, id)
+			hErr := next(res, req)
+			if hErr == nil {
+				return nil
+			}
+			// the server drops the response headers to write the error, the ID goes with the error instead
+			withID := *hErr
+			if hErr.Headers != nil {
+				withID.Headers = hErr.Headers.Clone()
+			} else {
+				withID.Headers = headers.NewHeaders()
+			}
+			withID.Headers.Set(REQUEST_ID_HEADER, id)
+			return &withID
+		}
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"bytes"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	req, err := request.RequestFromReader(strings.NewReader("GET /users HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+
+	h := Logger(logger)(func(res *response.Response, req *request.Request) *server.HandlerError {
+		return &server.HandlerError{StatusCode: &response.NOT_FOUND}
+	})
+	hErr := h(&response.Response{Writer: &bytes.Buffer{}}, req)
+
+	require.NotNil(t, hErr)
+	assert.Contains(t, logs.String(), "method=GET")
+	assert.Contains(t, logs.String(), "target=/users")
+	assert.Contains(t, logs.String(), "status=404")
+}
+
+func TestRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	h := server.Chain(Logger(logger), RequestID())(func(res *response.Response, req *request.Request) *server.HandlerError {
+		res.Write([]byte(req.ID()))
+		return nil
+	})
+
+	t.Run("from the client", func(t *testing.T) {
+		req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nX-Request-Id: abc-123\r\n\r\n"))
+		require.NoError(t, err)
+		res := &response.Response{Writer: &bytes.Buffer{}}
+		h(res, req)
+
+		assert.Equal(t, "abc-123", req.ID())
+		assert.Equal(t, "abc-123", request.IDFromContext(req.Context()))
+		assert.Equal(t, "abc-123", res.Header().Get(REQUEST_ID_HEADER))
+		assert.Contains(t, logs.String(), "request_id=abc-123")
+	})
+
+	t.Run("generated", func(t *testing.T) {
+		req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nX-Request-Id: a,b\r\n\r\n"))
+		require.NoError(t, err)
+		res := &response.Response{Writer: &bytes.Buffer{}}
+		h(res, req)
+
+		assert.Len(t, req.ID(), 32)
+		assert.Equal(t, req.ID(), res.Header().Get(REQUEST_ID_HEADER))
+	})
+
+	t.Run("error response", func(t *testing.T) {
+		notAllowed := &server.HandlerError{StatusCode: &response.METHOD_NOT_ALLOWED, Message: []byte("no"), Headers: headers.NewHeaders()}
+		notAllowed.Headers.Set("Allow", "GET")
+		h := RequestID()(func(res *response.Response, req *request.Request) *server.HandlerError {
+			return notAllowed
+		})
+		req, err := request.RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nX-Request-Id: abc-123\r\n\r\n"))
+		require.NoError(t, err)
+		hErr := h(&response.Response{Writer: &bytes.Buffer{}}, req)
+		require.NotNil(t, hErr)
+
+		// as the server does: the error replaces the response
+		var out bytes.Buffer
+		require.NoError(t, hErr.Write(&response.Response{Writer: &out}))
+		assert.Contains(t, out.String(), "HTTP/1.1 405")
+		assert.Contains(t, out.String(), "x-request-id: abc-123\r\n")
+		assert.Contains(t, out.String(), "allow: GET\r\n")
+		// the error of the handler isn't changed
+		assert.False(t, notAllowed.Headers.Has(REQUEST_ID_HEADER))
+	})
+}
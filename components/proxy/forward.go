@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const PROXY_REALM = "proxy"
+
+// When a side of a tunnel is closed, the other one is closed after this time
+const TUNNEL_CLOSE_TIMEOUT = 10 * time.Second
+
+// destinationRule matches a destination of the forward proxy: a host ("example.com"), every subdomain
+// ("*.example.com"), optionally with a port ("example.com:443"), or a network ("10.0.0.0/8")
+type destinationRule struct {
+	host    string
+	port    string
+	network *net.IPNet
+}
+
+func parseRules(patterns []string) []destinationRule {
+	rules := make([]destinationRule, 0, len(patterns))
+	for _, pattern := range patterns {
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			rules = append(rules, destinationRule{network: network})
+			continue
+		}
+		rule := destinationRule{host: pattern}
+		if host, port, err := net.SplitHostPort(pattern); err == nil {
+			rule.host, rule.port = host, port
+		}
+		rule.host = strings.ToLower(strings.Trim(rule.host, "[]"))
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// match checks the host and the port, a network rule checks the addresses of the host
+func (r destinationRule) match(host string, port string, ips []net.IP) bool {
+	if r.network != nil {
+		for _, ip := range ips {
+			if r.network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if r.port != "" && r.port != port {
+		return false
+	}
+	if suffix, ok := strings.CutPrefix(r.host, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return r.host == host
+}
+
+// WithAllow restricts the destinations of ForwardProxy to the ones matching a pattern:
+// "example.com", "*.example.com", "example.com:443" or a network like "192.168.0.0/16"
+func WithAllow(patterns ...string) Option {
+	return func(p *reverseProxy) {
+		p.allow = append(p.allow, parseRules(patterns)...)
+	}
+}
+
+// WithDeny rejects the destinations of ForwardProxy matching a pattern (see WithAllow), deny wins over allow
+func WithDeny(patterns ...string) Option {
+	return func(p *reverseProxy) {
+		p.deny = append(p.deny, parseRules(patterns)...)
+	}
+}
+
+// WithBasicAuth requires the Proxy-Authorization credentials for ForwardProxy
+func WithBasicAuth(user string, password string) Option {
+	return func(p *reverseProxy) {
+		p.credentials = user + ":" + password
+	}
+}
+
+// ForwardProxy serves the requests of clients configured to use a proxy: CONNECT opens a tunnel to
+// host:port, a request with an absolute URI ("GET http://example.com/ HTTP/1.1") is forwarded.
+// It's mounted as the handler of the server, not on a route.
+func ForwardProxy(opts ...Option) server.Handler {
+	p := newReverseProxy(nil, opts...)
+	p.forwardedHeaders = false
+	return p.serveForward
+}
+
+func (p *reverseProxy) serveForward(res *response.Response, req *request.Request) *server.HandlerError {
+	if hErr := p.authorize(req); hErr != nil {
+		return hErr
+	}
+	switch req.URL.Form {
+	case request.AuthorityForm:
+		return p.tunnel(res, req)
+	case request.AbsoluteForm:
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return &server.HandlerError{StatusCode: &response.BAD_REQUEST, Message: []byte("Unsupported scheme")}
+		}
+		port := "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+		host := req.URL.Host
+		if h, hp, err := net.SplitHostPort(host); err == nil {
+			host, port = h, hp
+		}
+		addr, hErr := p.checkDestination(req, host, port)
+		if hErr != nil {
+			return hErr
+		}
+		return p.forward(res, req, &url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host}, addr, nil)
+	}
+	return &server.HandlerError{StatusCode: &response.BAD_REQUEST, Message: []byte("Not a proxy request")}
+}
+
+// authorize checks the Basic credentials of Proxy-Authorization, the field isn't forwarded
+func (p *reverseProxy) authorize(req *request.Request) *server.HandlerError {
+	if p.credentials == "" {
+		return nil
+	}
+	scheme, encoded, _ := strings.Cut(req.Headers.Get("Proxy-Authorization"), " ")
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err == nil && strings.EqualFold(scheme, "Basic") && subtle.ConstantTimeCompare(decoded, []byte(p.credentials)) == 1 {
+		return nil
+	}
+	h := headers.NewHeaders()
+	h.Set("Proxy-Authenticate", `Basic realm="`+PROXY_REALM+`"`)
+	return &server.HandlerError{StatusCode: &response.PROXY_AUTHENTICATION_REQUIRED, Message: []byte("Proxy authentication required"), Headers: h}
+}
+
+// checkDestination applies the deny and allow rules and returns the address to dial. When a network rule
+// is set the host is resolved once, the tunnel and the forwarded request dial the checked address so that
+// DNS can't change it.
+func (p *reverseProxy) checkDestination(req *request.Request, host string, port string) (string, *server.HandlerError) {
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if hasNetworkRule(p.allow) || hasNetworkRule(p.deny) {
+		addrs, err := p.lookupIP(req.Context(), "ip", host)
+		if err != nil || len(addrs) == 0 {
+			return "", &server.HandlerError{StatusCode: &response.BAD_GATEWAY, Message: []byte("Unknown host")}
+		}
+		ips = addrs
+	}
+
+	forbidden := &server.HandlerError{StatusCode: &response.FORBIDDEN, Message: []byte("Destination not allowed")}
+	for _, rule := range p.deny {
+		if rule.match(host, port, ips) {
+			return "", forbidden
+		}
+	}
+	if len(p.allow) > 0 {
+		allowed := false
+		for _, rule := range p.allow {
+			if rule.match(host, port, ips) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", forbidden
+		}
+	}
+
+	if len(ips) > 0 {
+		return net.JoinHostPort(ips[0].String(), port), nil
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func hasNetworkRule(rules []destinationRule) bool {
+	for _, rule := range rules {
+		if rule.network != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnel connects to the destination, answers 200 and copies the bytes both ways until both sides are done
+func (p *reverseProxy) tunnel(res *response.Response, req *request.Request) *server.HandlerError {
+	host, port, err := net.SplitHostPort(req.URL.Host)
+	if err != nil {
+		return &server.HandlerError{StatusCode: &response.BAD_REQUEST, Message: []byte("CONNECT target must be host:port")}
+	}
+	addr, hErr := p.checkDestination(req, host, port)
+	if hErr != nil {
+		return hErr
+	}
+	dialer := &net.Dialer{Timeout: p.dialTimeout}
+	upstream, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return upstreamError(&url.URL{Host: req.URL.Host}, err)
+	}
+	defer upstream.Close()
+
+	conn, rd, err := res.Hijack()
+	if err != nil {
+		return &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte(err.Error())}
+	}
+	defer conn.Close()
+	// a 2xx answer to CONNECT has no framing, the tunnel starts right after the blank line
+	if _, err := io.WriteString(conn, response.HTTP_VERSION+" 200 Connection Established\r\n\r\n"); err != nil {
+		return nil
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		// the bytes already buffered by the server (e.g. a TLS ClientHello) come first
+		io.Copy(upstream, rd)
+		closeWrite(upstream)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+	// once a side is done the other one gets some time to finish, closing both connections ends the copy
+	<-done
+	select {
+	case <-done:
+	case <-time.After(TUNNEL_CLOSE_TIMEOUT):
+	}
+	return nil
+}
+
+// closeWrite half-closes the connection so that the other side sees the end of the stream
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
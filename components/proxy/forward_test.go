@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoListener echoes the bytes of every connection until the client closes its side
+func echoListener(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// proxyRequest sends a raw request to the proxy and returns the connection positioned after the response headers
+func proxyRequest(t *testing.T, proxyAddr string, raw string) (net.Conn, *bufio.Reader, string, map[string]string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, raw)
+
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	require.NoError(t, err)
+	hdrs := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		k, v, _ := strings.Cut(line, ": ")
+		hdrs[strings.ToLower(k)] = v
+	}
+	return conn, r, strings.TrimRight(status, "\r\n"), hdrs
+}
+
+func TestForwardProxyConnect(t *testing.T) {
+	echo := echoListener(t)
+	front := startServer(t, ForwardProxy())
+
+	// the first bytes of the tunnel are sent with the CONNECT request
+	conn, r, status, _ := proxyRequest(t, front.Host, fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nearly ", echo, echo))
+	assert.Equal(t, "HTTP/1.1 200 Connection Established", status)
+	io.WriteString(conn, "bytes")
+	buf := make([]byte, len("early bytes"))
+	_, err := io.ReadFull(r, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "early bytes", string(buf))
+
+	// closing our side ends the tunnel
+	conn.(*net.TCPConn).CloseWrite()
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	t.Run("unreachable destination", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := l.Addr().String()
+		l.Close()
+
+		_, _, status, _ := proxyRequest(t, front.Host, fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr))
+		assert.Equal(t, "HTTP/1.1 502 Bad Gateway", status)
+	})
+}
+
+func TestForwardProxyHTTP(t *testing.T) {
+	target := startServer(t, upstream)
+	front := startServer(t, ForwardProxy())
+
+	_, r, status, hdrs := proxyRequest(t, front.Host, fmt.Sprintf(
+		"GET http://%s/api/page?x=1 HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\n\r\n", target.Host, target.Host))
+	assert.Equal(t, "HTTP/1.1 201 Created", status)
+	assert.Equal(t, "/api/page?x=1", hdrs["seen-target"])
+	assert.Equal(t, target.Host, hdrs["seen-host"])
+	assert.Equal(t, "1.1 "+VIA_PSEUDONYM, hdrs["seen-via"])
+	// a forward proxy doesn't reveal the client
+	assert.Empty(t, hdrs["seen-x-forwarded-for"])
+	assert.Empty(t, hdrs["seen-forwarded"])
+	assert.Equal(t, "1.1 "+VIA_PSEUDONYM, hdrs["via"])
+	assert.NotNil(t, r)
+
+	_, _, status, _ = proxyRequest(t, front.Host, "GET /local HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 400 Bad Request", status)
+}
+
+func TestForwardProxyPinnedAddress(t *testing.T) {
+	target := startServer(t, upstream)
+	_, port, _ := net.SplitHostPort(target.Host)
+
+	// a rebinding host: the first lookup passes the rules, the next ones point to a denied network
+	var lookups atomic.Int32
+	p := newReverseProxy(nil, WithAllow("127.0.0.0/8"), WithDeny("10.0.0.0/8"))
+	p.forwardedHeaders = false
+	p.lookupIP = func(ctx context.Context, network string, host string) ([]net.IP, error) {
+		if lookups.Add(1) == 1 {
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		}
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+	front := startServer(t, p.serveForward)
+
+	host := "rebind.test:" + port
+	_, _, status, hdrs := proxyRequest(t, front.Host, fmt.Sprintf("GET http://%s/pinned HTTP/1.1\r\nHost: %s\r\n\r\n", host, host))
+	assert.Equal(t, "HTTP/1.1 201 Created", status)
+	assert.Equal(t, host, hdrs["seen-host"])
+	// the request is sent to the checked address, the host isn't resolved again
+	assert.Equal(t, int32(1), lookups.Load())
+}
+
+func TestForwardProxyRules(t *testing.T) {
+	echo := echoListener(t)
+	_, echoPort, _ := net.SplitHostPort(echo)
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		target string
+		status string
+	}{
+		{"denied network", []Option{WithDeny("127.0.0.0/8")}, echo, "403"},
+		{"denied host", []Option{WithDeny("localhost")}, "localhost:" + echoPort, "403"},
+		{"denied wildcard", []Option{WithDeny("*.example.com")}, "api.example.com:443", "403"},
+		{"not in allow list", []Option{WithAllow("*.example.com:443")}, echo, "403"},
+		{"allowed port", []Option{WithAllow("127.0.0.1:" + echoPort)}, echo, "200"},
+		{"other port", []Option{WithAllow("127.0.0.1:1")}, echo, "403"},
+		{"deny wins", []Option{WithAllow("127.0.0.0/8"), WithDeny("127.0.0.1")}, echo, "403"},
+		{"allowed network", []Option{WithAllow("127.0.0.0/8")}, "localhost:" + echoPort, "200"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			front := startServer(t, ForwardProxy(tt.opts...))
+			_, _, status, _ := proxyRequest(t, front.Host, fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", tt.target, tt.target))
+			assert.Contains(t, status, " "+tt.status+" ")
+		})
+	}
+}
+
+func TestForwardProxyAuth(t *testing.T) {
+	echo := echoListener(t)
+	front := startServer(t, ForwardProxy(WithBasicAuth("qa", "s3cret")))
+	connect := "CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\n"
+
+	_, _, status, hdrs := proxyRequest(t, front.Host, connect+"\r\n")
+	assert.Equal(t, "HTTP/1.1 407 Proxy Authentication Required", status)
+	assert.Equal(t, `Basic realm="proxy"`, hdrs["proxy-authenticate"])
+
+	wrong := base64.StdEncoding.EncodeToString([]byte("qa:wrong"))
+	_, _, status, _ = proxyRequest(t, front.Host, connect+"Proxy-Authorization: Basic "+wrong+"\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 407 Proxy Authentication Required", status)
+
+	valid := base64.StdEncoding.EncodeToString([]byte("qa:s3cret"))
+	_, _, status, _ = proxyRequest(t, front.Host, connect+"Proxy-Authorization: Basic "+valid+"\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 Connection Established", status)
+}
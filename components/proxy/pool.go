@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"encoding/json"
+	"http/components/client"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Consecutive failed probes before an upstream is marked unhealthy, and successful ones to bring it back
+const (
+	DEFAULT_UNHEALTHY_THRESHOLD = 2
+	DEFAULT_HEALTHY_THRESHOLD   = 1
+)
+
+// Passive outlier ejection: consecutive failures (5xx or connection errors) and how long the upstream is skipped
+const (
+	DEFAULT_MAX_FAILURES  = 5
+	DEFAULT_EJECTION_TIME = 30 * time.Second
+)
+
+// Upstream is a server of a Pool, it must not be copied once the pool is created
+type Upstream struct {
+	URL *url.URL
+	// Weight is used by the Weighted and ConsistentHash strategies, 0 counts as 1
+	Weight int
+
+	active atomic.Int64
+
+	mu                  sync.Mutex
+	healthy             bool
+	probeFailures       int
+	probeSuccesses      int
+	consecutiveFailures int
+	ejectedUntil        time.Time
+	requests            int64
+	failures            int64
+}
+
+// Available reports whether the upstream is healthy and not ejected
+func (u *Upstream) Available() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy && time.Now().After(u.ejectedUntil)
+}
+
+// ActiveRequests is the number of requests in flight on the upstream
+func (u *Upstream) ActiveRequests() int64 {
+	return u.active.Load()
+}
+
+func (u *Upstream) weight() int {
+	return max(u.Weight, 1)
+}
+
+// Pool balances the requests between upstreams, see LoadBalancer
+type Pool struct {
+	upstreams []*Upstream
+	strategy  Strategy
+
+	healthPath     string
+	healthInterval time.Duration
+	healthTimeout  time.Duration
+	maxFailures    int
+	ejectionTime   time.Duration
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type PoolOption func(*Pool)
+
+// WithStrategy selects how an upstream is picked, RoundRobin by default
+func WithStrategy(s Strategy) PoolOption {
+	return func(p *Pool) {
+		p.strategy = s
+	}
+}
+
+// WithHealthCheck probes GET path on every upstream each interval, a 2xx or 3xx answer within timeout is healthy
+func WithHealthCheck(path string, interval time.Duration, timeout time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.healthPath, p.healthInterval, p.healthTimeout = path, interval, timeout
+	}
+}
+
+// WithOutlierEjection skips an upstream for ejectionTime after maxFailures consecutive 5xx or connection errors,
+// 0 disables the ejection
+func WithOutlierEjection(maxFailures int, ejectionTime time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.maxFailures, p.ejectionTime = maxFailures, ejectionTime
+	}
+}
+
+// NewPool starts the health checks when WithHealthCheck is set, Close stops them
+func NewPool(upstreams []*Upstream, opts ...PoolOption) *Pool {
+	p := &Pool{
+		upstreams:    upstreams,
+		strategy:     RoundRobin(),
+		maxFailures:  DEFAULT_MAX_FAILURES,
+		ejectionTime: DEFAULT_EJECTION_TIME,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	for _, u := range upstreams {
+		u.healthy = true
+	}
+	if p.healthInterval > 0 {
+		go p.healthChecks()
+	} else {
+		close(p.done)
+	}
+	return p
+}
+
+// Upstreams returns the upstreams of the pool
+func (p *Pool) Upstreams() []*Upstream {
+	return p.upstreams
+}
+
+// Close stops the health checks
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() { close(p.stop) })
+	<-p.done
+}
+
+// next picks an upstream with the strategy, nil when none is available
+func (p *Pool) next(req *request.Request) *Upstream {
+	return p.strategy.Next(req, p.upstreams)
+}
+
+// report records the outcome of a proxied request for the passive outlier ejection
+func (p *Pool) report(u *Upstream, ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.requests++
+	if ok {
+		u.consecutiveFailures = 0
+		return
+	}
+	u.failures++
+	u.consecutiveFailures++
+	if p.maxFailures > 0 && u.consecutiveFailures >= p.maxFailures {
+		u.ejectedUntil = time.Now().Add(p.ejectionTime)
+		u.consecutiveFailures = 0
+	}
+}
+
+func (p *Pool) healthChecks() {
+	defer close(p.done)
+	c := client.New(client.WithTimeout(p.healthTimeout), client.WithMaxRedirects(0))
+	defer c.CloseIdleConnections()
+	ticker := time.NewTicker(p.healthInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, u := range p.upstreams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.probe(c, u)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) probe(c *client.Client, u *Upstream) {
+	ok := false
+	resp, err := c.Get(u.URL.Scheme + "://" + u.URL.Host + joinPath(u.URL.Path, p.healthPath))
+	if err == nil {
+		resp.Body.Close()
+		ok = resp.StatusCode >= 200 && resp.StatusCode < 400
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if ok {
+		u.probeFailures = 0
+		u.probeSuccesses++
+		if !u.healthy && u.probeSuccesses >= DEFAULT_HEALTHY_THRESHOLD {
+			u.healthy = true
+		}
+		return
+	}
+	u.probeSuccesses = 0
+	u.probeFailures++
+	if u.healthy && u.probeFailures >= DEFAULT_UNHEALTHY_THRESHOLD {
+		u.healthy = false
+	}
+}
+
+// UpstreamStatus is the state of an upstream shown by AdminHandler
+type UpstreamStatus struct {
+	URL            string     `json:"url"`
+	Weight         int        `json:"weight"`
+	Healthy        bool       `json:"healthy"`
+	Ejected        bool       `json:"ejected"`
+	EjectedUntil   *time.Time `json:"ejectedUntil,omitempty"`
+	ActiveRequests int64      `json:"activeRequests"`
+	Requests       int64      `json:"requests"`
+	Failures       int64      `json:"failures"`
+}
+
+func (p *Pool) Status() []UpstreamStatus {
+	status := make([]UpstreamStatus, 0, len(p.upstreams))
+	now := time.Now()
+	for _, u := range p.upstreams {
+		u.mu.Lock()
+		s := UpstreamStatus{
+			URL:            u.URL.String(),
+			Weight:         u.weight(),
+			Healthy:        u.healthy,
+			Ejected:        now.Before(u.ejectedUntil),
+			ActiveRequests: u.active.Load(),
+			Requests:       u.requests,
+			Failures:       u.failures,
+		}
+		if s.Ejected {
+			until := u.ejectedUntil
+			s.EjectedUntil = &until
+		}
+		u.mu.Unlock()
+		status = append(status, s)
+	}
+	return status
+}
+
+// AdminHandler answers the state of the upstreams in JSON
+func (p *Pool) AdminHandler() server.Handler {
+	return func(res *response.Response, req *request.Request) *server.HandlerError {
+		body, err := json.MarshalIndent(map[string]any{"upstreams": p.Status()}, "", "  ")
+		if err != nil {
+			return &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte(err.Error())}
+		}
+		res.Header().Set(headers.CONTENT_TYPE, "application/json")
+		res.Header().Set("Cache-Control", "no-store")
+		res.Write(append(body, '\n'))
+		return nil
+	}
+}
+
+// LoadBalancer proxies the requests to the upstreams of the pool, it answers 503 when none is available.
+// The options are the ones of ReverseProxy.
+func LoadBalancer(pool *Pool, opts ...Option) server.Handler {
+	p := newReverseProxy(nil, opts...)
+	p.pool = pool
+	return p.serve
+}
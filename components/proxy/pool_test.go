@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"http/components/client"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"io"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newUpstreams(t *testing.T, weights ...int) []*Upstream {
+	t.Helper()
+	upstreams := make([]*Upstream, len(weights))
+	for i, w := range weights {
+		u, err := url.Parse(fmt.Sprintf("http://10.0.0.%d:8080", i+1))
+		require.NoError(t, err)
+		upstreams[i] = &Upstream{URL: u, Weight: w}
+	}
+	NewPool(upstreams)
+	return upstreams
+}
+
+func clientRequest(addr string, header string) *request.Request {
+	req := request.NewRequest()
+	req.RemoteAddr = addr
+	req.Headers.Set("X-Session", header)
+	return req
+}
+
+// pick counts the upstreams picked for n requests
+func pick(s Strategy, upstreams []*Upstream, n int) map[*Upstream]int {
+	counts := map[*Upstream]int{}
+	for i := range n {
+		counts[s.Next(clientRequest(fmt.Sprintf("192.0.2.%d:5000", i), ""), upstreams)]++
+	}
+	return counts
+}
+
+func TestStrategies(t *testing.T) {
+	t.Run("round robin skips unavailable upstreams", func(t *testing.T) {
+		ups := newUpstreams(t, 1, 1, 1)
+		counts := pick(RoundRobin(), ups, 9)
+		assert.Equal(t, map[*Upstream]int{ups[0]: 3, ups[1]: 3, ups[2]: 3}, counts)
+
+		ups[1].healthy = false
+		counts = pick(RoundRobin(), ups, 8)
+		assert.Equal(t, map[*Upstream]int{ups[0]: 4, ups[2]: 4}, counts)
+
+		ups[0].healthy, ups[2].healthy = false, false
+		assert.Nil(t, RoundRobin().Next(clientRequest("", ""), ups))
+	})
+
+	t.Run("least connections", func(t *testing.T) {
+		ups := newUpstreams(t, 1, 1, 1)
+		ups[0].active.Store(3)
+		ups[1].active.Store(1)
+		ups[2].active.Store(2)
+		assert.Equal(t, map[*Upstream]int{ups[1]: 5}, pick(LeastConnections(), ups, 5))
+	})
+
+	t.Run("smooth weighted", func(t *testing.T) {
+		ups := newUpstreams(t, 5, 1, 1)
+		s := Weighted()
+		var order []int
+		for range 7 {
+			u := s.Next(clientRequest("", ""), ups)
+			order = append(order, int(u.URL.Host[7]-'0'))
+		}
+		assert.Equal(t, []int{1, 1, 2, 1, 3, 1, 1}, order)
+	})
+
+	t.Run("consistent hash", func(t *testing.T) {
+		ups := newUpstreams(t, 1, 1, 1, 1)
+		s := ConsistentHash(HashHeader("X-Session"))
+		before := map[string]*Upstream{}
+		for i := range 200 {
+			key := fmt.Sprint("session-", i)
+			before[key] = s.Next(clientRequest("", key), ups)
+			assert.Same(t, before[key], s.Next(clientRequest("", key), ups))
+		}
+		assert.Len(t, pick(ConsistentHash(HashClientIP), ups, 200), 4)
+
+		// only the keys of the removed upstream move
+		ups[2].healthy = false
+		moved := 0
+		for key, u := range before {
+			after := s.Next(clientRequest("", key), ups)
+			if u == ups[2] {
+				assert.NotSame(t, ups[2], after)
+				moved++
+			} else {
+				assert.Same(t, u, after)
+			}
+		}
+		assert.Greater(t, moved, 0)
+	})
+}
+
+// backend answers its name, /health answers 500 while failing is set
+func backend(t *testing.T, name string, failing *atomic.Bool) *Upstream {
+	t.Helper()
+	u := startServer(t, func(res *response.Response, req *request.Request) *server.HandlerError {
+		if failing.Load() {
+			return &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte(name)}
+		}
+		io.WriteString(res, name)
+		return nil
+	})
+	return &Upstream{URL: u}
+}
+
+func getBody(t *testing.T, c *client.Client, u string) (int, string) {
+	t.Helper()
+	resp, err := c.Get(u)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestLoadBalancer(t *testing.T) {
+	c := client.New(client.WithTimeout(5 * time.Second))
+
+	t.Run("active health checks", func(t *testing.T) {
+		var aFailing, bFailing atomic.Bool
+		a, b := backend(t, "a", &aFailing), backend(t, "b", &bFailing)
+		pool := NewPool([]*Upstream{a, b}, WithHealthCheck("/health", 10*time.Millisecond, time.Second), WithOutlierEjection(0, 0))
+		defer pool.Close()
+		front := startServer(t, LoadBalancer(pool))
+
+		bFailing.Store(true)
+		require.Eventually(t, func() bool { return !b.Available() }, 2*time.Second, 5*time.Millisecond)
+		for range 4 {
+			_, body := getBody(t, c, front.String()+"/")
+			assert.Equal(t, "a", body)
+		}
+
+		bFailing.Store(false)
+		require.Eventually(t, b.Available, 2*time.Second, 5*time.Millisecond)
+		seen := map[string]bool{}
+		for range 4 {
+			_, body := getBody(t, c, front.String()+"/")
+			seen[body] = true
+		}
+		assert.Equal(t, map[string]bool{"a": true, "b": true}, seen)
+	})
+
+	t.Run("outlier ejection", func(t *testing.T) {
+		var aFailing, bFailing atomic.Bool
+		a, b := backend(t, "a", &aFailing), backend(t, "b", &bFailing)
+		pool := NewPool([]*Upstream{a, b}, WithOutlierEjection(2, time.Minute))
+		defer pool.Close()
+		front := startServer(t, LoadBalancer(pool))
+
+		aFailing.Store(true)
+		for range 4 {
+			getBody(t, c, front.String()+"/")
+		}
+		assert.False(t, a.Available())
+		for range 3 {
+			status, body := getBody(t, c, front.String()+"/")
+			assert.Equal(t, 200, status)
+			assert.Equal(t, "b", body)
+		}
+
+		var status []UpstreamStatus
+		admin := startServer(t, pool.AdminHandler())
+		_, body := getBody(t, c, admin.String()+"/")
+		require.NoError(t, json.Unmarshal([]byte(body), &struct {
+			Upstreams *[]UpstreamStatus `json:"upstreams"`
+		}{&status}))
+		require.Len(t, status, 2)
+		assert.True(t, status[0].Ejected)
+		assert.NotNil(t, status[0].EjectedUntil)
+		assert.Equal(t, int64(2), status[0].Failures)
+		assert.False(t, status[1].Ejected)
+		assert.Equal(t, int64(5), status[1].Requests)
+	})
+
+	t.Run("no upstream available", func(t *testing.T) {
+		var failing atomic.Bool
+		a := backend(t, "a", &failing)
+		pool := NewPool([]*Upstream{a}, WithOutlierEjection(1, time.Minute))
+		front := startServer(t, LoadBalancer(pool))
+
+		failing.Store(true)
+		status, _ := getBody(t, c, front.String()+"/")
+		assert.Equal(t, 500, status)
+		status, _ = getBody(t, c, front.String()+"/")
+		assert.Equal(t, 503, status)
+	})
+}
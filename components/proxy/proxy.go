@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"http/components/client"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Wait for the response headers of the upstream before answering 504
+const DEFAULT_UPSTREAM_TIMEOUT = 30 * time.Second
+
+// Name of this proxy in the Via header
+const VIA_PSEUDONYM = "http-proxy"
+
+// Bodies without Content-Length are flushed after each read of this size at most
+const COPY_BUFFER_SIZE = 32 << 10
+
+// Fields that only concern a single connection, they are never forwarded (RFC 9110 section 7.6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type reverseProxy struct {
+	// a single target, or a pool for LoadBalancer
+	target         *url.URL
+	pool           *Pool
+	client         *client.Client
+	clientOpts     []client.Option
+	rewrite        func(out *client.Request, in *request.Request)
+	modifyResponse func(resp *client.Response) error
+	// X-Forwarded-* and Forwarded are added by a reverse proxy, a forward proxy only adds Via
+	forwardedHeaders bool
+
+	// ForwardProxy only
+	dialTimeout time.Duration
+	lookupIP    func(ctx context.Context, network string, host string) ([]net.IP, error)
+	allow       []destinationRule
+	deny        []destinationRule
+	credentials string
+}
+
+type Option func(*reverseProxy)
+
+// WithTimeout limits the wait for the upstream response headers, the body can stream for longer
+func WithTimeout(d time.Duration) Option {
+	return func(p *reverseProxy) {
+		p.clientOpts = append(p.clientOpts, client.WithResponseHeaderTimeout(d))
+	}
+}
+
+// WithDialTimeout limits the connection to the upstream, the destination of a tunnel included
+func WithDialTimeout(d time.Duration) Option {
+	return func(p *reverseProxy) {
+		p.clientOpts = append(p.clientOpts, client.WithDialTimeout(d))
+		p.dialTimeout = d
+	}
+}
+
+// WithRewrite changes the outgoing request once the forwarding headers are set, e.g. to add authentication
+// or to change the path. The Host header always comes from out.URL.
+func WithRewrite(rewrite func(out *client.Request, in *request.Request)) Option {
+	return func(p *reverseProxy) {
+		p.rewrite = rewrite
+	}
+}
+
+// WithModifyResponse changes the upstream response before it's sent back, an error answers 502
+func WithModifyResponse(modify func(resp *client.Response) error) Option {
+	return func(p *reverseProxy) {
+		p.modifyResponse = modify
+	}
+}
+
+// ReverseProxy forwards the requests to target, the request path is appended to the path of target.
+// Redirects of the upstream are sent back to the client.
+func ReverseProxy(target *url.URL, opts ...Option) server.Handler {
+	return newReverseProxy(target, opts...).serve
+}
+
+func newReverseProxy(target *url.URL, opts ...Option) *reverseProxy {
+	p := &reverseProxy{
+		target:           target,
+		clientOpts:       []client.Option{client.WithMaxRedirects(0), client.WithResponseHeaderTimeout(DEFAULT_UPSTREAM_TIMEOUT)},
+		forwardedHeaders: true,
+		dialTimeout:      client.DEFAULT_DIAL_TIMEOUT,
+		lookupIP:         net.DefaultResolver.LookupIP,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.client = client.New(p.clientOpts...)
+	return p
+}
+
+func (p *reverseProxy) serve(res *response.Response, req *request.Request) *server.HandlerError {
+	target := p.target
+	var upstream *Upstream
+	if p.pool != nil {
+		upstream = p.pool.next(req)
+		if upstream == nil {
+			return &server.HandlerError{StatusCode: &response.SERVICE_UNAVAILABLE, Message: []byte("No upstream available")}
+		}
+		upstream.active.Add(1)
+		defer upstream.active.Add(-1)
+		target = upstream.URL
+	}
+	return p.forward(res, req, target, "", upstream)
+}
+
+// forward sends the request to target and streams the response back, the outcome is reported to the pool
+// when the target is one of its upstreams. A non-empty addr is dialed instead of the host of target.
+func (p *reverseProxy) forward(res *response.Response, req *request.Request, target *url.URL, addr string, upstream *Upstream) *server.HandlerError {
+	out, err := outgoingRequest(target, req, p.forwardedHeaders)
+	if err != nil {
+		return &server.HandlerError{StatusCode: &response.BAD_REQUEST, Message: []byte("Invalid request target")}
+	}
+	out.Addr = addr
+	if p.rewrite != nil {
+		p.rewrite(out, req)
+	}
+
+	resp, err := p.client.Do(out)
+	if upstream != nil {
+		// connection errors and 5xx count against the upstream for the outlier ejection
+		p.pool.report(upstream, err == nil && resp.StatusCode < 500)
+	}
+	if err != nil {
+		return upstreamError(out.URL, err)
+	}
+	defer resp.Body.Close()
+	if p.modifyResponse != nil {
+		if err := p.modifyResponse(resp); err != nil {
+			return upstreamError(out.URL, err)
+		}
+	}
+
+	res.SetStatus(&response.StatusCode{Reason: resp.Reason, Code: uint16(resp.StatusCode)})
+	copyHeaders(res.Header(), resp.Headers)
+	res.Header().Add("Via", resp.Proto+" "+VIA_PSEUDONYM)
+
+	// a body without Content-Length may be a stream (e.g. Server-Sent Events), it's flushed as it comes
+	streaming := !resp.Headers.Has(headers.CONTENT_LENGTH)
+	if err := copyBody(res, resp.Body, streaming); err != nil {
+		// the response has started: the server closes the connection so that the client sees the truncation
+		return upstreamError(out.URL, err)
+	}
+	resp.Trailers.ForEach(func(k, v string) {
+		res.Trailer().Add(k, v)
+	})
+	return nil
+}
+
+// outgoingRequest copies the incoming request for the upstream, adding the forwarding headers
+func outgoingRequest(target *url.URL, req *request.Request, forwardedHeaders bool) (*client.Request, error) {
+	path := req.URL.RawPath
+	if path == "" {
+		path = "/"
+	}
+	rawURL := target.Scheme + "://" + target.Host + joinPath(target.Path, path)
+	if req.URL.RawQuery != "" {
+		rawURL += "?" + req.URL.RawQuery
+	}
+
+	var body io.Reader
+	if req.Body != request.NoBody {
+		body = req.Body
+	}
+	out, err := client.NewRequest(req.RequestLine.Method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		out.ContentLength = req.ContentLength()
+		// the trailers of a chunked body are known once the client has sent it
+		out.Trailers = req.Trailers
+	}
+
+	copyHeaders(out.Headers, req.Headers)
+	out.Headers.Del("Host")
+	out.Headers.Add("Via", req.RequestLine.HttpVersion+" "+VIA_PSEUDONYM)
+	if !forwardedHeaders {
+		return out, nil
+	}
+
+	host := req.Headers.Get("Host")
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+	if prior := out.Headers.Get("X-Forwarded-For"); prior != "" {
+		out.Headers.Set("X-Forwarded-For", prior+", "+clientIP)
+	} else {
+		out.Headers.Set("X-Forwarded-For", clientIP)
+	}
+	out.Headers.Set("X-Forwarded-Host", host)
+	out.Headers.Set("X-Forwarded-Proto", proto)
+	out.Headers.Add("Forwarded", "for="+forwardedValue(clientIP)+";host="+forwardedValue(host)+";proto="+proto)
+	return out, nil
+}
+
+// copyHeaders adds the end-to-end fields of src to dst, the fields named by Connection are hop-by-hop too
+func copyHeaders(dst *headers.Headers, src *headers.Headers) {
+	hop := map[string]bool{}
+	for _, name := range hopByHopHeaders {
+		hop[strings.ToLower(name)] = true
+	}
+	for _, value := range src.Values(headers.CONNECTION) {
+		for _, name := range strings.Split(value, ",") {
+			hop[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+	}
+	src.ForEach(func(k, v string) {
+		if !hop[strings.ToLower(k)] {
+			dst.Add(k, v)
+		}
+	})
+}
+
+func copyBody(res *response.Response, body io.Reader, streaming bool) error {
+	if !streaming {
+		_, err := io.Copy(res, body)
+		return err
+	}
+	buf := make([]byte, COPY_BUFFER_SIZE)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := res.Write(buf[:n]); err != nil {
+				return err
+			}
+			if err := res.Flush(); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// upstreamError answers 504 when the upstream timed out and 502 for the other failures
+func upstreamError(upstream *url.URL, err error) *server.HandlerError {
+	slog.Warn("Upstream request failed", "upstream", upstream.Host, "err", err)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &server.HandlerError{StatusCode: &response.GATEWAY_TIMEOUT, Message: []byte("Upstream timed out")}
+	}
+	return &server.HandlerError{StatusCode: &response.BAD_GATEWAY, Message: []byte("Upstream unavailable")}
+}
+
+func joinPath(base string, path string) string {
+	switch {
+	case base == "" || base == "/":
+		return path
+	case strings.HasSuffix(base, "/"):
+		return base + strings.TrimPrefix(path, "/")
+	default:
+		return base + path
+	}
+}
+
+// forwardedValue quotes the values that aren't tokens, e.g. an IPv6 address or a host with a port (RFC 7239)
+func forwardedValue(v string) string {
+	if strings.Contains(v, ":") {
+		if ip := net.ParseIP(v); ip != nil && ip.To4() == nil {
+			v = "[" + v + "]"
+		}
+		return `"` + v + `"`
+	}
+	return v
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"http/components/client"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler server.Handler) *url.URL {
+	t.Helper()
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	_, port, _ := net.SplitHostPort(s.Addr().String())
+	u, err := url.Parse("http://127.0.0.1:" + port)
+	require.NoError(t, err)
+	return u
+}
+
+// upstream reflects the request in the response headers and echoes the body
+func upstream(res *response.Response, req *request.Request) *server.HandlerError {
+	switch req.URL.Path {
+	case "/api/slow":
+		time.Sleep(200 * time.Millisecond)
+	case "/api/trailers":
+		res.Header().Set(headers.TRAILER, "X-Checksum")
+		io.WriteString(res, "streamed body")
+		res.Trailer().Set("X-Checksum", "abc")
+		return nil
+	case "/api/request-trailers":
+		body, _ := io.ReadAll(req.Body)
+		fmt.Fprintf(res, "%s trailer=%s checksum=%s", body, req.Headers.Get(headers.TRAILER), req.Trailers.Get("X-Checksum"))
+		return nil
+	}
+	for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded", "Via", "X-Custom", "Keep-Alive", "Host", "Authorization"} {
+		res.Header().Set("Seen-"+name, strings.Join(req.Headers.Values(name), " | "))
+	}
+	res.Header().Set("Seen-Target", req.RequestLine.RequestTarget)
+	res.SetStatus(&response.StatusCode{Reason: "Created", Code: 201})
+	io.Copy(res, req.Body)
+	return nil
+}
+
+func TestReverseProxy(t *testing.T) {
+	target := startServer(t, upstream)
+	target.Path = "/api"
+	front := startServer(t, ReverseProxy(target))
+	c := client.New(client.WithTimeout(5 * time.Second))
+
+	t.Run("forwarding headers", func(t *testing.T) {
+		req, err := client.NewRequest("GET", front.String()+"/users?id=7", nil)
+		require.NoError(t, err)
+		req.Headers.Set("X-Forwarded-For", "203.0.113.9")
+		req.Headers.Set("Connection", "X-Custom")
+		req.Headers.Set("X-Custom", "hop")
+		req.Headers.Set("Keep-Alive", "timeout=5")
+		resp, err := c.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, 201, resp.StatusCode)
+		assert.Equal(t, "Created", resp.Reason)
+		assert.Equal(t, "/api/users?id=7", resp.Headers.Get("Seen-Target"))
+		assert.Equal(t, "203.0.113.9, 127.0.0.1", resp.Headers.Get("Seen-X-Forwarded-For"))
+		assert.Equal(t, front.Host, resp.Headers.Get("Seen-X-Forwarded-Host"))
+		assert.Equal(t, "http", resp.Headers.Get("Seen-X-Forwarded-Proto"))
+		assert.Equal(t, fmt.Sprintf("for=127.0.0.1;host=%q;proto=http", front.Host), resp.Headers.Get("Seen-Forwarded"))
+		assert.Equal(t, "1.1 "+VIA_PSEUDONYM, resp.Headers.Get("Seen-Via"))
+		assert.Equal(t, target.Host, resp.Headers.Get("Seen-Host"))
+		// hop-by-hop fields and the ones named by Connection are dropped
+		assert.Empty(t, resp.Headers.Get("Seen-X-Custom"))
+		assert.Empty(t, resp.Headers.Get("Seen-Keep-Alive"))
+		assert.Equal(t, "1.1 "+VIA_PSEUDONYM, resp.Headers.Get("Via"))
+	})
+
+	t.Run("request bodies", func(t *testing.T) {
+		resp, err := c.Post(front.String()+"/echo", "text/plain", strings.NewReader("sized body"))
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "sized body", string(body))
+
+		// an unknown size is sent chunked
+		resp, err = c.Post(front.String()+"/echo", "text/plain", io.MultiReader(strings.NewReader("chunked "), strings.NewReader("body")))
+		require.NoError(t, err)
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "chunked body", string(body))
+	})
+
+	t.Run("chunked response with trailers", func(t *testing.T) {
+		resp, err := c.Get(front.String() + "/trailers")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "streamed body", string(body))
+		assert.Equal(t, "chunked", resp.Headers.Get("Transfer-Encoding"))
+		assert.Equal(t, "abc", resp.Trailers.Get("X-Checksum"))
+	})
+
+	t.Run("chunked request with trailers", func(t *testing.T) {
+		req, err := client.NewRequest("POST", front.String()+"/request-trailers", io.MultiReader(strings.NewReader("chunked "), strings.NewReader("body")))
+		require.NoError(t, err)
+		req.Headers.Set(headers.TRAILER, "X-Checksum")
+		req.Trailers = headers.NewHeaders()
+		req.Trailers.Set("X-Checksum", "xyz")
+		resp, err := c.Do(req)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "chunked body trailer=X-Checksum checksum=xyz", string(body))
+	})
+}
+
+func TestCopyHeaders(t *testing.T) {
+	src := headers.NewHeaders()
+	src.Set("Connection", "close, X-Internal")
+	src.Set("X-Internal", "secret")
+	src.Set("Transfer-Encoding", "chunked")
+	src.Set("Upgrade", "websocket")
+	src.Add("Set-Cookie", "a=1")
+	src.Add("Set-Cookie", "b=2")
+
+	dst := headers.NewHeaders()
+	copyHeaders(dst, src)
+	assert.Equal(t, 1, dst.Len())
+	assert.Equal(t, []string{"a=1", "b=2"}, dst.Values("Set-Cookie"))
+}
+
+func TestReverseProxyErrors(t *testing.T) {
+	c := client.New(client.WithTimeout(5 * time.Second))
+
+	t.Run("unreachable upstream", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := l.Addr().String()
+		l.Close()
+
+		front := startServer(t, ReverseProxy(&url.URL{Scheme: "http", Host: addr}))
+		resp, err := c.Get(front.String() + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, 502, resp.StatusCode)
+	})
+
+	t.Run("upstream timeout", func(t *testing.T) {
+		target := startServer(t, upstream)
+		front := startServer(t, ReverseProxy(target, WithTimeout(50*time.Millisecond)))
+		resp, err := c.Get(front.String() + "/api/slow")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, 504, resp.StatusCode)
+	})
+}
+
+func TestReverseProxyHooks(t *testing.T) {
+	target := startServer(t, upstream)
+	front := startServer(t, ReverseProxy(target,
+		WithRewrite(func(out *client.Request, in *request.Request) {
+			out.Headers.Set("Authorization", "Bearer internal")
+			out.URL.Path = "/api" + out.URL.Path
+		}),
+		WithModifyResponse(func(resp *client.Response) error {
+			if resp.Headers.Get("Seen-Target") == "/api/forbidden" {
+				return errors.New("blocked by the gateway")
+			}
+			resp.Headers.Set("X-Gateway", "yes")
+			return nil
+		}),
+	))
+	c := client.New(client.WithTimeout(5 * time.Second))
+
+	resp, err := c.Get(front.String() + "/users")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "/api/users", resp.Headers.Get("Seen-Target"))
+	assert.Equal(t, "Bearer internal", resp.Headers.Get("Seen-Authorization"))
+	assert.Equal(t, "yes", resp.Headers.Get("X-Gateway"))
+
+	resp, err = c.Get(front.String() + "/forbidden")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 502, resp.StatusCode)
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"cmp"
+	"hash/crc32"
+	"http/components/request"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Points of each upstream (per unit of weight) on the consistent hash ring
+const HASH_REPLICAS = 100
+
+// Strategy picks the upstream of a request among the available ones, nil when none is available.
+// A strategy keeps state, each pool needs its own.
+type Strategy interface {
+	Next(req *request.Request, upstreams []*Upstream) *Upstream
+}
+
+type roundRobin struct {
+	counter atomic.Uint64
+}
+
+// RoundRobin sends the requests to the upstreams in turn
+func RoundRobin() Strategy {
+	return &roundRobin{}
+}
+
+// Next turns over the available upstreams only, the load of an unavailable one is spread evenly
+func (s *roundRobin) Next(req *request.Request, upstreams []*Upstream) *Upstream {
+	available := availableUpstreams(upstreams)
+	if len(available) == 0 {
+		return nil
+	}
+	return available[(s.counter.Add(1)-1)%uint64(len(available))]
+}
+
+type leastConnections struct {
+	roundRobin
+}
+
+// LeastConnections picks the upstream with the fewest requests in flight, ties are broken in turn
+func LeastConnections() Strategy {
+	return &leastConnections{}
+}
+
+func (s *leastConnections) Next(req *request.Request, upstreams []*Upstream) *Upstream {
+	available := availableUpstreams(upstreams)
+	n := uint64(len(available))
+	start := s.counter.Add(1) - 1
+	var best *Upstream
+	for i := range n {
+		u := available[(start+i)%n]
+		if best == nil || u.ActiveRequests() < best.ActiveRequests() {
+			best = u
+		}
+	}
+	return best
+}
+
+type weighted struct {
+	mu      sync.Mutex
+	current map[*Upstream]int
+}
+
+// Weighted is a smooth weighted round robin (as in nginx): with weights 5, 1, 1 the first upstream
+// gets 5 of 7 requests, interleaved with the others
+func Weighted() Strategy {
+	return &weighted{current: map[*Upstream]int{}}
+}
+
+func (s *weighted) Next(req *request.Request, upstreams []*Upstream) *Upstream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var best *Upstream
+	total := 0
+	for _, u := range upstreams {
+		if !u.Available() {
+			continue
+		}
+		s.current[u] += u.weight()
+		total += u.weight()
+		if best == nil || s.current[u] > s.current[best] {
+			best = u
+		}
+	}
+	if best != nil {
+		s.current[best] -= total
+	}
+	return best
+}
+
+type consistentHash struct {
+	key  func(req *request.Request) string
+	once sync.Once
+	ring []ringPoint
+}
+
+type ringPoint struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+// ConsistentHash sends the requests with the same key to the same upstream, when an upstream becomes
+// unavailable only its keys move to the next upstreams of the ring
+func ConsistentHash(key func(req *request.Request) string) Strategy {
+	return &consistentHash{key: key}
+}
+
+// HashHeader keys ConsistentHash on a request header, e.g. a session or tenant id
+func HashHeader(name string) func(req *request.Request) string {
+	return func(req *request.Request) string {
+		return req.Headers.Get(name)
+	}
+}
+
+// HashClientIP keys ConsistentHash on the address of the client
+func HashClientIP(req *request.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (s *consistentHash) Next(req *request.Request, upstreams []*Upstream) *Upstream {
+	s.once.Do(func() {
+		for _, u := range upstreams {
+			for i := range HASH_REPLICAS * u.weight() {
+				s.ring = append(s.ring, ringPoint{crc32.ChecksumIEEE([]byte(u.URL.String() + "#" + strconv.Itoa(i))), u})
+			}
+		}
+		slices.SortFunc(s.ring, func(a, b ringPoint) int { return cmp.Compare(a.hash, b.hash) })
+	})
+	if len(s.ring) == 0 {
+		return nil
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(s.key(req)))
+	start, _ := slices.BinarySearchFunc(s.ring, hash, func(p ringPoint, h uint32) int { return cmp.Compare(p.hash, h) })
+	for i := range s.ring {
+		if u := s.ring[(start+i)%len(s.ring)].upstream; u.Available() {
+			return u
+		}
+	}
+	return nil
+}
+
+func availableUpstreams(upstreams []*Upstream) []*Upstream {
+	available := make([]*Upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if u.Available() {
+			available = append(available, u)
+		}
+	}
+	return available
+}
@@ -0,0 +1,128 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Unread bytes of a body are discarded up to this size to reuse the connection,
+// bigger leftovers make the connection unusable
+const MAX_DRAIN = 256 << 10
+
+var ErrBodyClosed = errors.New("read on closed body")
+
+var ErrBodyNotDrained = errors.New("too many unread body bytes to reuse the connection")
+
+// NoBody is the Body of a request without content
+var NoBody = noBody{}
+
+type noBody struct{}
+
+func (noBody) Read([]byte) (int, error) { return 0, io.EOF }
+func (noBody) Close() error             { return nil }
+
+// body streams a Content-Length delimited body from the Reader:
+// first the bytes already in the sliding window, then directly from the connection
+type body struct {
+	rd        *Reader
+	length    int64
+	remaining int64
+	closed    bool
+	err       error
+	done      func(err error) // called when the body is complete or broken
+}
+
+func newBody(rd *Reader, length int64, done func(error)) *body {
+	return &body{rd: rd, length: length, remaining: length, done: done}
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyClosed
+	}
+	return b.read(p)
+}
+
+func (b *body) read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+
+	n, err := b.rd.readData(p)
+	b.remaining -= int64(n)
+
+	if b.remaining == 0 {
+		b.done(nil)
+		return n, io.EOF
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		b.err = fmt.Errorf("body cannot be shorter or greater then Content-length.\n - content-length: %v\n - bodyRead: %v: %w", b.length, b.length-b.remaining, err)
+		b.done(b.err)
+		return n, b.err
+	}
+	return n, nil
+}
+
+// Close discards the unread part of the body so that the next request can be parsed
+func (b *body) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if b.err != nil {
+		return b.err
+	}
+	if b.remaining > MAX_DRAIN {
+		return ErrBodyNotDrained
+	}
+	buffer := make([]byte, BUFFER_CAPACITY)
+	for b.remaining > 0 {
+		if _, err := b.read(buffer); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeDelimitedBody is a body without framing, it ends when the stream ends (only for responses)
+type closeDelimitedBody struct {
+	rd     *Reader
+	closed bool
+	err    error
+	done   func(err error)
+}
+
+func (b *closeDelimitedBody) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyClosed
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.rd.readData(p)
+	if err != nil {
+		b.err = err
+		if errors.Is(err, io.EOF) {
+			b.done(nil)
+		} else {
+			b.done(err)
+		}
+	}
+	return n, err
+}
+
+// Close doesn't drain: the stream can't be reused after a close-delimited body
+func (b *closeDelimitedBody) Close() error {
+	b.closed = true
+	return nil
+}
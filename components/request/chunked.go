@@ -0,0 +1,246 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"http/components/headers"
+	"io"
+	"strconv"
+)
+
+type chunkedState string
+
+const (
+	chunkSize     chunkedState = "size"
+	chunkData     chunkedState = "data"
+	chunkDataEnd  chunkedState = "data-end"
+	chunkTrailers chunkedState = "trailers"
+	chunkDone     chunkedState = "done"
+)
+
+// chunkedBody decodes a body sent with "Transfer-Encoding: chunked" (RFC 9112 section 7.1):
+//
+//	chunk-size [ ; chunk-ext ] CRLF
+//	chunk-data CRLF
+//	...
+//	0 CRLF
+//	trailer-section
+//	CRLF
+type chunkedBody struct {
+	rd        *Reader
+	trailers  *headers.Headers
+	state     chunkedState
+	remaining int64 // unread bytes of the current chunk
+	decoded   int64 // total decoded bytes
+	closed    bool
+	err       error
+	done      func(err error) // called when the body is complete or broken
+}
+
+func newChunkedBody(rd *Reader, trailers *headers.Headers, done func(error)) *chunkedBody {
+	return &chunkedBody{rd: rd, trailers: trailers, state: chunkSize, done: done}
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyClosed
+	}
+	return b.read(p)
+}
+
+func (b *chunkedBody) read(p []byte) (int, error) {
+	for b.err == nil {
+		switch b.state {
+		case chunkSize:
+			line, err := b.rd.readLine()
+			if err != nil {
+				b.fail(err)
+				break
+			}
+			size, err := parseChunkSize(line)
+			if err != nil {
+				b.fail(err)
+				break
+			}
+			if max := b.rd.Limits.MaxBodyBytes; max > 0 && size > max-b.decoded {
+				b.fail(fmt.Errorf("%w: limit %d", ErrBodyTooLarge, max))
+				break
+			}
+			if size == 0 {
+				b.state = chunkTrailers
+			} else {
+				b.remaining = size
+				b.state = chunkData
+			}
+		case chunkData:
+			if len(p) == 0 {
+				return 0, nil
+			}
+			if int64(len(p)) > b.remaining {
+				p = p[:b.remaining]
+			}
+			n, err := b.rd.readData(p)
+			b.remaining -= int64(n)
+			b.decoded += int64(n)
+			if b.remaining == 0 {
+				b.state = chunkDataEnd
+			}
+			if n == 0 && err != nil {
+				if errors.Is(err, io.EOF) {
+					err = io.ErrUnexpectedEOF
+				}
+				b.fail(err)
+				break
+			}
+			return n, nil
+		case chunkDataEnd:
+			line, err := b.rd.readLine()
+			if err != nil {
+				b.fail(err)
+				break
+			}
+			if len(line) != 0 {
+				b.fail(fmt.Errorf("chunk data is longer than its size"))
+				break
+			}
+			b.state = chunkSize
+		case chunkTrailers:
+			// the trailer-section is parsed like the header-section
+			if err := b.rd.ReadHeaders(b.trailers); err != nil {
+				b.fail(err)
+				break
+			}
+			b.state = chunkDone
+			b.done(nil)
+		case chunkDone:
+			return 0, io.EOF
+		}
+	}
+	return 0, b.err
+}
+
+func (b *chunkedBody) fail(err error) {
+	b.err = fmt.Errorf("malformed chunked body after %d bytes: %w", b.decoded, err)
+	b.done(b.err)
+}
+
+// Close discards the unread chunks so that the next request can be parsed
+func (b *chunkedBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	buffer := make([]byte, BUFFER_CAPACITY)
+	start := b.decoded
+	for {
+		if b.decoded-start > MAX_DRAIN {
+			return ErrBodyNotDrained
+		}
+		if _, err := b.read(buffer); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// parseChunkSize parses "chunk-size [ ; chunk-ext ]", extensions are validated and ignored
+func parseChunkSize(line []byte) (int64, error) {
+	size, ext, _ := bytes.Cut(line, []byte{';'})
+	size = bytes.TrimRight(size, " \t")
+	if len(size) == 0 {
+		return 0, fmt.Errorf("missing chunk size")
+	}
+	for _, c := range size {
+		if !isHex(c) {
+			return 0, fmt.Errorf("invalid chunk size: %q", size)
+		}
+	}
+	n, err := strconv.ParseInt(string(size), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chunk size: %q", size)
+	}
+	if len(ext) > 0 {
+		if err := validateChunkExt(ext); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// chunk-ext = *( BWS ";" BWS chunk-ext-name [ BWS "=" BWS chunk-ext-val ] ), ext starts after the first ";"
+func validateChunkExt(ext []byte) error {
+	i := 0
+	for {
+		i = skipBWS(ext, i)
+		if n := tokenLen(ext[i:]); n > 0 {
+			i += n
+		} else {
+			return fmt.Errorf("invalid chunk extension name: %q", ext)
+		}
+		i = skipBWS(ext, i)
+		if i < len(ext) && ext[i] == '=' {
+			i = skipBWS(ext, i+1)
+			n := tokenLen(ext[i:])
+			if i < len(ext) && ext[i] == '"' {
+				n = quotedStringLen(ext[i:])
+			}
+			if n == 0 {
+				return fmt.Errorf("invalid chunk extension value: %q", ext)
+			}
+			i = skipBWS(ext, i+n)
+		}
+		if i == len(ext) {
+			return nil
+		}
+		if ext[i] != ';' {
+			return fmt.Errorf("invalid chunk extension: %q", ext)
+		}
+		i++
+	}
+}
+
+func skipBWS(b []byte, i int) int {
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// tokenLen returns the length of the token at the start of b, 0 when there is none
+func tokenLen(b []byte) int {
+	n := 0
+	for n < len(b) && isToken(b[n:n+1]) {
+		n++
+	}
+	return n
+}
+
+// quotedStringLen returns the length of the quoted-string at the start of b, 0 when it's malformed
+// or unterminated (RFC 9110 section 5.6.4): control characters, a bare CR or LF are never allowed
+func quotedStringLen(b []byte) int {
+	for i := 1; i < len(b); i++ {
+		switch c := b[i]; {
+		case c == '"':
+			return i + 1
+		case c == '\\':
+			// quoted-pair = "\" ( HTAB / SP / VCHAR / obs-text )
+			i++
+			if i == len(b) || (b[i] != '\t' && (b[i] < ' ' || b[i] == 0x7f)) {
+				return 0
+			}
+		case c != '\t' && (c < ' ' || c == 0x7f):
+			// qdtext = HTAB / SP / %x21 / %x23-5B / %x5D-7E / obs-text
+			return 0
+		}
+	}
+	return 0
+}
+
+func isToken(b []byte) bool {
+	ok, _ := headers.IsToken(b)
+	return ok
+}
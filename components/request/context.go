@@ -0,0 +1,66 @@
+package request
+
+import "context"
+
+type contextKey string
+
+const (
+	requestIDKey contextKey = "request-id"
+	userKey      contextKey = "user"
+)
+
+// Context returns the context of the request. The server cancels it when the client closes the
+// connection (or resets the HTTP/2 stream), when the server shuts down or when the request timeout
+// expires, context.Cause tells which one. It is context.Background() for a request built by hand.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// SetContext replaces the context of the request, ctx should derive from Context()
+// (e.g. a middleware adding a deadline or a value)
+func (r *Request) SetContext(ctx context.Context) {
+	if ctx == nil {
+		panic("request: nil context")
+	}
+	r.ctx = ctx
+}
+
+// SetValue attaches a request-scoped value to the context of the request
+func (r *Request) SetValue(key, value any) {
+	r.ctx = context.WithValue(r.Context(), key, value)
+}
+
+// Value returns the value attached to key by SetValue (or by a parent context), nil when there is none
+func (r *Request) Value(key any) any {
+	return r.Context().Value(key)
+}
+
+// SetID sets the request ID, e.g. taken from X-Request-Id or generated by a middleware
+func (r *Request) SetID(id string) {
+	r.SetValue(requestIDKey, id)
+}
+
+// ID returns the request ID, empty when none is set
+func (r *Request) ID() string {
+	return IDFromContext(r.Context())
+}
+
+// SetUser records the authenticated user, e.g. by an authentication middleware
+func (r *Request) SetUser(user any) {
+	r.SetValue(userKey, user)
+}
+
+// User returns the authenticated user, nil when the request is anonymous
+func (r *Request) User() any {
+	return r.Value(userKey)
+}
+
+// IDFromContext returns the request ID carried by ctx (e.g. the context of a request passed to
+// a database call or to an outgoing request)
+func IDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
@@ -0,0 +1,54 @@
+package request
+
+import (
+	"fmt"
+	"http/components/headers"
+	"strings"
+)
+
+// framing decides how the body is delimited once the header section is parsed (RFC 9112 section 6.3).
+// Ambiguous messages are the base of request smuggling (CL.TE, TE.CL, CL.CL desync):
+// the ones that can't be interpreted safely are always rejected, the others only in strict mode.
+func (r *Request) framing() error {
+	hasTE := r.Headers.Has(headers.TRANSFER_ENCODING)
+	hasCL := r.Headers.Has(headers.CONTENT_LENGTH)
+
+	length, err := r.Headers.GetContentLength()
+	if err != nil {
+		return err
+	}
+
+	if r.strict {
+		if len(r.Headers.Values("Host")) != 1 || strings.Contains(r.Headers.Get("Host"), ",") {
+			if r.RequestLine.HttpVersion == "1.1" || r.Headers.Has("Host") {
+				return fmt.Errorf("exactly one Host header is required")
+			}
+		}
+		if strings.Contains(r.Headers.Get(headers.CONTENT_LENGTH), ",") {
+			return fmt.Errorf("duplicated Content-Length: %q", r.Headers.Get(headers.CONTENT_LENGTH))
+		}
+		if hasTE && hasCL {
+			return fmt.Errorf("both Transfer-Encoding and Content-Length are present")
+		}
+		if hasTE && r.RequestLine.HttpVersion == "1.0" {
+			return fmt.Errorf("Transfer-Encoding is not allowed in HTTP/1.0")
+		}
+	}
+
+	if hasTE {
+		if !r.IsChunked() {
+			return fmt.Errorf("unsupported transfer-coding: %s", r.Headers.Get(headers.TRANSFER_ENCODING))
+		}
+		if hasCL {
+			// Transfer-Encoding overrides Content-Length, the connection is not reused
+			// since an intermediary might have framed the message with Content-Length
+			r.Headers.Del(headers.CONTENT_LENGTH)
+			r.close = true
+		}
+		r.chunked = true
+		return nil
+	}
+
+	r.contentLength = int64(length)
+	return nil
+}
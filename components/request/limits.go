@@ -0,0 +1,39 @@
+package request
+
+import (
+	"errors"
+)
+
+var (
+	ErrRequestLineTooLong = errors.New("request line too long")
+	ErrHeadersTooLarge    = errors.New("request header fields too large")
+	ErrBodyTooLarge       = errors.New("request body too large")
+)
+
+// Limits bounds the size of a request, a zero field disables the limit
+type Limits struct {
+	// MaxRequestLine is the maximum length of the request line, without CRLF
+	MaxRequestLine int
+	// MaxHeaderBytes is the maximum size of the header section (and of the trailer section)
+	MaxHeaderBytes int
+	// MaxHeaderCount is the maximum number of distinct header fields
+	MaxHeaderCount int
+	// MaxBodyBytes is the maximum size of the body (decoded size for chunked bodies)
+	MaxBodyBytes int64
+}
+
+// DefaultLimits bounds request line and headers, the body is unlimited since it's streamed to the handler
+var DefaultLimits = Limits{
+	MaxRequestLine: 8 << 10,
+	MaxHeaderBytes: 64 << 10,
+	MaxHeaderCount: 100,
+}
+
+// maxBuffer is the capacity the sliding window can grow to:
+// it must hold the longest line allowed, a zero value means unbounded
+func (l Limits) maxBuffer() int {
+	if l.MaxRequestLine == 0 || l.MaxHeaderBytes == 0 {
+		return 0
+	}
+	return max(l.MaxRequestLine, l.MaxHeaderBytes) + BUFFER_CAPACITY
+}
@@ -2,6 +2,9 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"http/components/headers"
 	"io"
@@ -33,35 +36,103 @@ type RequestLine struct {
 }
 
 type Request struct {
-	Body        []byte
-	Headers     *headers.Headers
+	// Body is read lazily from the connection; it is NoBody when the request has no content
+	Body    io.ReadCloser
+	Headers *headers.Headers
+	// Trailers of a chunked body, they are available once Body has been read until io.EOF
+	Trailers    *headers.Headers
 	state       RequestState
 	RequestLine *RequestLine
-	bodyRead    int
-	isEof       bool
+	// URL is the parsed RequestLine.RequestTarget
+	URL *URL
+	// TLS is the state of the connection negotiated by an HTTPS server, nil for plain HTTP
+	TLS *tls.ConnectionState
+	// RemoteAddr is the address of the client ("ip:port"), set by the server
+	RemoteAddr string
+	pathValues map[string]string
+	// ctx is cancelled by the server when the request is over (see Context)
+	ctx    context.Context
+	limits Limits
+	strict bool
+	// bytes of the header section parsed so far
+	headerBytes int
+	// body framing decided by the header section
+	chunked       bool
+	contentLength int64
+	// the connection can't be reused after this request
+	close bool
 }
 
 func NewRequest() *Request {
-	return &Request{state: RequestInit, Headers: headers.NewHeaders()}
+	return &Request{state: RequestInit, Headers: headers.NewHeaders(), Trailers: headers.NewHeaders(), Body: NoBody}
+}
+
+// NewFramedRequest builds a request whose message has been framed by another protocol (e.g. an HTTP/2 stream):
+// the header section is already decoded and body is read until io.EOF. length is the size declared
+// by Content-Length, -1 when it's unknown.
+func NewFramedRequest(line *RequestLine, h *headers.Headers, body io.ReadCloser, length int64) (*Request, error) {
+	u, err := ParseTarget(line.Method, line.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRequest()
+	r.RequestLine, r.URL, r.Headers, r.Body = line, u, h, body
+	r.contentLength = length
+	r.state = RequestBody
+	if body == NoBody {
+		r.state = RequestDone
+	}
+	return r, nil
+}
+
+// PathValue returns the value of a named path parameter set by a router (e.g. {id} in /users/{id})
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+// LookupPathValue is like PathValue but it also reports whether the parameter is set
+func (r *Request) LookupPathValue(name string) (string, bool) {
+	v, ok := r.pathValues[name]
+	return v, ok
+}
+
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = map[string]string{}
+	}
+	r.pathValues[name] = value
+}
+
+// IsChunked reports whether the body uses the chunked transfer-coding.
+// chunked must be the only coding, other codings are not supported
+func (r *Request) IsChunked() bool {
+	return strings.EqualFold(strings.TrimSpace(r.Headers.Get(headers.TRANSFER_ENCODING)), "chunked")
+}
+
+// ContentLength is the size of the body declared by Content-Length, -1 for a chunked body or when it's unknown
+func (r *Request) ContentLength() int64 {
+	if r.chunked {
+		return -1
+	}
+	return r.contentLength
 }
 
 func (r *Request) parse(line []byte) (int, error) {
 	var (
-		curretLine               []byte
-		err                      error
-		rd, read, curretLineSize int
-		done                     bool
+		curretLine []byte
+		err        error
+		rd, read   int
+		done       bool
 	)
 
 outer:
 	for {
 		curretLine = line[read:]
-		curretLineSize = len(curretLine)
 		switch r.state {
 		case RequestError:
 			return 0, fmt.Errorf("general error during parsing request")
 		case RequestInit:
-			r.RequestLine, rd, err = readRequestLine(curretLine)
+			r.RequestLine, rd, err = readRequestLine(curretLine, r.strict)
 			if err != nil {
 				r.state = RequestError
 				break outer
@@ -69,6 +140,19 @@ outer:
 
 			// when rd == 0, there isn't enough data in the buffer to build the requestLine
 			if rd == 0 {
+				if r.limits.MaxRequestLine > 0 && len(curretLine) > r.limits.MaxRequestLine {
+					err = fmt.Errorf("%w: more than %d bytes", ErrRequestLineTooLong, r.limits.MaxRequestLine)
+					r.state = RequestError
+				}
+				break outer
+			}
+			if r.limits.MaxRequestLine > 0 && rd-2 > r.limits.MaxRequestLine {
+				err = fmt.Errorf("%w: %d bytes", ErrRequestLineTooLong, rd-2)
+				r.state = RequestError
+				break outer
+			}
+			if r.URL, err = ParseTarget(r.RequestLine.Method, r.RequestLine.RequestTarget); err != nil {
+				r.state = RequestError
 				break outer
 			}
 
@@ -81,12 +165,39 @@ outer:
 				break outer
 			}
 
+			// unparsed bytes belong to a header line that is not complete yet
+			r.headerBytes += rd
+			pending := 0
+			if !done {
+				pending = len(curretLine) - rd
+			}
+			if r.limits.MaxHeaderBytes > 0 && r.headerBytes+pending > r.limits.MaxHeaderBytes {
+				err = fmt.Errorf("%w: more than %d bytes", ErrHeadersTooLarge, r.limits.MaxHeaderBytes)
+				r.state = RequestError
+				break outer
+			}
+			if r.limits.MaxHeaderCount > 0 && r.Headers.Len() > r.limits.MaxHeaderCount {
+				err = fmt.Errorf("%w: more than %d fields", ErrHeadersTooLarge, r.limits.MaxHeaderCount)
+				r.state = RequestError
+				break outer
+			}
+
 			// If parsing reaches the last field-line, we can assume there are no other field-lines
 			// e.g.: accept: */*\r\n\r\n -> The double CRLF (\r\n\r\n) is the proper delimiter
 			// between HTTP headers and message body according to RFC 7230
 			if done {
-				if r.Headers.GetContentLength() == 0 {
+				if err = r.framing(); err != nil {
+					r.state = RequestError
+					break outer
+				}
+				if r.chunked {
+					r.state = RequestBody
+				} else if r.contentLength == 0 {
 					r.state = RequestDone
+				} else if r.limits.MaxBodyBytes > 0 && r.contentLength > r.limits.MaxBodyBytes {
+					err = fmt.Errorf("%w: %d bytes, limit %d", ErrBodyTooLarge, r.contentLength, r.limits.MaxBodyBytes)
+					r.state = RequestError
+					break outer
 				} else {
 					r.state = RequestBody
 				}
@@ -96,25 +207,8 @@ outer:
 			}
 			read += rd
 		case RequestBody:
-			length := r.Headers.GetContentLength()
-
-			if r.Body == nil {
-				r.Body = make([]byte, length)
-			}
-			copy(r.Body[r.bodyRead:], curretLine)
-
-			r.bodyRead += curretLineSize
-			read += curretLineSize
-
-			if r.bodyRead > length || (r.isEof && r.bodyRead < length) {
-				err = fmt.Errorf("body cannot be shorter or greater then Content-length.\n - content-length: %v\n - bodyRead: %v", length, r.bodyRead)
-				r.state = RequestError
-				break outer
-			} else if r.bodyRead == length || r.isEof {
-				r.state = RequestDone
-			} else if read >= curretLineSize {
-				break outer
-			}
+			// the body is not buffered here, it's streamed to the handler by Request.Body
+			break outer
 		case RequestDone:
 			fmt.Println("All data are consumed correctly")
 			break outer
@@ -126,55 +220,292 @@ outer:
 	return read, err
 }
 
+// Reader reads consecutive requests from the same stream (e.g. a keep-alive connection).
+// Bytes received after the end of a request are kept in the buffer for the next one.
+type Reader struct {
+	// Limits applied to every request read, DefaultLimits unless changed
+	Limits Limits
+	// Strict rejects every ambiguous message instead of interpreting it safely
+	Strict  bool
+	reader  io.Reader
+	buffer  []byte
+	startId int
+	// body of the last request, it must be consumed before the next request line
+	body io.ReadCloser
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{Limits: DefaultLimits, reader: reader, buffer: make([]byte, BUFFER_CAPACITY)}
+}
+
 // Read data input with dynamic buffer
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).ReadRequest()
+}
+
+// ReadRequest parses the next request from the stream.
+// It returns io.EOF when the stream ends cleanly before a new request starts.
+func (rd *Reader) ReadRequest() (*Request, error) {
+
+	if err := rd.discardBody(); err != nil {
+		return nil, err
+	}
 
 	request := NewRequest()
-	buffer := make([]byte, BUFFER_CAPACITY)
+	request.limits = rd.Limits
+	request.strict = rd.Strict
 
 	var (
-		err, pErr        error
-		n, read, startId int
+		err, pErr error
+		n, read   int
 	)
 
-outer:
-	for request.state != RequestDone {
-
-		n, err = reader.Read(buffer[startId:])
-		if err != nil {
-			request.isEof = true
+	// data left over from the previous request is parsed before reading again
+	if rd.startId > 0 {
+		if read, pErr = rd.consume(request); pErr != nil {
+			return request, pErr
 		}
+	}
 
-		startId += n
+	for request.state != RequestDone && request.state != RequestBody {
+
+		if pErr = rd.grow(); pErr != nil {
+			break
+		}
+		n, err = rd.reader.Read(rd.buffer[rd.startId:])
+		rd.startId += n
 
 		// read is number of processed byte
 		// 	- read <= startId
-		read, pErr = request.parse(buffer[:startId])
+		read, pErr = rd.consume(request)
 		if pErr != nil {
-			break outer
+			break
 		}
 
-		// moves unprocessed data to the left, freeing up the buffer for new data
-		if read > 0 {
-			copy(buffer, buffer[read:startId])
-			startId -= read
+		if err != nil && request.state != RequestDone && request.state != RequestBody {
+			if request.state == RequestInit && rd.startId == 0 && read == 0 {
+				// the client closed the connection between two requests
+				pErr = err
+			} else {
+				pErr = fmt.Errorf("incomplete request: %w", err)
+			}
+			break
 		}
+	}
 
+	if pErr == nil && request.state == RequestBody {
+		request.Body = rd.newBody(request.contentLength, request.chunked, request.Trailers, func(err error) {
+			if err != nil {
+				request.state = RequestError
+			} else {
+				request.state = RequestDone
+			}
+		})
 	}
 
 	return request, pErr
 }
 
-func readRequestLine(l []byte) (*RequestLine, int, error) {
+// Buffered returns the bytes received and not parsed yet (e.g. after an upgrade request),
+// the Reader must not be used afterwards
+func (rd *Reader) Buffered() []byte {
+	buffered := bytes.Clone(rd.buffer[:rd.startId])
+	rd.startId = 0
+	return buffered
+}
+
+// ReadLine returns the next line without the CRLF delimiter (e.g. the status line of a response),
+// the unread part of the previous body is discarded first
+func (rd *Reader) ReadLine() ([]byte, error) {
+	if err := rd.discardBody(); err != nil {
+		return nil, err
+	}
+	return rd.readLine()
+}
+
+// ReadHeaders parses a header section (or a trailer-section) into h up to the empty line,
+// MaxHeaderBytes and MaxHeaderCount of the Limits apply
+func (rd *Reader) ReadHeaders(h *headers.Headers) error {
+	headerBytes := 0
+	for {
+		read, done, err := h.ParseAll(rd.buffer[:rd.startId])
+		if err != nil {
+			return err
+		}
+		copy(rd.buffer, rd.buffer[read:rd.startId])
+		rd.startId -= read
+		headerBytes += read
+		if max := rd.Limits.MaxHeaderCount; max > 0 && h.Len() > max {
+			return fmt.Errorf("%w: more than %d fields", ErrHeadersTooLarge, max)
+		}
+		if done {
+			return nil
+		}
+		if max := rd.Limits.MaxHeaderBytes; max > 0 && headerBytes+rd.startId > max {
+			return fmt.Errorf("%w: more than %d bytes", ErrHeadersTooLarge, max)
+		}
+		if err := rd.fill(); err != nil {
+			return err
+		}
+	}
+}
+
+// NewBody returns the body that follows the headers just read: chunked (its trailers are added to trailers),
+// Content-Length delimited or, with a negative length, delimited by the end of the stream.
+// The next ReadLine or ReadRequest discards what is left of it.
+func (rd *Reader) NewBody(length int64, chunked bool, trailers *headers.Headers) io.ReadCloser {
+	return rd.newBody(length, chunked, trailers, func(error) {})
+}
+
+func (rd *Reader) newBody(length int64, chunked bool, trailers *headers.Headers, done func(error)) io.ReadCloser {
+	switch {
+	case chunked:
+		rd.body = newChunkedBody(rd, trailers, done)
+	case length < 0:
+		rd.body = &closeDelimitedBody{rd: rd, done: done}
+	case length == 0:
+		done(nil)
+		rd.body = nil
+		return NoBody
+	default:
+		rd.body = newBody(rd, length, done)
+	}
+	return rd.body
+}
+
+// grow doubles the buffer when it's full, up to the size allowed by the limits
+func (rd *Reader) grow() error {
+	if rd.startId < len(rd.buffer) {
+		return nil
+	}
+	size := len(rd.buffer) * 2
+	if maxBuffer := rd.Limits.maxBuffer(); maxBuffer > 0 {
+		if len(rd.buffer) >= maxBuffer {
+			return fmt.Errorf("%w: line exceeds the buffer capacity (%d bytes)", ErrHeadersTooLarge, len(rd.buffer))
+		}
+		size = min(size, maxBuffer)
+	}
+	buffer := make([]byte, size)
+	copy(buffer, rd.buffer[:rd.startId])
+	rd.buffer = buffer
+	return nil
+}
+
+// fill reads more data from the stream into the free part of the buffer
+func (rd *Reader) fill() error {
+	if err := rd.grow(); err != nil {
+		return err
+	}
+	n, err := rd.reader.Read(rd.buffer[rd.startId:])
+	rd.startId += n
+	if n > 0 {
+		return nil
+	}
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readLine returns the next line without the CRLF delimiter
+func (rd *Reader) readLine() ([]byte, error) {
+	for {
+		if i := bytes.Index(rd.buffer[:rd.startId], []byte{CR_DELIMETER, LN_DELIMETER}); i != -1 {
+			line := bytes.Clone(rd.buffer[:i])
+			copy(rd.buffer, rd.buffer[i+2:rd.startId])
+			rd.startId -= i + 2
+			return line, nil
+		}
+		if err := rd.fill(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readData reads body bytes: first the ones already in the sliding window, then directly from the stream
+func (rd *Reader) readData(p []byte) (int, error) {
+	if rd.startId > 0 {
+		n := copy(p, rd.buffer[:rd.startId])
+		copy(rd.buffer, rd.buffer[n:rd.startId])
+		rd.startId -= n
+		return n, nil
+	}
+	return rd.reader.Read(p)
+}
+
+// WaitRequest blocks until the first bytes of the next request are available,
+// it lets the caller tell an idle connection apart from a slow request
+func (rd *Reader) WaitRequest() error {
+	if err := rd.discardBody(); err != nil {
+		return err
+	}
+	for rd.startId == 0 {
+		n, err := rd.reader.Read(rd.buffer)
+		rd.startId += n
+		if n == 0 && err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discardBody consumes the unread part of the previous body
+func (rd *Reader) discardBody() error {
+	if rd.body == nil {
+		return nil
+	}
+	err := rd.body.Close()
+	rd.body = nil
+	return err
+}
+
+func (rd *Reader) consume(request *Request) (int, error) {
+	read, err := request.parse(rd.buffer[:rd.startId])
+
+	// moves unprocessed data to the left, freeing up the buffer for new data
+	if read > 0 {
+		copy(rd.buffer, rd.buffer[read:rd.startId])
+		rd.startId -= read
+	}
+	return read, err
+}
+
+// KeepAlive reports whether the connection can be reused after this request,
+// following the HTTP/1.1 (persistent by default) and HTTP/1.0 (close by default) rules.
+func (r *Request) KeepAlive() bool {
+	if r.RequestLine == nil || r.close {
+		return false
+	}
+	if r.Headers.HasToken(headers.CONNECTION, "close") {
+		return false
+	}
+	if r.RequestLine.HttpVersion == "1.0" {
+		return r.Headers.HasToken(headers.CONNECTION, "keep-alive")
+	}
+	return true
+}
+
+func readRequestLine(l []byte, strict bool) (*RequestLine, int, error) {
 	read := bytes.Index(l, []byte{CR_DELIMETER, LN_DELIMETER})
 	if read == -1 {
 		return nil, 0, nil
 	}
 
+	// a bare CR or LF would end the line for a parser and not for another one
+	if i := bytes.IndexAny(l[:read], "\r\n"); i != -1 {
+		return nil, 0, fmt.Errorf("bare CR or LF in request line")
+	}
+
 	splt := bytes.Split(l[:read], []byte{' '})
-	if len(splt) < 3 {
+	if len(splt) < 3 || (strict && len(splt) != 3) {
 		return nil, 0, fmt.Errorf("invalid number of parts in request line. current: %v Requested: (Method  target  http version)", splt)
 	}
+	if ok, c := headers.IsToken(splt[0]); !ok || len(splt[0]) == 0 {
+		return nil, 0, fmt.Errorf("invalid character in method: %q", c)
+	}
+	if strict && !isHttpVersion(splt[2]) {
+		return nil, 0, fmt.Errorf("invalid HTTP version: %s", splt[2])
+	}
 	requestLine := &RequestLine{}
 	requestLine.Method = string(splt[0])
 	requestLine.RequestTarget = string(splt[1])
@@ -182,6 +513,12 @@ func readRequestLine(l []byte) (*RequestLine, int, error) {
 	return requestLine, read + 2, nil
 }
 
+// HTTP-version = "HTTP/" DIGIT "." DIGIT
+func isHttpVersion(v []byte) bool {
+	return len(v) == 8 && bytes.HasPrefix(v, []byte("HTTP/")) &&
+		'0' <= v[5] && v[5] <= '9' && v[6] == '.' && '0' <= v[7] && v[7] <= '9'
+}
+
 func (r *Request) PrintRequest() {
 	fmt.Println("Request Line:")
 	fmt.Printf("- Method: %s\n", r.RequestLine.Method)
@@ -191,5 +528,4 @@ func (r *Request) PrintRequest() {
 	r.Headers.ForEach(func(k, v string) {
 		fmt.Printf("- %s: %s\n", k, v)
 	})
-	fmt.Printf("Body:\n%s\n", string(r.Body))
 }
@@ -1,6 +1,7 @@
 package request
 
 import (
+	"context"
 	"io"
 	"strings"
 	"testing"
@@ -82,7 +83,9 @@ func TestParseBody(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "hello world!\n", string(r.Body))
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
 
 	// Test: Body shorter than reported content length
 	reader = &chunkReader{
@@ -94,6 +97,233 @@ func TestParseBody(t *testing.T) {
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
 	require.Error(t, err)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: No body
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, NoBody, r.Body)
+}
+
+func TestBodyStreaming(t *testing.T) {
+	// Test: body is pulled from the reader only when the handler reads it
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 26\r\n" +
+			"\r\n" +
+			"ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+		numBytesPerRead: 5,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Less(t, reader.pos, len(reader.data))
+
+	p := make([]byte, 4)
+	n, err := io.ReadFull(r.Body, p)
+	require.NoError(t, err)
+	assert.Equal(t, "ABCD", string(p[:n]))
+
+	rest, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "EFGHIJKLMNOPQRSTUVWXYZ", string(rest))
+
+	// Test: unread body is drained before the next request
+	rd := NewReader(strings.NewReader("POST /a HTTP/1.1\r\nContent-Length: 3\r\n\r\nabcGET /b HTTP/1.1\r\n\r\n"))
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+
+	// Test: read after close
+	r, err = RequestFromReader(strings.NewReader("POST /a HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc"))
+	require.NoError(t, err)
+	require.NoError(t, r.Body.Close())
+	_, err = r.Body.Read(p)
+	assert.ErrorIs(t, err, ErrBodyClosed)
+}
+
+func TestReaderPipelined(t *testing.T) {
+	reader := NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /next HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Connection: close\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	})
+
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/submit", r.RequestLine.RequestTarget)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.True(t, r.KeepAlive())
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+	assert.False(t, r.KeepAlive())
+
+	// Test: stream closed between two requests
+	_, err = reader.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestKeepAlive(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nConnection: upgrade, close\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+}
+
+func TestParseChunkedBody(t *testing.T) {
+	// Test: chunks, extensions and trailers
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"7;name=value;flag\r\n, world\r\n" +
+			"1A\r\nABCDEFGHIJKLMNOPQRSTUVWXYZ\r\n" +
+			"0\r\n" +
+			"X-Checksum: abcde12345\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.True(t, r.IsChunked())
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, worldABCDEFGHIJKLMNOPQRSTUVWXYZ", string(body))
+	assert.Equal(t, "abcde12345", r.Trailers.Get("X-Checksum"))
+
+	// Test: chunked body followed by another request
+	rd := NewReader(strings.NewReader("POST /a HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\nGET /b HTTP/1.1\r\n\r\n"))
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+
+	// Test: invalid chunk size
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nabc\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.Error(t, err)
+
+	// Test: quoted chunk extension values
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3 ; a = \"x;y=\\\"z\\\"\" ; b=1\r\nabc\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(body))
+	for _, ext := range []string{`a="x`, `a="x"y`, `a="x` + "\x01" + `y"`, `a="x\`, `a=`, `=x`, `a b`} {
+		r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3;" + ext + "\r\nabc\r\n0\r\n\r\n"))
+		require.NoError(t, err)
+		_, err = io.ReadAll(r.Body)
+		assert.Error(t, err, ext)
+	}
+
+	// Test: chunk data longer than its size
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nabc\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.Error(t, err)
+
+	// Test: connection closed in the middle of a chunk
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\na\r\nabc"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: unsupported transfer-coding
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n"))
+	require.Error(t, err)
+}
+
+func TestLimits(t *testing.T) {
+	limits := Limits{MaxRequestLine: 32, MaxHeaderBytes: 64, MaxHeaderCount: 3, MaxBodyBytes: 10}
+	read := func(data string) (*Request, error) {
+		rd := NewReader(&chunkReader{data: data, numBytesPerRead: 7})
+		rd.Limits = limits
+		return rd.ReadRequest()
+	}
+
+	// Test: request line too long, even without CRLF
+	_, err := read("GET /" + strings.Repeat("a", 64) + " HTTP/1.1\r\n\r\n")
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+	_, err = read("GET /" + strings.Repeat("a", 1<<12))
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: header section too large
+	_, err = read("GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", 64) + "\r\n\r\n")
+	assert.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: too many header fields
+	_, err = read("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n")
+	assert.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: Content-Length bigger than the limit is rejected before reading the body
+	_, err = read("POST / HTTP/1.1\r\nContent-Length: 9999999999\r\n\r\n")
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: chunked body bigger than the limit
+	r, err := read("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n8\r\n12345678\r\n8\r\n12345678\r\n0\r\n\r\n")
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: within the limits
+	r, err = read("POST /ok HTTP/1.1\r\nContent-Length: 10\r\n\r\n0123456789")
+	require.NoError(t, err)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(body))
+
+	// Test: the buffer grows beyond its initial capacity for long lines
+	r, err = RequestFromReader(strings.NewReader("GET /" + strings.Repeat("a", 3*BUFFER_CAPACITY) + " HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Len(t, r.RequestLine.RequestTarget, 3*BUFFER_CAPACITY+1)
+}
+
+func TestRequestContext(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, context.Background(), r.Context())
+	assert.Empty(t, r.ID())
+	assert.Nil(t, r.User())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.SetContext(ctx)
+	r.SetID("req-1")
+	r.SetUser("alice")
+	r.SetValue("tenant", "acme")
+
+	assert.Equal(t, "req-1", r.ID())
+	assert.Equal(t, "alice", r.User())
+	assert.Equal(t, "acme", r.Value("tenant"))
+	assert.Equal(t, "req-1", IDFromContext(r.Context()))
 
+	// values keep the cancellation of the parent
+	cancel()
+	assert.ErrorIs(t, r.Context().Err(), context.Canceled)
 }
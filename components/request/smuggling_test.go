@@ -0,0 +1,236 @@
+package request
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Known request smuggling payloads (CL.CL, CL.TE, TE.CL, TE.TE obfuscations, header injection).
+// Strict mode rejects all of them, the default mode accepts the ones marked as accepted
+// (interpreting them safely) and lenient is the body it's expected to read.
+var smugglingCorpus = []struct {
+	name     string
+	request  string
+	accepted bool
+	lenient  string
+}{
+	{
+		name:    "conflicting Content-Length fields",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 5\r\n\r\nabcde",
+	},
+	{
+		name:    "conflicting Content-Length list",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3, 5\r\n\r\nabcde",
+	},
+	{
+		name:     "duplicated Content-Length with the same value",
+		request:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc",
+		accepted: true,
+		lenient:  "abc",
+	},
+	{
+		name:     "Content-Length and Transfer-Encoding (CL.TE)",
+		request:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG",
+		accepted: true,
+		lenient:  "",
+	},
+	{
+		name:     "Transfer-Encoding and Content-Length (TE.CL)",
+		request:  "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+		accepted: true,
+		lenient:  "abc",
+	},
+	{
+		name:    "non-numeric Content-Length",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: abc\r\n\r\n",
+	},
+	{
+		name:    "signed Content-Length",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +3\r\n\r\nabc",
+	},
+	{
+		name:    "negative Content-Length",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1\r\n\r\n",
+	},
+	{
+		name:    "hex Content-Length",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0x3\r\n\r\nabc",
+	},
+	{
+		name:    "Content-Length with inner space",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1 3\r\n\r\nabc",
+	},
+	{
+		name:    "empty Content-Length",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length:\r\n\r\nabc",
+	},
+	{
+		name:    "Content-Length and an empty Content-Length",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length:\r\n\r\nabcde",
+	},
+	{
+		name:    "empty Transfer-Encoding",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding:\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+	},
+	{
+		name:    "space before colon",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n",
+	},
+	{
+		name:    "tab before colon",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding\t: chunked\r\n\r\n0\r\n\r\n",
+	},
+	{
+		name:    "obs-fold of Transfer-Encoding",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding:\r\n chunked\r\n\r\n0\r\n\r\n",
+	},
+	{
+		name:    "obs-fold on the first field",
+		request: "POST / HTTP/1.1\r\n Host: a\r\n\r\n",
+	},
+	{
+		name:    "bare LF in header section",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nX: y\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+	},
+	{
+		name:    "bare CR in header section",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nX: y\rTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+	},
+	{
+		name:    "bare LF in request line",
+		request: "GET / HTTP/1.1\nHost: a\r\n\r\n",
+	},
+	{
+		name:    "NUL in field value",
+		request: "GET / HTTP/1.1\r\nHost: a\x00b\r\n\r\n",
+	},
+	{
+		name:    "obfuscated Transfer-Encoding value",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n",
+	},
+	{
+		name:    "chunked not alone",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, identity\r\n\r\n0\r\n\r\n",
+	},
+	{
+		name:    "repeated Transfer-Encoding",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: x\r\n\r\n0\r\n\r\n",
+	},
+	{
+		name:     "Transfer-Encoding in HTTP/1.0",
+		request:  "POST / HTTP/1.0\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+		accepted: true,
+		lenient:  "abc",
+	},
+	{
+		name:     "missing Host in HTTP/1.1",
+		request:  "GET / HTTP/1.1\r\n\r\n",
+		accepted: true,
+		lenient:  "",
+	},
+	{
+		name:     "duplicated Host",
+		request:  "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n",
+		accepted: true,
+		lenient:  "",
+	},
+	{
+		name:     "extra part in request line",
+		request:  "GET / HTTP/1.1 x\r\nHost: a\r\n\r\n",
+		accepted: true,
+		lenient:  "",
+	},
+	{
+		name:     "malformed HTTP version",
+		request:  "GET / HTTP/1.1.1\r\nHost: a\r\n\r\n",
+		accepted: true,
+		lenient:  "",
+	},
+	{
+		name:    "signed chunk size",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n+3\r\nabc\r\n0\r\n\r\n",
+	},
+	{
+		name:    "hex prefix in chunk size",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0x3\r\nabc\r\n0\r\n\r\n",
+	},
+	{
+		name:    "bare LF in quoted chunk extension",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3;a=\"x\ny\"\r\nabc\r\n0\r\n\r\n",
+	},
+	{
+		name:    "bare CR in quoted chunk extension",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3;a=\"x\ry\"\r\nabc\r\n0\r\n\r\n",
+	},
+	{
+		name:    "control character in quoted chunk extension",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3;a=\"x\x00y\"\r\nabc\r\n0\r\n\r\n",
+	},
+	{
+		name:    "unterminated quoted chunk extension",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3;a=\"unterminated\r\nabc\r\n0\r\n\r\n",
+	},
+	{
+		name:    "overflowing chunk size",
+		request: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n10000000000000003\r\nabc\r\n0\r\n\r\n",
+	},
+}
+
+// readAll parses the request and its body
+func readAll(data string, strict bool) (*Request, string, error) {
+	rd := NewReader(strings.NewReader(data))
+	rd.Strict = strict
+	r, err := rd.ReadRequest()
+	if err != nil {
+		return r, "", err
+	}
+	body, err := io.ReadAll(r.Body)
+	return r, string(body), err
+}
+
+func TestSmugglingStrict(t *testing.T) {
+	for _, tt := range smugglingCorpus {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readAll(tt.request, true)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSmugglingLenient(t *testing.T) {
+	for _, tt := range smugglingCorpus {
+		t.Run(tt.name, func(t *testing.T) {
+			_, body, err := readAll(tt.request, false)
+			if !tt.accepted {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.lenient, body)
+		})
+	}
+
+	// Test: Transfer-Encoding wins over Content-Length and the connection is not reused
+	r, _, err := readAll("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG", false)
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+	assert.False(t, r.Headers.Has("Content-Length"))
+}
+
+func TestStrictValidRequests(t *testing.T) {
+	// Test: well-formed requests are accepted in strict mode
+	_, body, err := readAll("POST / HTTP/1.1\r\nHost: a\r\nContent-Length:  3 \r\n\r\nabc", true)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", body)
+
+	_, body, err = readAll("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding:\tchunked\r\n\r\n3;ext=1\r\nabc\r\n0\r\n\r\n", true)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", body)
+
+	_, _, err = readAll("GET / HTTP/1.0\r\n\r\n", true)
+	require.NoError(t, err)
+}
@@ -0,0 +1,225 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TargetForm is the form of the request-target (RFC 9112 section 3.2)
+type TargetForm string
+
+const (
+	// /where?q=now
+	OriginForm TargetForm = "origin"
+	// http://www.example.org/pub/WWW/TheProject.html (requests to a proxy)
+	AbsoluteForm TargetForm = "absolute"
+	// www.example.com:80 (only CONNECT)
+	AuthorityForm TargetForm = "authority"
+	// * (only server-wide OPTIONS)
+	AsteriskForm TargetForm = "asterisk"
+)
+
+// URL is the parsed request-target
+type URL struct {
+	Form TargetForm
+	// Scheme is set only for the absolute-form
+	Scheme string
+	// Host (host[:port]) is set for the absolute and authority forms
+	Host string
+	// Path is percent-decoded, RawPath is the path as sent by the client
+	Path     string
+	RawPath  string
+	RawQuery string
+	Query    Values
+}
+
+// Values maps a query parameter to its values, in the order they appear
+type Values map[string][]string
+
+// Get returns the first value of the parameter
+func (v Values) Get(k string) string {
+	if vs := v[k]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+func (v Values) Has(k string) bool {
+	_, ok := v[k]
+	return ok
+}
+
+// ParseTarget parses the request-target of the request line, the method decides
+// whether the authority-form (CONNECT) and the asterisk-form (OPTIONS) are allowed
+func ParseTarget(method string, target string) (*URL, error) {
+	if target == "" {
+		return nil, fmt.Errorf("empty request target")
+	}
+	for i := 0; i < len(target); i++ {
+		if c := target[i]; c <= ' ' || c == 0x7f {
+			return nil, fmt.Errorf("invalid character in request target: %q", c)
+		}
+	}
+	if strings.Contains(target, "#") {
+		return nil, fmt.Errorf("request target cannot contain a fragment: %s", target)
+	}
+
+	switch {
+	case method == "CONNECT":
+		if err := validateAuthority(target); err != nil {
+			return nil, err
+		}
+		return &URL{Form: AuthorityForm, Host: target, Query: Values{}}, nil
+	case target == "*":
+		if method != "OPTIONS" {
+			return nil, fmt.Errorf("asterisk-form is allowed only for OPTIONS")
+		}
+		return &URL{Form: AsteriskForm, Path: "*", RawPath: "*", Query: Values{}}, nil
+	case strings.HasPrefix(target, "/"):
+		u := &URL{Form: OriginForm}
+		return u, u.parsePathQuery(target)
+	}
+
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok || !isScheme(scheme) {
+		return nil, fmt.Errorf("invalid request target: %s", target)
+	}
+	u := &URL{Form: AbsoluteForm, Scheme: strings.ToLower(scheme)}
+	end := strings.IndexAny(rest, "/?")
+	if end == -1 {
+		end = len(rest)
+	}
+	u.Host = rest[:end]
+	if u.Host == "" || strings.Contains(u.Host, "@") {
+		return nil, fmt.Errorf("invalid authority in request target: %s", target)
+	}
+	pathQuery := rest[end:]
+	if !strings.HasPrefix(pathQuery, "/") {
+		pathQuery = "/" + pathQuery
+	}
+	return u, u.parsePathQuery(pathQuery)
+}
+
+func (u *URL) parsePathQuery(target string) error {
+	var err error
+	u.RawPath, u.RawQuery, _ = strings.Cut(target, "?")
+	if u.Path, err = unescape(u.RawPath, false); err != nil {
+		return err
+	}
+	u.Query, err = ParseQuery(u.RawQuery)
+	return err
+}
+
+// String returns the target as it was sent
+func (u *URL) String() string {
+	switch u.Form {
+	case AuthorityForm:
+		return u.Host
+	case AbsoluteForm:
+		return u.Scheme + "://" + u.Host + u.RequestURI()
+	}
+	return u.RequestURI()
+}
+
+// RequestURI returns the target in origin-form (path and query)
+func (u *URL) RequestURI() string {
+	if u.RawQuery == "" {
+		return u.RawPath
+	}
+	return u.RawPath + "?" + u.RawQuery
+}
+
+// ParseQuery parses "a=1&b=2&a=3", keys and values are percent-decoded and '+' is a space
+func ParseQuery(query string) (Values, error) {
+	values := Values{}
+	for _, pair := range strings.Split(query, "&") {
+		if pair == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(pair, "=")
+		key, err := unescape(k, true)
+		if err != nil {
+			return nil, err
+		}
+		val, err := unescape(v, true)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = append(values[key], val)
+	}
+	return values, nil
+}
+
+// PathUnescape decodes the %XX sequences of a path (or of a segment of RawPath), '+' is kept
+func PathUnescape(s string) (string, error) {
+	return unescape(s, false)
+}
+
+// unescape decodes %XX sequences, in a query '+' is decoded as a space
+func unescape(s string, query bool) (string, error) {
+	if !strings.ContainsAny(s, "%+") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return "", fmt.Errorf("malformed percent-encoding: %s", s)
+			}
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		case c == '+' && query:
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// authority-form = uri-host ":" port
+func validateAuthority(target string) error {
+	i := strings.LastIndex(target, ":")
+	if i <= 0 || i == len(target)-1 || strings.ContainsAny(target, "/?@") {
+		return fmt.Errorf("CONNECT requires host:port, got: %s", target)
+	}
+	for _, c := range target[i+1:] {
+		if c < '0' || c > '9' {
+			return fmt.Errorf("invalid port in request target: %s", target)
+		}
+	}
+	return nil
+}
+
+// scheme = ALPHA *( ALPHA / DIGIT / "+" / "-" / "." )
+func isScheme(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		isAlpha := 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+		if i == 0 && !isAlpha {
+			return false
+		}
+		if !isAlpha && !('0' <= c && c <= '9') && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
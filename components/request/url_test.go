@@ -0,0 +1,73 @@
+package request
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTarget(t *testing.T) {
+	// Test: origin-form with query and percent-encoding
+	u, err := ParseTarget("GET", "/caf%C3%A9/a%20b?x=1&tag=a&tag=b+c&empty=&flag&q=%3D%26")
+	require.NoError(t, err)
+	assert.Equal(t, OriginForm, u.Form)
+	assert.Equal(t, "/café/a b", u.Path)
+	assert.Equal(t, "/caf%C3%A9/a%20b", u.RawPath)
+	assert.Equal(t, "1", u.Query.Get("x"))
+	assert.Equal(t, []string{"a", "b c"}, u.Query["tag"])
+	assert.True(t, u.Query.Has("empty"))
+	assert.True(t, u.Query.Has("flag"))
+	assert.Equal(t, "=&", u.Query.Get("q"))
+	assert.Equal(t, "/caf%C3%A9/a%20b?x=1&tag=a&tag=b+c&empty=&flag&q=%3D%26", u.RequestURI())
+
+	// Test: absolute-form
+	u, err = ParseTarget("GET", "http://www.example.org:8080/pub/index.html?lang=en")
+	require.NoError(t, err)
+	assert.Equal(t, AbsoluteForm, u.Form)
+	assert.Equal(t, "http", u.Scheme)
+	assert.Equal(t, "www.example.org:8080", u.Host)
+	assert.Equal(t, "/pub/index.html", u.Path)
+	assert.Equal(t, "en", u.Query.Get("lang"))
+
+	u, err = ParseTarget("GET", "http://example.org")
+	require.NoError(t, err)
+	assert.Equal(t, "/", u.Path)
+	assert.Equal(t, "http://example.org/", u.String())
+
+	// Test: authority-form
+	u, err = ParseTarget("CONNECT", "www.example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, AuthorityForm, u.Form)
+	assert.Equal(t, "www.example.com:443", u.Host)
+
+	_, err = ParseTarget("CONNECT", "www.example.com")
+	require.Error(t, err)
+
+	// Test: asterisk-form
+	u, err = ParseTarget("OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, AsteriskForm, u.Form)
+
+	_, err = ParseTarget("GET", "*")
+	require.Error(t, err)
+
+	// Test: invalid targets
+	for _, target := range []string{"/a#frag", "/bad%zz", "/bad%4", "relative/path", "ht@tp://x/", "http:///path"} {
+		_, err = ParseTarget("GET", target)
+		assert.Error(t, err, target)
+	}
+}
+
+func TestRequestURL(t *testing.T) {
+	r, err := RequestFromReader(strings.NewReader("GET /chunked?x=1 HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "/chunked?x=1", r.RequestLine.RequestTarget)
+	assert.Equal(t, "/chunked", r.URL.Path)
+	assert.Equal(t, "1", r.URL.Query.Get("x"))
+
+	// Test: malformed percent-encoding
+	_, err = RequestFromReader(strings.NewReader("GET /%G0 HTTP/1.1\r\n\r\n"))
+	require.Error(t, err)
+}
@@ -1,9 +1,12 @@
 package response
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"http/components/headers"
 	"io"
+	"net"
 	"strconv"
 	"strings"
 )
@@ -12,57 +15,592 @@ type StatusCode struct {
 	Reason string
 	Code   uint16
 }
+
+// ResponseState tracks what has been written, each write method is allowed only in some states:
+//
+//	init -> status -> headers -> body -> trailers -> done
+type ResponseState string
+
+const (
+	ResponseInit     ResponseState = "init"
+	ResponseStatus   ResponseState = "status"
+	ResponseHeaders  ResponseState = "headers"
+	ResponseBody     ResponseState = "body"
+	ResponseTrailers ResponseState = "trailers"
+	ResponseDone     ResponseState = "done"
+	// the connection has been taken over by the handler
+	ResponseHijacked ResponseState = "hijacked"
+)
+
+var ErrWriteOrder = errors.New("invalid response write")
+
+var ErrNotHijackable = errors.New("connection can't be hijacked")
+
+// HijackFunc hands the connection over, the reader holds the bytes already received from the client
+type HijackFunc func() (net.Conn, *bufio.Reader, error)
+
+// Framer sends the response with another protocol (e.g. HTTP/2 frames) instead of the HTTP/1.1 syntax.
+// The Response still checks the write order and decides whether the end of the body is known in advance,
+// a chunked body becomes a sequence of data terminated by WriteTrailers.
+type Framer interface {
+	// WriteHeader sends the status and the header fields, endStream when the response has no body
+	WriteHeader(status *StatusCode, h *headers.Headers, endStream bool) error
+	// WriteData sends body bytes, endStream with the last ones
+	WriteData(p []byte, endStream bool) (int, error)
+	// WriteTrailers ends the body with the trailer fields, an empty h just ends it
+	WriteTrailers(h *headers.Headers) error
+}
+
 type Response struct {
 	Writer io.Writer
+	// KeepAlive tells the client whether the connection stays open after this response.
+	// It is turned off when the handler sends "Connection: close" or a body without framing.
+	KeepAlive bool
+	// Head is set for a HEAD request: the response ends after the headers and the body is discarded
+	Head bool
+	// RequestVersion is the HTTP version of the request ("1.0", "1.1"). An HTTP/1.0 client doesn't
+	// know chunked encoding: a body of unknown length is delimited by closing the connection instead.
+	RequestVersion string
+	// OnHijack is set by the server when the handler can take over the connection (see Hijack)
+	OnHijack HijackFunc
+	// Framer replaces the HTTP/1.1 syntax written to Writer (e.g. for an HTTP/2 stream)
+	Framer Framer
+
+	state  ResponseState
+	status *StatusCode
+	// body framing decided by the headers
+	chunked       bool
+	contentLength int64 // -1 when the body is delimited by closing the connection
+	// chunks written as is to an HTTP/1.0 client, the trailers are dropped
+	closeDelimited bool
+	bodyWritten    int64
+
+	// streaming API: fields set before the headers are committed, the body is buffered
+	// up to BODY_BUFFER_SIZE to choose between Content-Length and chunked
+	header   *headers.Headers
+	trailer  *headers.Headers
+	declared []string // trailer fields announced in the Trailer header
+	buffered []byte
+
+	// body filters (e.g. compression), the active ones are stacked on the framing when the headers are committed
+	filters []BodyFilter
+	active  []io.WriteCloser
 }
 
+// BodyFilter is called when the headers are committed, it can change them and return a writer
+// that transforms the body before the framing (e.g. compression) or nil to leave the body unchanged.
+// The writer is closed before the end of the body, so it can flush what it still holds.
+type BodyFilter func(status *StatusCode, h *headers.Headers, w io.Writer) io.WriteCloser
+
+// Write buffers the body up to this size, a handler that writes less gets a Content-Length response
+const BODY_BUFFER_SIZE = 4 << 10
+
 var (
-	OK                    StatusCode = StatusCode{"OK", 200}
-	NOT_FOUND             StatusCode = StatusCode{"Not Found", 404}
-	BAD_REQUEST           StatusCode = StatusCode{"Bad Request", 400}
-	INTERNAL_SERVER_ERROR StatusCode = StatusCode{"Internal Server Error", 500}
+	SWITCHING_PROTOCOLS           StatusCode = StatusCode{"Switching Protocols", 101}
+	OK                            StatusCode = StatusCode{"OK", 200}
+	NO_CONTENT                    StatusCode = StatusCode{"No Content", 204}
+	PARTIAL_CONTENT               StatusCode = StatusCode{"Partial Content", 206}
+	MOVED_PERMANENTLY             StatusCode = StatusCode{"Moved Permanently", 301}
+	NOT_MODIFIED                  StatusCode = StatusCode{"Not Modified", 304}
+	FORBIDDEN                     StatusCode = StatusCode{"Forbidden", 403}
+	NOT_FOUND                     StatusCode = StatusCode{"Not Found", 404}
+	METHOD_NOT_ALLOWED            StatusCode = StatusCode{"Method Not Allowed", 405}
+	BAD_REQUEST                   StatusCode = StatusCode{"Bad Request", 400}
+	PROXY_AUTHENTICATION_REQUIRED StatusCode = StatusCode{"Proxy Authentication Required", 407}
+	REQUEST_TIMEOUT               StatusCode = StatusCode{"Request Timeout", 408}
+	CONTENT_TOO_LARGE             StatusCode = StatusCode{"Content Too Large", 413}
+	URI_TOO_LONG                  StatusCode = StatusCode{"URI Too Long", 414}
+
+	RANGE_NOT_SATISFIABLE           StatusCode = StatusCode{"Range Not Satisfiable", 416}
+	UPGRADE_REQUIRED                StatusCode = StatusCode{"Upgrade Required", 426}
+	REQUEST_HEADER_FIELDS_TOO_LARGE StatusCode = StatusCode{"Request Header Fields Too Large", 431}
+	INTERNAL_SERVER_ERROR           StatusCode = StatusCode{"Internal Server Error", 500}
+	BAD_GATEWAY                     StatusCode = StatusCode{"Bad Gateway", 502}
+	SERVICE_UNAVAILABLE             StatusCode = StatusCode{"Service Unavailable", 503}
+	GATEWAY_TIMEOUT                 StatusCode = StatusCode{"Gateway Timeout", 504}
 )
 
 const HTTP_VERSION = "HTTP/1.1"
 
 const DELIMITER = "\r\n"
 
-func (res *Response) Write(status *StatusCode, currentHeaders *headers.Headers, body []byte) {
+// State returns what has been written so far
+func (res *Response) State() ResponseState {
+	if res.state == "" {
+		return ResponseInit
+	}
+	return res.state
+}
+
+// Started reports whether the status line has been sent, after that an error page can't be written anymore
+func (res *Response) Started() bool {
+	return res.State() != ResponseInit
+}
+
+func (res *Response) checkState(op string, allowed ...ResponseState) error {
+	for _, s := range allowed {
+		if res.State() == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s in state %s", ErrWriteOrder, op, res.State())
+}
+
+// Header returns the fields sent with the response, they can be changed until the headers are committed
+func (res *Response) Header() *headers.Headers {
+	if res.header == nil {
+		res.header = headers.NewHeaders()
+	}
+	return res.header
+}
+
+// Trailer returns the trailer fields, only the ones declared in the Trailer header are sent.
+// They can be set at any time before the handler returns.
+func (res *Response) Trailer() *headers.Headers {
+	if res.trailer == nil {
+		res.trailer = headers.NewHeaders()
+	}
+	return res.trailer
+}
+
+// AddBodyFilter adds a filter applied to the body of this response, it must be added before the headers are committed
+func (res *Response) AddBodyFilter(f BodyFilter) error {
+	if err := res.checkState("AddBodyFilter", ResponseInit); err != nil {
+		return err
+	}
+	res.filters = append(res.filters, f)
+	return nil
+}
+
+// Hijack takes over the connection (e.g. for a WebSocket): the server stops reading requests and won't close it.
+// It's allowed before anything is written or after a complete response (e.g. 101 Switching Protocols).
+func (res *Response) Hijack() (net.Conn, *bufio.Reader, error) {
+	if res.OnHijack == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	if err := res.checkState("Hijack", ResponseInit, ResponseDone); err != nil {
+		return nil, nil, err
+	}
+	conn, rd, err := res.OnHijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	res.state = ResponseHijacked
+	res.buffered = nil
+	return conn, rd, nil
+}
+
+// SetStatus sets the status of a response written with Write, the default is 200 OK
+func (res *Response) SetStatus(status *StatusCode) error {
+	if err := res.checkState("SetStatus", ResponseInit); err != nil {
+		return err
+	}
+	res.status = status
+	return nil
+}
+
+// Write streams the body. The first BODY_BUFFER_SIZE bytes are buffered: if the handler returns
+// within them the response gets a Content-Length, otherwise it switches to chunked encoding.
+func (res *Response) Write(p []byte) (int, error) {
+	if res.State() == ResponseInit {
+		if len(res.buffered)+len(p) <= BODY_BUFFER_SIZE {
+			res.buffered = append(res.buffered, p...)
+			return len(p), nil
+		}
+		if err := res.commit(false); err != nil {
+			return 0, err
+		}
+	}
+	if res.chunked {
+		return res.WriteChunkedBody(p)
+	}
+	return res.WriteBody(p)
+}
+
+// Flush commits the headers and sends the buffered body, the rest of the body will be chunked.
+// Filters that hold data (e.g. compression) are flushed too.
+func (res *Response) Flush() error {
+	if res.State() == ResponseInit {
+		return res.commit(false)
+	}
+	for i := len(res.active) - 1; i >= 0; i-- {
+		if f, ok := res.active[i].(interface{ Flush() error }); ok {
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Finish completes the response when the handler returns: the buffered body is sent
+// with a Content-Length and a chunked body is terminated with the trailers
+func (res *Response) Finish() error {
+	if res.State() == ResponseInit {
+		if err := res.commit(true); err != nil {
+			return err
+		}
+	}
+	if res.chunked && (res.State() == ResponseHeaders || res.State() == ResponseBody) {
+		return res.WriteTrailers(headers.NewHeaders())
+	}
+	if res.Framer != nil && res.contentLength < 0 && (res.State() == ResponseHeaders || res.State() == ResponseBody) {
+		// a body without framing ends with the stream instead of the connection
+		res.state = ResponseDone
+		_, err := res.Framer.WriteData(nil, true)
+		return err
+	}
+	return nil
+}
+
+// Reset drops what has been buffered by Write, it fails once the headers are committed
+func (res *Response) Reset() error {
+	if err := res.checkState("Reset", ResponseInit); err != nil {
+		return err
+	}
+	res.status, res.header, res.trailer, res.buffered = nil, nil, nil, nil
+	return nil
+}
+
+// commit writes the status line, the fields of Header() and the buffered body.
+// The framing is left to the handler when it sets Content-Length or Transfer-Encoding, otherwise
+// a final commit knows the whole body, anything else (or announced trailers) requires chunked encoding.
+func (res *Response) commit(final bool) error {
+	status := res.status
 	if status == nil {
 		status = &OK
 	}
-	writeStatusLine(res.Writer, status)
+	h := res.Header()
+	if bodyAllowed(status) && !h.Has(headers.CONTENT_LENGTH) && !h.Has(headers.TRANSFER_ENCODING) {
+		if final && !h.Has(headers.TRAILER) {
+			h.Set(headers.CONTENT_LENGTH, strconv.Itoa(len(res.buffered)))
+		} else {
+			h.Set(headers.TRANSFER_ENCODING, "chunked")
+		}
+	}
+	if err := res.WriteStatusLine(status); err != nil {
+		return err
+	}
+	if err := res.WriteHeaders(h); err != nil {
+		return err
+	}
+
+	body := res.buffered
+	res.buffered = nil
+	if len(body) == 0 {
+		return nil
+	}
+	var err error
+	if res.chunked {
+		_, err = res.WriteChunkedBody(body)
+	} else {
+		_, err = res.WriteBody(body)
+	}
+	return err
+}
+
+// WriteResponse sends a complete response: status line, headers and body.
+// A nil body leaves the response open, e.g. for chunks after a "Transfer-Encoding: chunked" header.
+func (res *Response) WriteResponse(status *StatusCode, currentHeaders *headers.Headers, body []byte) error {
+	if err := res.checkState("WriteResponse", ResponseInit); err != nil {
+		return err
+	}
+	if status == nil {
+		status = &OK
+	}
+	if err := res.WriteStatusLine(status); err != nil {
+		return err
+	}
 
 	if currentHeaders == nil {
 		currentHeaders = GetDefaultHeaders(len(body))
 	} else if body != nil {
 		currentHeaders.Set(headers.CONTENT_LENGTH, strconv.Itoa(len(body)))
 	}
-	writeHeaders(res.Writer, currentHeaders)
+	if err := res.WriteHeaders(currentHeaders); err != nil {
+		return err
+	}
 
 	if len(body) > 0 {
-		writeBody(res.Writer, body)
+		if _, err := res.WriteBody(body); err != nil {
+			return err
+		}
 	}
+	if body != nil && len(res.active) > 0 {
+		// the filtered body has no known length, it's sent chunked
+		return res.Finish()
+	}
+	return nil
 }
 
-// TODO: need refactor
+func (res *Response) WriteStatusLine(status *StatusCode) error {
+	if err := res.checkState("WriteStatusLine", ResponseInit); err != nil {
+		return err
+	}
+	res.status = status
+	res.state = ResponseStatus
+	if res.Framer != nil {
+		// sent with the header fields
+		return nil
+	}
+	return writeStatusLine(res.Writer, status)
+}
+
+// WriteHeaders sends the header section and decides the body framing:
+// chunked, Content-Length or, without both, delimited by closing the connection
+func (res *Response) WriteHeaders(h *headers.Headers) error {
+	if err := res.checkState("WriteHeaders", ResponseStatus); err != nil {
+		return err
+	}
+
+	if h != res.header {
+		merge(h, res.header)
+	}
+	res.applyFilters(h)
+	res.chunked = h.HasToken(headers.TRANSFER_ENCODING, "chunked")
+	if res.chunked && res.Framer == nil && res.RequestVersion == "1.0" {
+		// chunked encoding can't be sent to an HTTP/1.0 recipient (RFC 9112 section 6.1)
+		h.Del(headers.TRANSFER_ENCODING)
+		h.Del(headers.TRAILER)
+		res.closeDelimited = true
+	}
+	res.contentLength = -1
+	if !res.chunked && h.Has(headers.CONTENT_LENGTH) {
+		length, err := h.GetContentLength()
+		if err != nil {
+			return err
+		}
+		res.contentLength = int64(length)
+	}
+	res.setConnection(h)
+	for _, name := range strings.Split(h.Get(headers.TRAILER), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			res.declared = append(res.declared, name)
+		}
+	}
+
+	res.state = ResponseHeaders
+	if !bodyAllowed(res.status) || res.contentLength == 0 || res.Head {
+		res.state = ResponseDone
+	}
+	if res.Framer != nil {
+		return res.Framer.WriteHeader(res.status, h, res.State() == ResponseDone)
+	}
+	_, err := writeHeaders(res.Writer, h)
+	return err
+}
+
+// WriteBody writes body bytes of a Content-Length (or connection delimited) response,
+// it fails when the body exceeds the declared Content-Length
+func (res *Response) WriteBody(p []byte) (int, error) {
+	if res.discardBody() {
+		return len(p), nil
+	}
+	if err := res.checkState("WriteBody", ResponseHeaders, ResponseBody); err != nil {
+		return 0, err
+	}
+	if len(res.active) > 0 {
+		// the Content-Length declared by the handler was replaced by chunked encoding
+		res.state = ResponseBody
+		return res.active[len(res.active)-1].Write(p)
+	}
+	if res.chunked {
+		return 0, fmt.Errorf("%w: WriteBody on a chunked response, use WriteChunkedBody", ErrWriteOrder)
+	}
+	if res.contentLength >= 0 && res.bodyWritten+int64(len(p)) > res.contentLength {
+		return 0, fmt.Errorf("%w: body longer than Content-Length %d", ErrWriteOrder, res.contentLength)
+	}
+
+	res.state = ResponseBody
+	return res.writeFramed(p)
+}
+
+// writeFramed writes body bytes after the filters, as a chunk or within the Content-Length
+func (res *Response) writeFramed(p []byte) (int, error) {
+	if res.chunked {
+		return res.writeChunk(p)
+	}
+	var (
+		n   int
+		err error
+	)
+	if res.Framer != nil {
+		n, err = res.Framer.WriteData(p, res.bodyWritten+int64(len(p)) == res.contentLength)
+	} else {
+		n, err = res.Writer.Write(p)
+	}
+	res.bodyWritten += int64(n)
+	if res.bodyWritten == res.contentLength {
+		res.state = ResponseDone
+	}
+	return n, err
+}
+
+// applyFilters stacks the filters on the framing. A filtered body has a new length,
+// so the Content-Length set by the handler is replaced by chunked encoding.
+// The headers of a HEAD response are filtered too, so that they describe the response to a GET.
+func (res *Response) applyFilters(h *headers.Headers) {
+	if !bodyAllowed(res.status) {
+		return
+	}
+	var w io.Writer = framedWriter{res}
+	for _, f := range res.filters {
+		if fw := f(res.status, h, w); fw != nil {
+			res.active = append(res.active, fw)
+			w = fw
+		}
+	}
+	if len(res.active) > 0 {
+		h.Del(headers.CONTENT_LENGTH)
+		if !h.HasToken(headers.TRANSFER_ENCODING, "chunked") {
+			h.Set(headers.TRANSFER_ENCODING, "chunked")
+		}
+	}
+	if res.Head {
+		// the body is never written
+		res.active = nil
+	}
+}
+
+// closeFilters flushes the filters, outermost first
+func (res *Response) closeFilters() error {
+	for i := len(res.active) - 1; i >= 0; i-- {
+		if err := res.active[i].Close(); err != nil {
+			return err
+		}
+	}
+	res.active = nil
+	return nil
+}
+
+type framedWriter struct {
+	res *Response
+}
+
+func (w framedWriter) Write(p []byte) (int, error) {
+	return w.res.writeFramed(p)
+}
+
+// A persistent connection requires the end of the body to be known by the client,
+// otherwise the only way to delimit it is closing the connection.
+// A 101 switches the connection to another protocol: "Connection: Upgrade" is kept and
+// no other HTTP/1.1 response follows; the Upgrade option set by the handler is kept too (e.g. 426).
+func (res *Response) setConnection(h *headers.Headers) {
+	if res.status.Code == SWITCHING_PROTOCOLS.Code {
+		res.KeepAlive = false
+		if !h.HasToken(headers.CONNECTION, "upgrade") {
+			h.Set(headers.CONNECTION, "Upgrade")
+		}
+		return
+	}
+	if h.HasToken(headers.CONNECTION, "close") ||
+		(bodyAllowed(res.status) && !res.Head && res.contentLength < 0 && (!res.chunked || res.closeDelimited)) {
+		res.KeepAlive = false
+	}
+	if h.HasToken(headers.CONNECTION, "upgrade") {
+		if !res.KeepAlive && !h.HasToken(headers.CONNECTION, "close") {
+			h.Set(headers.CONNECTION, h.Get(headers.CONNECTION)+", close")
+		}
+		return
+	}
+	if res.KeepAlive {
+		h.Set(headers.CONNECTION, "keep-alive")
+	} else {
+		h.Set(headers.CONNECTION, "close")
+	}
+}
+
+// discardBody reports whether the body of a HEAD response is being written
+func (res *Response) discardBody() bool {
+	return res.Head && res.State() == ResponseDone
+}
+
+// 1xx, 204 and 304 responses never have a body (RFC 9112 section 6.3)
+func bodyAllowed(status *StatusCode) bool {
+	return status.Code >= 200 && status.Code != 204 && status.Code != 304
+}
+
+// WriteChunkedBody writes a chunk, the headers must declare "Transfer-Encoding: chunked".
+// An empty p is ignored since a zero-size chunk terminates the body.
 func (r *Response) WriteChunkedBody(p []byte) (int, error) {
+	if r.discardBody() {
+		return len(p), nil
+	}
+	if err := r.checkState("WriteChunkedBody", ResponseHeaders, ResponseBody); err != nil {
+		return 0, err
+	}
+	if !r.chunked {
+		return 0, fmt.Errorf("%w: WriteChunkedBody without Transfer-Encoding: chunked", ErrWriteOrder)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	r.state = ResponseBody
+	if len(r.active) > 0 {
+		return r.active[len(r.active)-1].Write(p)
+	}
+	return r.writeChunk(p)
+}
+
+func (r *Response) writeChunk(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.Framer != nil {
+		return r.Framer.WriteData(p, false)
+	}
+	if r.closeDelimited {
+		return r.Writer.Write(p)
+	}
 	_, err := r.Writer.Write(fmt.Appendf(nil, "%02x\r\n", len(p))) // write chunk size
 	if err != nil {
 		return 0, err
 	}
-	_, err = r.Writer.Write(p) // write chunk
+	n, err := r.Writer.Write(p) // write chunk
 	if err != nil {
-		return 0, err
+		return n, err
 	}
 	_, err = r.Writer.Write([]byte(DELIMITER)) // delimiter
 	if err != nil {
-		return 0, err
+		return n, err
 	}
-	return 0, nil
+	return n, nil
 }
 
+// WriteTrailers terminates a chunked body with the trailer fields and the declared fields of Trailer()
 func (r *Response) WriteTrailers(h *headers.Headers) error {
+	if r.discardBody() {
+		return nil
+	}
+	if err := r.checkState("WriteTrailers", ResponseHeaders, ResponseBody); err != nil {
+		return err
+	}
+	if !r.chunked {
+		return fmt.Errorf("%w: WriteTrailers without Transfer-Encoding: chunked", ErrWriteOrder)
+	}
+	if err := r.closeFilters(); err != nil {
+		return err
+	}
+	if r.closeDelimited {
+		// the body ends when the connection is closed
+		r.state = ResponseDone
+		return nil
+	}
+	r.state = ResponseTrailers
+	if r.trailer != nil {
+		declared := headers.NewHeaders()
+		for _, name := range r.declared {
+			for _, v := range r.trailer.Values(name) {
+				declared.Add(name, v)
+			}
+		}
+		merge(h, declared)
+	}
+	if r.Framer != nil {
+		r.state = ResponseDone
+		return r.Framer.WriteTrailers(h)
+	}
+
 	var hBuilder strings.Builder
 
 	// Signal end of the body
@@ -79,17 +617,34 @@ func (r *Response) WriteTrailers(h *headers.Headers) error {
 	hBuilder.Write([]byte{'\r', '\n'})
 
 	_, error := io.WriteString(r.Writer, hBuilder.String())
+	r.state = ResponseDone
 	return error
 }
 
+// WriteChunkedBodyDone terminates a chunked body without trailers
 func (r *Response) WriteChunkedBodyDone() (int, error) {
-	r.Writer.Write([]byte{'0', '\r', '\n', '\r', '\n'})
-	return 0, nil
+	return 0, r.WriteTrailers(headers.NewHeaders())
+}
+
+// merge adds the fields of src that are missing in dst
+func merge(dst *headers.Headers, src *headers.Headers) {
+	if src == nil {
+		return
+	}
+	missing := map[string]bool{}
+	src.ForEach(func(k, v string) {
+		if _, ok := missing[k]; !ok {
+			missing[k] = !dst.Has(k)
+		}
+		if missing[k] {
+			dst.Add(k, v)
+		}
+	})
 }
 
 func writeStatusLine(w io.Writer, statusCode *StatusCode) error {
-	fmt.Fprintf(w, "%v %v %v\r\n", HTTP_VERSION, statusCode.Code, statusCode.Reason)
-	return nil
+	_, err := fmt.Fprintf(w, "%v %v %v\r\n", HTTP_VERSION, statusCode.Code, statusCode.Reason)
+	return err
 }
 
 func writeHeaders(w io.Writer, h *headers.Headers) (int, error) {
@@ -105,15 +660,9 @@ func writeHeaders(w io.Writer, h *headers.Headers) (int, error) {
 	return io.WriteString(w, hBuilder.String())
 }
 
-func writeBody(w io.Writer, data []byte) error {
-	_, err := w.Write(data)
-	return err
-}
-
 func GetDefaultHeaders(contentLen int) *headers.Headers {
 	h := headers.NewHeaders()
 	h.Set(headers.CONTENT_TYPE, "text/plain")
 	h.Set(headers.CONTENT_LENGTH, strconv.Itoa(contentLen))
-	h.Set("Connection", "close")
 	return h
 }
@@ -18,7 +18,7 @@ func TestResponse_Write(t *testing.T) {
 		res := Response{Writer: &buf}
 		body := []byte("Hello0o0o0")
 
-		res.Write(nil, nil, body)
+		res.WriteResponse(nil, nil, body)
 
 		output := buf.String()
 		expectedPrefix := "HTTP/1.1 200 OK\r\n"
@@ -38,7 +38,7 @@ func TestResponse_Write(t *testing.T) {
 		hdrs := headers.NewHeaders()
 		hdrs.Set("X-Custom-Header", "Im-header")
 
-		res.Write(status, hdrs, []byte{})
+		res.WriteResponse(status, hdrs, []byte{})
 
 		output := buf.String()
 		expectedPrefix := "HTTP/1.1 404 Not Found\r\n"
@@ -57,16 +57,27 @@ func TestResponse_Write(t *testing.T) {
 		hdrs := headers.NewHeaders()
 		hdrs.Set("X-Another-Header", "not-alone")
 
-		res.Write(&OK, hdrs, body)
+		res.WriteResponse(&OK, hdrs, body)
 
 		output := buf.String()
 		assert.Contains(t, output, fmt.Sprintf("content-length: %s\r\n", strconv.Itoa(len(body))))
 	})
 }
 
+// chunkedResponse returns a response whose chunked headers are already written, buf is reset
+func chunkedResponse(t *testing.T, buf *bytes.Buffer) *Response {
+	res := &Response{Writer: buf}
+	h := headers.NewHeaders()
+	h.Set(headers.TRANSFER_ENCODING, "chunked")
+	require.NoError(t, res.WriteResponse(&OK, h, nil))
+	require.Equal(t, ResponseHeaders, res.State())
+	buf.Reset()
+	return res
+}
+
 func TestResponse_WriteChunkedBody(t *testing.T) {
 	var buf bytes.Buffer
-	res := Response{Writer: &buf}
+	res := chunkedResponse(t, &buf)
 
 	// TEST 1
 	chunkData := []byte("this is a chunk of you")
@@ -93,7 +104,7 @@ func TestResponse_WriteChunkedBody(t *testing.T) {
 
 func TestResponse_WriteChunkedBodyDone(t *testing.T) {
 	var buf bytes.Buffer
-	res := Response{Writer: &buf}
+	res := chunkedResponse(t, &buf)
 
 	_, err := res.WriteChunkedBodyDone()
 	require.NoError(t, err)
@@ -104,7 +115,7 @@ func TestResponse_WriteChunkedBodyDone(t *testing.T) {
 
 func TestResponse_WriteTrailers(t *testing.T) {
 	var buf bytes.Buffer
-	res := Response{Writer: &buf}
+	res := chunkedResponse(t, &buf)
 
 	trailers := headers.NewHeaders()
 	trailers.Set("X-Checksum", "abcde12345")
@@ -122,3 +133,222 @@ func TestResponse_WriteTrailers(t *testing.T) {
 	assert.Contains(t, output, "expires: Wed, 21 Oct 2025 07:28:00 GMT\r\n")
 	require.True(t, strings.HasSuffix(output, expectedSuffix))
 }
+
+func TestResponse_WriteMultipleValues(t *testing.T) {
+	var buf bytes.Buffer
+	res := Response{Writer: &buf}
+	hdrs := headers.NewHeaders()
+	hdrs.Add("Set-Cookie", "a=1; Path=/")
+	hdrs.Add("Set-Cookie", "b=2")
+	hdrs.Set("Cache-Control", "no-cache")
+
+	res.WriteResponse(&OK, hdrs, []byte("ok"))
+
+	output := buf.String()
+	assert.Contains(t, output, "set-cookie: a=1; Path=/\r\nset-cookie: b=2\r\ncache-control: no-cache\r\n")
+}
+
+func TestResponse_WriteOrder(t *testing.T) {
+	t.Run("second Write is rejected", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := Response{Writer: &buf}
+		require.NoError(t, res.WriteResponse(&OK, nil, []byte("first")))
+		assert.Equal(t, ResponseDone, res.State())
+		written := buf.Len()
+
+		err := res.WriteResponse(&NOT_FOUND, nil, []byte("second"))
+		require.ErrorIs(t, err, ErrWriteOrder)
+		assert.Equal(t, written, buf.Len())
+	})
+
+	t.Run("chunks need a chunked header", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := Response{Writer: &buf}
+		_, err := res.WriteChunkedBody([]byte("data"))
+		require.ErrorIs(t, err, ErrWriteOrder)
+
+		require.NoError(t, res.WriteResponse(&OK, nil, nil))
+		_, err = res.WriteChunkedBody([]byte("data"))
+		require.ErrorIs(t, err, ErrWriteOrder)
+	})
+
+	t.Run("headers before status line", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := Response{Writer: &buf}
+		require.ErrorIs(t, res.WriteHeaders(headers.NewHeaders()), ErrWriteOrder)
+		assert.Equal(t, 0, buf.Len())
+	})
+
+	t.Run("body longer than Content-Length", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := Response{Writer: &buf}
+		require.NoError(t, res.WriteStatusLine(&OK))
+		require.NoError(t, res.WriteHeaders(GetDefaultHeaders(5)))
+
+		_, err := res.WriteBody([]byte("abc"))
+		require.NoError(t, err)
+		assert.Equal(t, ResponseBody, res.State())
+		_, err = res.WriteBody([]byte("def"))
+		require.ErrorIs(t, err, ErrWriteOrder)
+		_, err = res.WriteBody([]byte("de"))
+		require.NoError(t, err)
+		assert.Equal(t, ResponseDone, res.State())
+	})
+
+	t.Run("chunked body then trailers", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := chunkedResponse(t, &buf)
+		_, err := res.WriteChunkedBody([]byte("data"))
+		require.NoError(t, err)
+		assert.Equal(t, ResponseBody, res.State())
+		_, err = res.WriteBody([]byte("data"))
+		require.ErrorIs(t, err, ErrWriteOrder)
+
+		require.NoError(t, res.WriteTrailers(headers.NewHeaders()))
+		assert.Equal(t, ResponseDone, res.State())
+		_, err = res.WriteChunkedBody([]byte("late"))
+		require.ErrorIs(t, err, ErrWriteOrder)
+	})
+
+	t.Run("no body for 204", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := Response{Writer: &buf, KeepAlive: true}
+		require.NoError(t, res.WriteStatusLine(&NO_CONTENT))
+		require.NoError(t, res.WriteHeaders(headers.NewHeaders()))
+		assert.Equal(t, ResponseDone, res.State())
+		assert.True(t, res.KeepAlive)
+	})
+
+	t.Run("101 keeps Connection: Upgrade", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := Response{Writer: &buf, KeepAlive: true}
+		res.Header().Set("Upgrade", "websocket")
+		require.NoError(t, res.WriteStatusLine(&SWITCHING_PROTOCOLS))
+		require.NoError(t, res.WriteHeaders(res.Header()))
+		assert.Equal(t, ResponseDone, res.State())
+		assert.False(t, res.KeepAlive)
+		assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\nupgrade: websocket\r\nconnection: Upgrade\r\n\r\n", buf.String())
+	})
+
+	t.Run("Upgrade option set by the handler", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := Response{Writer: &buf, KeepAlive: true}
+		h := GetDefaultHeaders(0)
+		h.Set("Upgrade", "h2c")
+		h.Set(headers.CONNECTION, "Upgrade")
+		require.NoError(t, res.WriteResponse(&UPGRADE_REQUIRED, h, nil))
+		assert.True(t, res.KeepAlive)
+		assert.Contains(t, buf.String(), "connection: Upgrade\r\n")
+	})
+}
+
+func TestResponse_Stream(t *testing.T) {
+	t.Run("small body gets a Content-Length", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := Response{Writer: &buf, KeepAlive: true}
+		res.Header().Set(headers.CONTENT_TYPE, "text/plain")
+		res.Write([]byte("hello "))
+		res.Write([]byte("world"))
+		assert.Equal(t, 0, buf.Len())
+
+		require.NoError(t, res.Finish())
+		assert.Equal(t, ResponseDone, res.State())
+		assert.Equal(t, "HTTP/1.1 200 OK\r\ncontent-type: text/plain\r\ncontent-length: 11\r\nconnection: keep-alive\r\n\r\nhello world", buf.String())
+	})
+
+	t.Run("large body switches to chunked", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := Response{Writer: &buf, KeepAlive: true}
+		data := bytes.Repeat([]byte("a"), BODY_BUFFER_SIZE)
+		res.Write(data)
+		assert.Equal(t, ResponseInit, res.State())
+
+		res.Write([]byte("b"))
+		assert.Equal(t, ResponseBody, res.State())
+		require.NoError(t, res.Finish())
+		assert.Equal(t, ResponseDone, res.State())
+
+		output := buf.String()
+		assert.Contains(t, output, "transfer-encoding: chunked\r\n")
+		assert.Contains(t, output, "connection: keep-alive\r\n")
+		assert.NotContains(t, output, "content-length")
+		assert.True(t, strings.HasSuffix(output, "\r\n1000\r\n"+string(data)+"\r\n01\r\nb\r\n0\r\n\r\n"))
+	})
+
+	t.Run("declared trailers are sent after the body", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := Response{Writer: &buf}
+		res.Header().Set(headers.TRAILER, "X-Checksum")
+		res.Write([]byte("data"))
+		res.Trailer().Set("X-Checksum", "abc")
+		res.Trailer().Set("X-Undeclared", "no")
+		require.NoError(t, res.Finish())
+
+		output := buf.String()
+		assert.Contains(t, output, "transfer-encoding: chunked\r\n")
+		assert.True(t, strings.HasSuffix(output, "04\r\ndata\r\n0\r\nx-checksum: abc\r\n\r\n"))
+		assert.NotContains(t, output, "x-undeclared")
+	})
+
+	t.Run("HTTP/1.0 body delimited by the connection", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := Response{Writer: &buf, KeepAlive: true, RequestVersion: "1.0"}
+		res.Header().Set(headers.TRAILER, "X-Checksum")
+		data := bytes.Repeat([]byte("a"), BODY_BUFFER_SIZE)
+		res.Write(data)
+		res.Write([]byte("b"))
+		res.Trailer().Set("X-Checksum", "abc")
+		require.NoError(t, res.Finish())
+		assert.Equal(t, ResponseDone, res.State())
+		assert.False(t, res.KeepAlive)
+
+		output := buf.String()
+		assert.Contains(t, output, "connection: close\r\n")
+		assert.NotContains(t, output, "transfer-encoding")
+		assert.NotContains(t, output, "trailer")
+		assert.NotContains(t, output, "x-checksum")
+		assert.True(t, strings.HasSuffix(output, "\r\n\r\n"+string(data)+"b"))
+
+		// a known length keeps the connection
+		buf.Reset()
+		res = Response{Writer: &buf, KeepAlive: true, RequestVersion: "1.0"}
+		res.Write([]byte("short"))
+		require.NoError(t, res.Finish())
+		assert.True(t, res.KeepAlive)
+		assert.Contains(t, buf.String(), "content-length: 5\r\n")
+	})
+
+	t.Run("Flush commits the headers", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := Response{Writer: &buf}
+		require.NoError(t, res.SetStatus(&NOT_FOUND))
+		res.Write([]byte("early"))
+		require.NoError(t, res.Flush())
+		assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 404 Not Found\r\n"))
+		assert.True(t, strings.HasSuffix(buf.String(), "05\r\nearly\r\n"))
+		assert.ErrorIs(t, res.SetStatus(&OK), ErrWriteOrder)
+	})
+
+	t.Run("Reset drops the buffered body", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := Response{Writer: &buf}
+		res.Header().Set("X-Dropped", "yes")
+		res.Write([]byte("dropped"))
+		require.NoError(t, res.Reset())
+		require.NoError(t, res.WriteResponse(&BAD_REQUEST, nil, []byte("error")))
+		assert.NotContains(t, buf.String(), "dropped")
+		assert.NotContains(t, buf.String(), "x-dropped")
+	})
+
+	t.Run("Header fields are added to WriteResponse", func(t *testing.T) {
+		var buf bytes.Buffer
+		res := Response{Writer: &buf}
+		res.Header().Set("X-Request-Id", "42")
+		res.Header().Set(headers.CONTENT_TYPE, "application/json")
+		require.NoError(t, res.WriteResponse(&OK, nil, []byte("ok")))
+		assert.Contains(t, buf.String(), "x-request-id: 42\r\n")
+		// fields passed to WriteResponse win
+		assert.Contains(t, buf.String(), "content-type: text/plain\r\n")
+		assert.NotContains(t, buf.String(), "application/json")
+	})
+}
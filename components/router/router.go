@@ -0,0 +1,260 @@
+package router
+
+import (
+	"fmt"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"slices"
+	"strings"
+)
+
+const (
+	GET     = "GET"
+	HEAD    = "HEAD"
+	POST    = "POST"
+	PUT     = "PUT"
+	PATCH   = "PATCH"
+	DELETE  = "DELETE"
+	OPTIONS = "OPTIONS"
+)
+
+// Path segment that matches the rest of the path, it must be the last one of a pattern
+const WILDCARD = "*"
+
+// node is a segment of the routing tree.
+// Lookup precedence for each segment: static > {param} > * (wildcard)
+type node struct {
+	static   map[string]*node
+	param    *node
+	name     string // parameter name, only for param nodes
+	wildcard *node
+	handlers map[string]*route
+}
+
+type route struct {
+	handler server.Handler
+	group   *Routes
+}
+
+func newNode() *node {
+	return &node{static: map[string]*node{}, handlers: map[string]*route{}}
+}
+
+// Router dispatches requests by method and path.
+// Patterns are made of static segments, named parameters and a trailing wildcard:
+//
+//	/users
+//	/users/{id}
+//	/static/*
+type Router struct {
+	*Routes
+	root *node
+}
+
+// Routes registers handlers under a shared prefix and middlewares,
+// the Router itself is the group with an empty prefix
+type Routes struct {
+	router      *Router
+	parent      *Routes
+	prefix      string
+	middlewares []server.Middleware
+}
+
+func New() *Router {
+	r := &Router{root: newNode()}
+	r.Routes = &Routes{router: r}
+	return r
+}
+
+// Group returns a set of routes sharing the prefix, e.g. Group("/api").GET("/users", h) -> GET /api/users
+// The group inherits the middlewares of its parent.
+func (g *Routes) Group(prefix string, mws ...server.Middleware) *Routes {
+	return &Routes{router: g.router, parent: g, prefix: joinPath(g.prefix, prefix), middlewares: mws}
+}
+
+// Use adds middlewares to every route of the group, including the ones already registered.
+// Middlewares of the Router also wrap the 404 and 405 responses.
+func (g *Routes) Use(mws ...server.Middleware) {
+	g.middlewares = append(g.middlewares, mws...)
+}
+
+// Handle registers h for the method and pattern, mws wrap only this route.
+// It panics on an invalid or duplicated route.
+func (g *Routes) Handle(method string, pattern string, h server.Handler, mws ...server.Middleware) {
+	g.router.add(method, joinPath(g.prefix, pattern), &route{handler: server.Chain(mws...)(h), group: g})
+}
+
+func (g *Routes) GET(pattern string, h server.Handler, mws ...server.Middleware) {
+	g.Handle(GET, pattern, h, mws...)
+}
+func (g *Routes) HEAD(pattern string, h server.Handler, mws ...server.Middleware) {
+	g.Handle(HEAD, pattern, h, mws...)
+}
+func (g *Routes) POST(pattern string, h server.Handler, mws ...server.Middleware) {
+	g.Handle(POST, pattern, h, mws...)
+}
+func (g *Routes) PUT(pattern string, h server.Handler, mws ...server.Middleware) {
+	g.Handle(PUT, pattern, h, mws...)
+}
+func (g *Routes) PATCH(pattern string, h server.Handler, mws ...server.Middleware) {
+	g.Handle(PATCH, pattern, h, mws...)
+}
+func (g *Routes) DELETE(pattern string, h server.Handler, mws ...server.Middleware) {
+	g.Handle(DELETE, pattern, h, mws...)
+}
+func (g *Routes) OPTIONS(pattern string, h server.Handler, mws ...server.Middleware) {
+	g.Handle(OPTIONS, pattern, h, mws...)
+}
+
+// wrap applies the middlewares of the group and of its ancestors, outermost first
+func (g *Routes) wrap(h server.Handler) server.Handler {
+	for ; g != nil; g = g.parent {
+		h = server.Chain(g.middlewares...)(h)
+	}
+	return h
+}
+
+func (r *Router) add(method string, pattern string, rt *route) {
+	n := r.root
+	segments := splitPath(pattern)
+
+	for i, seg := range segments {
+		switch {
+		case seg == WILDCARD:
+			if i != len(segments)-1 {
+				panic(fmt.Sprintf("router: wildcard must be the last segment: %s", pattern))
+			}
+			if n.wildcard == nil {
+				n.wildcard = newNode()
+			}
+			n = n.wildcard
+		case strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}"):
+			name := seg[1 : len(seg)-1]
+			if name == "" {
+				panic(fmt.Sprintf("router: empty parameter name: %s", pattern))
+			}
+			if n.param == nil {
+				n.param = newNode()
+				n.param.name = name
+			} else if n.param.name != name {
+				panic(fmt.Sprintf("router: parameter {%s} conflicts with {%s}: %s", name, n.param.name, pattern))
+			}
+			n = n.param
+		default:
+			child, ok := n.static[seg]
+			if !ok {
+				child = newNode()
+				n.static[seg] = child
+			}
+			n = child
+		}
+	}
+
+	if _, ok := n.handlers[method]; ok {
+		panic(fmt.Sprintf("router: duplicated route %s %s", method, pattern))
+	}
+	n.handlers[method] = rt
+}
+
+// Handler dispatches the request, it's meant to be passed to server.Serve.
+// Unknown paths get 404, known paths with an unregistered method get 405 with the Allow header.
+func (r *Router) Handler(res *response.Response, req *request.Request) *server.HandlerError {
+	params := map[string]string{}
+	n := r.root.match(pathSegments(req.URL.RawPath), params)
+	if n == nil {
+		return r.Routes.wrap(notFound)(res, req)
+	}
+
+	rt, ok := n.handlers[req.RequestLine.Method]
+	if !ok {
+		return r.Routes.wrap(methodNotAllowed(n.methods()))(res, req)
+	}
+
+	for k, v := range params {
+		req.SetPathValue(k, v)
+	}
+	return rt.group.wrap(rt.handler)(res, req)
+}
+
+func notFound(res *response.Response, req *request.Request) *server.HandlerError {
+	return &server.HandlerError{StatusCode: &response.NOT_FOUND, Message: []byte("Not Found")}
+}
+
+func methodNotAllowed(methods []string) server.Handler {
+	return func(res *response.Response, req *request.Request) *server.HandlerError {
+		allow := headers.NewHeaders()
+		allow.Set("Allow", strings.Join(methods, ", "))
+		return &server.HandlerError{StatusCode: &response.METHOD_NOT_ALLOWED, Message: []byte("Method Not Allowed"), Headers: allow}
+	}
+}
+
+// match walks the tree with backtracking, so a static segment that leads to a dead end
+// still lets a parameter or a wildcard match the same path
+func (n *node) match(segments []string, params map[string]string) *node {
+	if len(segments) == 0 {
+		if len(n.handlers) > 0 {
+			return n
+		}
+		// "/static/*" matches "/static" too
+		if n.wildcard != nil {
+			params[WILDCARD] = ""
+			return n.wildcard
+		}
+		return nil
+	}
+
+	seg := segments[0]
+	if child, ok := n.static[seg]; ok {
+		if found := child.match(segments[1:], params); found != nil {
+			return found
+		}
+	}
+	if n.param != nil {
+		if found := n.param.match(segments[1:], params); found != nil {
+			params[n.param.name] = seg
+			return found
+		}
+	}
+	if n.wildcard != nil {
+		params[WILDCARD] = strings.Join(segments, "/")
+		return n.wildcard
+	}
+	return nil
+}
+
+func (n *node) methods() []string {
+	methods := make([]string, 0, len(n.handlers))
+	for m := range n.handlers {
+		methods = append(methods, m)
+	}
+	slices.Sort(methods)
+	return methods
+}
+
+func splitPath(path string) []string {
+	segments := []string{}
+	for _, seg := range strings.Split(path, "/") {
+		if seg != "" {
+			segments = append(segments, seg)
+		}
+	}
+	return segments
+}
+
+// pathSegments splits the path as sent by the client and decodes each segment,
+// so that an encoded slash ("%2F") stays inside its segment
+func pathSegments(rawPath string) []string {
+	segments := splitPath(rawPath)
+	for i, seg := range segments {
+		if decoded, err := request.PathUnescape(seg); err == nil {
+			segments[i] = decoded
+		}
+	}
+	return segments
+}
+
+func joinPath(prefix, path string) string {
+	return "/" + strings.Join(append(splitPath(prefix), splitPath(path)...), "/")
+}
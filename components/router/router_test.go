@@ -0,0 +1,176 @@
+package router
+
+import (
+	"bytes"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(t *testing.T, method, target string) *request.Request {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+// reply writes the name of the matched route and its path values
+func reply(name string, params ...string) server.Handler {
+	return func(res *response.Response, req *request.Request) *server.HandlerError {
+		body := name
+		for _, p := range params {
+			body += " " + p + "=" + req.PathValue(p)
+		}
+		res.WriteResponse(&response.OK, nil, []byte(body))
+		return nil
+	}
+}
+
+func serve(t *testing.T, r *Router, method, target string) (string, *server.HandlerError) {
+	t.Helper()
+	var buf bytes.Buffer
+	hErr := r.Handler(&response.Response{Writer: &buf}, newRequest(t, method, target))
+	if hErr != nil {
+		return "", hErr
+	}
+	out := buf.String()
+	return out[strings.Index(out, "\r\n\r\n")+4:], nil
+}
+
+func TestRouter(t *testing.T) {
+	r := New()
+	r.GET("/", reply("index"))
+	r.GET("/users", reply("list"))
+	r.POST("/users", reply("create"))
+	r.GET("/users/{id}", reply("show", "id"))
+	r.DELETE("/users/{id}", reply("delete", "id"))
+	r.GET("/users/me", reply("me"))
+	r.GET("/users/{id}/posts/{post}", reply("post", "id", "post"))
+	r.GET("/static/*", reply("static", "*"))
+
+	api := r.Group("/api")
+	v1 := api.Group("v1/")
+	v1.GET("/status", reply("status"))
+
+	tests := []struct {
+		method, target, body string
+	}{
+		{"GET", "/", "index"},
+		{"GET", "/users", "list"},
+		{"GET", "/users/", "list"},
+		{"POST", "/users", "create"},
+		{"GET", "/users/42", "show id=42"},
+		{"DELETE", "/users/42", "delete id=42"},
+		{"GET", "/users/me", "me"},
+		{"GET", "/users/7/posts/hello", "post id=7 post=hello"},
+		{"GET", "/static/css/site.css", "static *=css/site.css"},
+		{"GET", "/static", "static *="},
+		{"GET", "/api/v1/status", "status"},
+		{"GET", "/users?page=2", "list"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			body, hErr := serve(t, r, tt.method, tt.target)
+			require.Nil(t, hErr)
+			assert.Equal(t, tt.body, body)
+		})
+	}
+
+	t.Run("should return 404 for unknown paths", func(t *testing.T) {
+		_, hErr := serve(t, r, "GET", "/nothing")
+		require.NotNil(t, hErr)
+		assert.Equal(t, response.NOT_FOUND, *hErr.StatusCode)
+
+		_, hErr = serve(t, r, "GET", "/users/7/comments")
+		require.NotNil(t, hErr)
+		assert.Equal(t, response.NOT_FOUND, *hErr.StatusCode)
+	})
+
+	t.Run("should keep an encoded slash inside a parameter", func(t *testing.T) {
+		body, hErr := serve(t, r, "GET", "/users/a%2Fb")
+		require.Nil(t, hErr)
+		assert.Equal(t, "show id=a/b", body)
+
+		body, hErr = serve(t, r, "GET", "/users/caf%C3%A9/posts/x%20y")
+		require.Nil(t, hErr)
+		assert.Equal(t, "post id=café post=x y", body)
+
+		// a single escaped segment can't fill two parameters
+		body, hErr = serve(t, r, "GET", "/users/7%2Fposts%2Fhello")
+		require.Nil(t, hErr)
+		assert.Equal(t, "show id=7/posts/hello", body)
+	})
+
+	t.Run("should return 405 with Allow when only the method doesn't match", func(t *testing.T) {
+		_, hErr := serve(t, r, "PUT", "/users/42")
+		require.NotNil(t, hErr)
+		assert.Equal(t, response.METHOD_NOT_ALLOWED, *hErr.StatusCode)
+		assert.Equal(t, "DELETE, GET", hErr.Headers.Get("Allow"))
+	})
+
+	t.Run("should panic on invalid routes", func(t *testing.T) {
+		assert.Panics(t, func() { r.GET("/users", reply("again")) })
+		assert.Panics(t, func() { r.GET("/users/{name}/x", reply("conflict")) })
+		assert.Panics(t, func() { r.GET("/files/*/x", reply("wildcard")) })
+	})
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	var calls []string
+	trace := func(name string) server.Middleware {
+		return func(next server.Handler) server.Handler {
+			return func(res *response.Response, req *request.Request) *server.HandlerError {
+				calls = append(calls, name)
+				return next(res, req)
+			}
+		}
+	}
+	auth := func(next server.Handler) server.Handler {
+		return func(res *response.Response, req *request.Request) *server.HandlerError {
+			if req.Headers.Get("Authorization") == "" {
+				return &server.HandlerError{StatusCode: &response.BAD_REQUEST, Message: []byte("missing credentials")}
+			}
+			return next(res, req)
+		}
+	}
+
+	r := New()
+	r.GET("/public", reply("public"))
+	admin := r.Group("/admin", trace("admin"))
+	admin.GET("/stats", reply("stats"), trace("route"))
+	admin.GET("/secret", reply("secret"), auth)
+	r.Use(trace("global"))
+
+	t.Run("should run router, group and route middlewares in order", func(t *testing.T) {
+		calls = nil
+		body, hErr := serve(t, r, "GET", "/admin/stats")
+		require.Nil(t, hErr)
+		assert.Equal(t, "stats", body)
+		assert.Equal(t, []string{"global", "admin", "route"}, calls)
+	})
+
+	t.Run("should not run group middlewares outside the group", func(t *testing.T) {
+		calls = nil
+		_, hErr := serve(t, r, "GET", "/public")
+		require.Nil(t, hErr)
+		assert.Equal(t, []string{"global"}, calls)
+	})
+
+	t.Run("should short-circuit with a HandlerError", func(t *testing.T) {
+		_, hErr := serve(t, r, "GET", "/admin/secret")
+		require.NotNil(t, hErr)
+		assert.Equal(t, response.BAD_REQUEST, *hErr.StatusCode)
+	})
+
+	t.Run("should wrap not found with router middlewares", func(t *testing.T) {
+		calls = nil
+		_, hErr := serve(t, r, "GET", "/missing")
+		require.NotNil(t, hErr)
+		assert.Equal(t, []string{"global"}, calls)
+	})
+}
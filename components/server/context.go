@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is the cause of the request contexts cancelled by Shutdown or Close
+var ErrServerClosed = errors.New("server closed")
+
+// ErrClientGone is the cause of the request contexts cancelled when the client closes the connection
+var ErrClientGone = errors.New("client closed the connection")
+
+// WithRequestTimeout sets a deadline on the context of each request, d after its header section is read.
+// The handler stops by watching req.Context(), the connection itself is bounded by WithReadTimeout
+// and WithWriteTimeout. A zero value disables the deadline.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.requestTimeout = d
+	}
+}
+
+// requestContext derives the context of a request from parent (the connection or the HTTP/2 stream)
+func (s *Server) requestContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if s.requestTimeout > 0 {
+		return context.WithTimeout(parent, s.requestTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// connReader reads an HTTP/1.x connection. Once the request body has been read, it keeps reading
+// in the background while the handler runs to notice the client closing the connection.
+type connReader struct {
+	conn net.Conn
+	r    io.Reader
+
+	mu       sync.Mutex
+	watching chan struct{} // closed when the background read returns, nil when there is none
+	stopping bool
+	// bytes received by the background read (e.g. a pipelined request), returned by the next Read
+	pending []byte
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	cr.stopWatch()
+	if len(cr.pending) > 0 {
+		n := copy(p, cr.pending)
+		cr.pending = cr.pending[n:]
+		return n, nil
+	}
+	return cr.r.Read(p)
+}
+
+// watch starts the background read, gone is called when the client closes the connection
+func (cr *connReader) watch(gone func()) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.watching != nil || len(cr.pending) > 0 {
+		// the next request already started, the client is still there
+		return
+	}
+	// the read timeout covers the request, not the wait for the end of the response
+	cr.conn.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	cr.watching = done
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1)
+		n, err := cr.r.Read(buf)
+		cr.mu.Lock()
+		defer cr.mu.Unlock()
+		cr.pending = buf[:n]
+		if n == 0 && err != nil && !cr.stopping {
+			gone()
+		}
+	}()
+}
+
+// stopWatch interrupts the background read and waits for it to return
+func (cr *connReader) stopWatch() {
+	cr.mu.Lock()
+	done := cr.watching
+	if done == nil {
+		cr.mu.Unlock()
+		return
+	}
+	cr.stopping = true
+	cr.mu.Unlock()
+
+	cr.conn.SetReadDeadline(time.Unix(1, 0))
+	<-done
+	cr.conn.SetReadDeadline(time.Time{})
+
+	cr.mu.Lock()
+	cr.watching = nil
+	cr.stopping = false
+	cr.mu.Unlock()
+}
+
+// watchedBody starts watching the connection when the handler has read the whole request body
+type watchedBody struct {
+	io.ReadCloser
+	onEOF func()
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.onEOF()
+	}
+	return n, err
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"http/components/http2"
+	"http/components/request"
+	"http/components/response"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitCause starts a handler that waits for the cancellation of the request context and reports its cause
+func waitCause(t *testing.T, opts ...Option) (*Server, chan error) {
+	causes := make(chan error, 1)
+	s := startServer(t, func(res *response.Response, req *request.Request) *HandlerError {
+		io.Copy(io.Discard, req.Body)
+		select {
+		case <-req.Context().Done():
+			causes <- context.Cause(req.Context())
+		case <-time.After(3 * time.Second):
+			causes <- nil
+		}
+		res.Write([]byte("stopped"))
+		return nil
+	}, opts...)
+	return s, causes
+}
+
+func TestRequestContext(t *testing.T) {
+	t.Run("client disconnect", func(t *testing.T) {
+		s, causes := waitCause(t)
+		conn := dial(t, s)
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\n\r\n")
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+		assert.ErrorIs(t, <-causes, ErrClientGone)
+	})
+
+	t.Run("client disconnect after the body", func(t *testing.T) {
+		s, causes := waitCause(t)
+		conn := dial(t, s)
+		fmt.Fprint(conn, "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+		assert.ErrorIs(t, <-causes, ErrClientGone)
+	})
+
+	t.Run("server shutdown", func(t *testing.T) {
+		s, causes := waitCause(t)
+		conn := dial(t, s)
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\n\r\n")
+		time.Sleep(50 * time.Millisecond)
+
+		require.NoError(t, s.Shutdown(context.Background()))
+		assert.ErrorIs(t, <-causes, ErrServerClosed)
+		// the handler still completes its response
+		status, _, body := readResponse(t, bufio.NewReader(conn))
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+		assert.Equal(t, "stopped", body)
+	})
+
+	t.Run("request timeout", func(t *testing.T) {
+		s, causes := waitCause(t, WithRequestTimeout(50*time.Millisecond))
+		conn := dial(t, s)
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\n\r\n")
+		assert.ErrorIs(t, <-causes, context.DeadlineExceeded)
+		status, _, _ := readResponse(t, bufio.NewReader(conn))
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+	})
+
+	t.Run("pipelined requests", func(t *testing.T) {
+		contexts := make(chan context.Context, 2)
+		s := startServer(t, func(res *response.Response, req *request.Request) *HandlerError {
+			// the second request arrives while the first one is served
+			time.Sleep(50 * time.Millisecond)
+			contexts <- req.Context()
+			res.Write([]byte(fmt.Sprint(req.Context().Err())))
+			return nil
+		})
+		conn := dial(t, s)
+		fmt.Fprint(conn, "GET /1 HTTP/1.1\r\n\r\nGET /2 HTTP/1.1\r\n\r\n")
+		br := bufio.NewReader(conn)
+		for range 2 {
+			_, _, body := readResponse(t, br)
+			assert.Equal(t, "<nil>", body)
+		}
+		// the context ends with its request
+		assert.ErrorIs(t, (<-contexts).Err(), context.Canceled)
+	})
+
+	t.Run("values set by a middleware", func(t *testing.T) {
+		auth := func(next Handler) Handler {
+			return func(res *response.Response, req *request.Request) *HandlerError {
+				req.SetID("req-42")
+				req.SetUser("alice")
+				return next(res, req)
+			}
+		}
+		s := startServer(t, auth(func(res *response.Response, req *request.Request) *HandlerError {
+			res.Write([]byte(fmt.Sprintf("%s %v", request.IDFromContext(req.Context()), req.User())))
+			return nil
+		}))
+		conn := dial(t, s)
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\n\r\n")
+		_, _, body := readResponse(t, bufio.NewReader(conn))
+		assert.Equal(t, "req-42 alice", body)
+	})
+
+	t.Run("HTTP/2 stream reset", func(t *testing.T) {
+		s, causes := waitCause(t)
+		conn := dial(t, s)
+		c := newH2Client(t, conn, bufio.NewReader(conn))
+		c.get(1, "/")
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, http2.WriteFrame(conn, http2.RSTStreamFrame(1, http2.ErrCodeCancel)))
+		assert.ErrorIs(t, <-causes, http2.ErrStreamReset)
+	})
+
+	t.Run("HTTP/2 connection closed", func(t *testing.T) {
+		s, causes := waitCause(t)
+		conn := dial(t, s)
+		c := newH2Client(t, conn, bufio.NewReader(conn))
+		c.get(1, "/")
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+		assert.ErrorIs(t, <-causes, http2.ErrConnClosed)
+	})
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"http/components/headers"
+	"http/components/http2"
+	"http/components/request"
+	"http/components/response"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// WithoutHTTP2 serves only HTTP/1.1: h2 isn't offered with ALPN, "Upgrade: h2c" is ignored
+// and the HTTP/2 preface is parsed as a request
+func WithoutHTTP2() Option {
+	return func(s *Server) {
+		s.noHTTP2 = true
+	}
+}
+
+// WithMaxConcurrentStreams bounds the streams a client can open on an HTTP/2 connection
+// (http2.DEFAULT_MAX_CONCURRENT_STREAMS by default)
+func WithMaxConcurrentStreams(n uint32) Option {
+	return func(s *Server) {
+		s.h2streams = n
+	}
+}
+
+// newHTTP2Conn prepares an HTTP/2 connection whose streams are served by the handler like HTTP/1.1 requests
+func (s *Server) newHTTP2Conn(conn net.Conn, rd io.Reader, tlsState *tls.ConnectionState) *http2.ServerConn {
+	config := http2.Config{
+		MaxConcurrentStreams: s.h2streams,
+		Limits:               s.limits,
+		PrefaceTimeout:       s.headerTimeout(),
+		IdleTimeout:          s.idleTimeout,
+		WriteTimeout:         s.writeTimeout,
+		Context:              s.ctx,
+	}
+	return http2.NewServerConn(conn, rd, config, func(resp *response.Response, req *request.Request) {
+		req.TLS = tlsState
+		req.RemoteAddr = conn.RemoteAddr().String()
+		ctx, cancel := s.requestContext(req.Context())
+		defer cancel()
+		req.SetContext(ctx)
+		hErr, panicked := s.serve(resp, req)
+		if panicked {
+			// the stream is reset when the response is incomplete
+			return
+		}
+		s.finish(resp, req, hErr, req.Body.Close())
+	})
+}
+
+// serveHTTP2 serves the connection until the client closes it, an error occurs or Shutdown sends GOAWAY
+func (s *Server) serveHTTP2(conn net.Conn, sc *http2.ServerConn) {
+	conn.SetDeadline(time.Time{})
+	s.mu.Lock()
+	s.conns[conn] = connActive
+	s.h2conns[conn] = sc
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.h2conns, conn)
+		s.mu.Unlock()
+	}()
+	if s.closed.Load() {
+		sc.Shutdown()
+	}
+
+	if err := sc.Serve(); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		logClose(conn, "HTTP/2 connection", err)
+	}
+}
+
+// upgradeHTTP2 switches the connection to HTTP/2, the request becomes the stream 1 (RFC 7540 section 3.2)
+func (s *Server) upgradeHTTP2(conn net.Conn, reader *request.Reader, resp *response.Response, req *request.Request) {
+	// the client preface and the first frames may be already buffered
+	sc := s.newHTTP2Conn(conn, io.MultiReader(bytes.NewReader(reader.Buffered()), conn), nil)
+	if err := sc.Upgrade(req, req.Headers.Get("HTTP2-Settings")); err != nil {
+		s.writeError(conn, resp, &HandlerError{StatusCode: &response.BAD_REQUEST, Message: []byte(err.Error())})
+		return
+	}
+	resp.Header().Set("Upgrade", http2.H2C_PROTOCOL)
+	resp.Header().Set(headers.CONNECTION, "Upgrade")
+	err := resp.WriteStatusLine(&response.SWITCHING_PROTOCOLS)
+	if err == nil {
+		err = resp.WriteHeaders(resp.Header())
+	}
+	if err != nil {
+		logClose(conn, "write error", err)
+		return
+	}
+	slog.Info("Connection upgraded", "addr", conn.RemoteAddr(), "protocol", http2.H2C_PROTOCOL)
+	s.serveHTTP2(conn, sc)
+}
+
+// isH2CUpgrade reports whether the request asks to switch to cleartext HTTP/2. Requests with a body
+// are served with HTTP/1.1, the body would have to be read before the switch.
+func isH2CUpgrade(req *request.Request) bool {
+	return req.Headers.HasToken("Upgrade", http2.H2C_PROTOCOL) &&
+		req.Headers.HasToken(headers.CONNECTION, "upgrade") &&
+		req.Headers.HasToken(headers.CONNECTION, "http2-settings") &&
+		len(req.Headers.Values("HTTP2-Settings")) == 1 &&
+		req.Body == request.NoBody
+}
+
+// sniffPreface reads the first bytes of a cleartext connection until they differ from the HTTP/2 preface
+// or the whole preface is received. The bytes read are returned so an HTTP/1.1 request can be parsed.
+func sniffPreface(conn net.Conn) ([]byte, bool, error) {
+	buf := make([]byte, len(http2.CLIENT_PREFACE))
+	n := 0
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if !bytes.HasPrefix([]byte(http2.CLIENT_PREFACE), buf[:n]) {
+			return buf[:n], false, nil
+		}
+		if err != nil {
+			return buf[:n], false, err
+		}
+	}
+	return buf, true, nil
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"http/components/headers"
+	"http/components/http2"
+	"http/components/request"
+	"http/components/response"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type h2Client struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	enc  *http2.Encoder
+	dec  *http2.Decoder
+}
+
+type h2Response struct {
+	status   string
+	header   map[string]string
+	body     string
+	trailers map[string]string
+	frames   []http2.FrameType
+}
+
+// newH2Client sends the client preface, br holds what the server has already sent (e.g. after a 101)
+func newH2Client(t *testing.T, conn net.Conn, br *bufio.Reader) *h2Client {
+	t.Helper()
+	_, err := io.WriteString(conn, http2.CLIENT_PREFACE)
+	require.NoError(t, err)
+	require.NoError(t, http2.WriteFrame(conn, http2.SettingsFrame()))
+	return &h2Client{t: t, conn: conn, br: br, enc: http2.NewEncoder(), dec: http2.NewDecoder(http2.DEFAULT_HEADER_TABLE_SIZE)}
+}
+
+func (c *h2Client) get(id uint32, path string) {
+	block := c.enc.Encode([]http2.HeaderField{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: path}, {Name: ":authority", Value: "localhost"}})
+	require.NoError(c.t, http2.WriteFrame(c.conn, &http2.Frame{Type: http2.FrameHeaders, Flags: http2.FlagEndHeaders | http2.FlagEndStream, StreamID: id, Payload: block}))
+}
+
+func (c *h2Client) read() *http2.Frame {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f, err := http2.ReadFrame(c.br, http2.MAX_FRAME_SIZE_LIMIT)
+	require.NoError(c.t, err)
+	if f.Type == http2.FrameSettings && !f.Has(http2.FlagAck) {
+		require.NoError(c.t, http2.WriteFrame(c.conn, &http2.Frame{Type: http2.FrameSettings, Flags: http2.FlagAck}))
+	}
+	return f
+}
+
+// response reads the frames of stream id until END_STREAM, the frames of the connection are skipped
+func (c *h2Client) response(id uint32) *h2Response {
+	c.t.Helper()
+	res := &h2Response{header: map[string]string{}, trailers: map[string]string{}}
+	for {
+		f := c.read()
+		if f.StreamID != id {
+			continue
+		}
+		res.frames = append(res.frames, f.Type)
+		switch f.Type {
+		case http2.FrameHeaders:
+			block, err := f.HeaderBlock()
+			require.NoError(c.t, err)
+			fields, err := c.dec.Decode(block)
+			require.NoError(c.t, err)
+			dst := res.header
+			if res.status != "" {
+				dst = res.trailers
+			}
+			for _, field := range fields {
+				if field.Name == ":status" {
+					res.status = field.Value
+				} else {
+					dst[field.Name] = field.Value
+				}
+			}
+		case http2.FrameData:
+			data, err := f.Data()
+			require.NoError(c.t, err)
+			res.body += string(data)
+		case http2.FrameRSTStream:
+			c.t.Fatalf("stream %d reset: %v", id, f.ErrorCode())
+		}
+		if f.Has(http2.FlagEndStream) {
+			return res
+		}
+	}
+}
+
+// h2Handler serves /chunked as a streamed body with a trailer, /proto tells the protocol of the request
+func h2Handler(res *response.Response, req *request.Request) *HandlerError {
+	switch req.URL.Path {
+	case "/chunked":
+		res.Header().Set(headers.TRAILER, "x-count")
+		res.Flush()
+		for i := range 3 {
+			res.Write([]byte(fmt.Sprintf("chunk %d;", i)))
+		}
+		res.Trailer().Set("X-Count", "3")
+	case "/proto":
+		res.Write([]byte(fmt.Sprintf("HTTP/%s tls=%t", req.RequestLine.HttpVersion, req.TLS != nil)))
+	case "/panic":
+		panic("boom")
+	default:
+		return &HandlerError{StatusCode: &response.NOT_FOUND, Message: []byte("nothing here")}
+	}
+	return nil
+}
+
+func TestHTTP2PriorKnowledge(t *testing.T) {
+	s := startServer(t, h2Handler)
+	conn := dial(t, s)
+	c := newH2Client(t, conn, bufio.NewReader(conn))
+
+	c.get(1, "/chunked")
+	res := c.response(1)
+	assert.Equal(t, "200", res.status)
+	assert.Equal(t, "chunk 0;chunk 1;chunk 2;", res.body)
+	assert.Equal(t, map[string]string{"x-count": "3"}, res.trailers)
+	assert.Equal(t, []http2.FrameType{http2.FrameHeaders, http2.FrameData, http2.FrameData, http2.FrameData, http2.FrameHeaders}, res.frames)
+
+	c.get(3, "/missing")
+	res = c.response(3)
+	assert.Equal(t, "404", res.status)
+	assert.Contains(t, res.body, "nothing here")
+
+	c.get(5, "/panic")
+	assert.Equal(t, "500", c.response(5).status)
+
+	// the connection is still usable after the panic
+	c.get(7, "/proto")
+	assert.Equal(t, "HTTP/2.0 tls=false", c.response(7).body)
+}
+
+func TestHTTP2Upgrade(t *testing.T) {
+	s := startServer(t, h2Handler)
+	conn := dial(t, s)
+
+	settings := base64.RawURLEncoding.EncodeToString(http2.SettingsFrame(http2.Setting{ID: http2.SettingMaxFrameSize, Value: 1 << 15}).Payload)
+	fmt.Fprintf(conn, "GET /chunked HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: %s\r\n\r\n", settings)
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	// the upgrade request is the stream 1
+	c := newH2Client(t, conn, br)
+	res := c.response(1)
+	assert.Equal(t, "chunk 0;chunk 1;chunk 2;", res.body)
+	assert.Equal(t, "3", res.trailers["x-count"])
+
+	c.get(3, "/proto")
+	assert.Equal(t, "HTTP/2.0 tls=false", c.response(3).body)
+}
+
+func TestHTTP2UpgradeIgnored(t *testing.T) {
+	s := startServer(t, h2Handler)
+	conn := dial(t, s)
+
+	// a request with a body stays on HTTP/1.1
+	fmt.Fprint(conn, "POST /proto HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\nContent-Length: 2\r\n\r\nhi")
+	status, _, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 200 OK", status)
+	assert.Equal(t, "HTTP/1.1 tls=false", body)
+}
+
+func TestHTTP2ALPN(t *testing.T) {
+	certFile, keyFile, cert := writeCert(t, t.TempDir(), "localhost", 1, "localhost")
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	s, err := ServeTLS(0, certFile, keyFile, h2Handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost", NextProtos: []string{"h2", "http/1.1"}})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	assert.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+
+	c := newH2Client(t, conn, bufio.NewReader(conn))
+	c.get(1, "/proto")
+	assert.Equal(t, "HTTP/2.0 tls=true", c.response(1).body)
+
+	// clients without ALPN get HTTP/1.1
+	h1, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	require.NoError(t, err)
+	t.Cleanup(func() { h1.Close() })
+	assert.Empty(t, h1.ConnectionState().NegotiatedProtocol)
+	fmt.Fprint(h1, "GET /proto HTTP/1.1\r\nConnection: close\r\n\r\n")
+	_, _, body := readResponse(t, bufio.NewReader(h1))
+	assert.Equal(t, "HTTP/1.1 tls=true", body)
+}
+
+func TestWithoutHTTP2(t *testing.T) {
+	s := startServer(t, h2Handler, WithoutHTTP2())
+	conn := dial(t, s)
+
+	// the preface is not a valid HTTP/1.1 request
+	io.WriteString(conn, http2.CLIENT_PREFACE)
+	status, _, _ := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 400 Bad Request", status)
+}
+
+func TestHTTP2Shutdown(t *testing.T) {
+	release := make(chan struct{})
+	s := startServer(t, func(res *response.Response, req *request.Request) *HandlerError {
+		<-release
+		res.Write([]byte("done"))
+		return nil
+	})
+	conn := dial(t, s)
+	c := newH2Client(t, conn, bufio.NewReader(conn))
+	c.get(1, "/")
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+
+	f := c.read()
+	for f.Type != http2.FrameGoAway {
+		f = c.read()
+	}
+	assert.Equal(t, uint32(1), f.LastStreamID())
+
+	// the open stream completes before the server stops
+	close(release)
+	assert.Equal(t, "done", c.response(1).body)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown didn't return")
+	}
+}
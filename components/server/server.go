@@ -1,24 +1,53 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"http/components/headers"
+	"http/components/http2"
 	"http/components/request"
 	"http/components/response"
-	"log"
+	"io"
 	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Handler func(res *response.Response, req *request.Request) *HandlerError
+
+// Middleware wraps a Handler with cross-cutting logic (logging, auth, ...).
+// It can short-circuit the chain returning a *HandlerError without calling next.
+type Middleware func(next Handler) Handler
+
+// Chain composes middlewares, the first one is the outermost:
+// Chain(a, b)(h) is equivalent to a(b(h))
+func Chain(mws ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			next = mws[i](next)
+		}
+		return next
+	}
+}
+
 type HandlerError struct {
 	StatusCode *response.StatusCode
 	Message    []byte
+	// Headers are added to the error response (e.g. Allow for 405)
+	Headers *headers.Headers
 }
 
-func (he *HandlerError) Write(res *response.Response) {
+func (he *HandlerError) Write(res *response.Response) error {
 	var (
 		body           []byte
 		currentHeaders *headers.Headers
@@ -35,41 +64,261 @@ func (he *HandlerError) Write(res *response.Response) {
 	} else {
 		body = fmt.Appendf(nil, "{\"statusCode\":%d, \"errorMessage\":\"%s\"}\n", he.StatusCode.Code, he.Message)
 	}
-	res.Write(he.StatusCode, currentHeaders, body)
+	if he.Headers != nil {
+		if currentHeaders == nil {
+			currentHeaders = response.GetDefaultHeaders(len(body))
+		}
+		// fields of the error replace the default ones, keeping all their values
+		replaced := map[string]bool{}
+		he.Headers.ForEach(func(k, v string) {
+			if !replaced[k] {
+				currentHeaders.Del(k)
+				replaced[k] = true
+			}
+			currentHeaders.Add(k, v)
+		})
+	}
+	return res.WriteResponse(he.StatusCode, currentHeaders, body)
 }
 
+// Idle connections are closed when the next request doesn't arrive within this time
+const DEFAULT_IDLE_TIMEOUT = 60 * time.Second
+
+// Request line and headers must be received within this time (slowloris protection)
+const DEFAULT_READ_HEADER_TIMEOUT = 10 * time.Second
+
+// Accept errors are retried with an exponential backoff between these durations
+const (
+	ACCEPT_MIN_BACKOFF = 5 * time.Millisecond
+	ACCEPT_MAX_BACKOFF = 1 * time.Second
+)
+
+// Shutdown checks the state of the connections with this interval
+const SHUTDOWN_POLL_INTERVAL = 10 * time.Millisecond
+
+type connState string
+
+const (
+	// waiting for the next request (or for the first one)
+	connIdle connState = "idle"
+	// serving a request
+	connActive connState = "active"
+)
+
 type Server struct {
-	closed   bool
-	listener net.Listener
-	handler  Handler
+	closed     atomic.Bool
+	mu         sync.Mutex
+	conns      map[net.Conn]connState
+	listener   net.Listener
+	handler    Handler
+	tlsConfig  *tls.Config
+	clientAuth tls.ClientAuthType
+	clientCAs  *x509.CertPool
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+
+	limits         request.Limits
+	strict         bool
+	requestTimeout time.Duration
+
+	// parent of the request contexts, cancelled by Shutdown and Close
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	// HTTP/2 connections, they are shut down with GOAWAY
+	h2conns   map[net.Conn]*http2.ServerConn
+	noHTTP2   bool
+	h2streams uint32
+
+	// invalid option, returned by Serve
+	optErr error
 }
 
-func Serve(port uint16, handler Handler) (*Server, error) {
-	server := &Server{closed: false, handler: handler}
+type Option func(*Server)
+
+// WithIdleTimeout sets how long a keep-alive connection waits for the next request.
+// A zero value disables the timeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// WithReadHeaderTimeout sets how long the client can take to send the request line and headers,
+// the connection gets 408 Request Timeout when it expires. A zero value uses the read timeout.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readHeaderTimeout = d
+	}
+}
+
+// WithReadTimeout sets the maximum duration for reading the entire request, body included.
+// A zero value disables the timeout.
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readTimeout = d
+	}
+}
+
+// WithWriteTimeout sets the maximum duration for writing the response, counted once the request headers are read.
+// A zero value disables the timeout.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithLimits bounds request line, headers and body size (request.DefaultLimits by default)
+func WithLimits(limits request.Limits) Option {
+	return func(s *Server) {
+		s.limits = limits
+	}
+}
+
+// WithStrictParsing rejects with 400 every ambiguous request (duplicated Content-Length,
+// Content-Length with Transfer-Encoding, missing Host, ...) instead of interpreting it safely
+func WithStrictParsing() Option {
+	return func(s *Server) {
+		s.strict = true
+	}
+}
+
+func Serve(port uint16, handler Handler, opts ...Option) (*Server, error) {
+	server := &Server{
+		handler:           handler,
+		idleTimeout:       DEFAULT_IDLE_TIMEOUT,
+		readHeaderTimeout: DEFAULT_READ_HEADER_TIMEOUT,
+		limits:            request.DefaultLimits,
+		conns:             map[net.Conn]connState{},
+		h2conns:           map[net.Conn]*http2.ServerConn{},
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
+	if server.optErr != nil {
+		return nil, server.optErr
+	}
+	server.ctx, server.cancel = context.WithCancelCause(context.Background())
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	if server.tlsConfig != nil {
+		listener = tls.NewListener(listener, server.buildTLSConfig())
+	}
 	server.listener = listener
 
 	go server.listen()
 
-	return server, err
+	return server, nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
 }
 
+// Close stops the server immediately, closing the listener and every connection
 func (s *Server) Close() error {
-	s.closed = true
-	return s.listener.Close()
+	s.closed.Store(true)
+	s.cancel(ErrServerClosed)
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+	return err
+}
+
+// Shutdown stops accepting connections, closes the idle ones and waits for the active ones
+// to finish their current response. The request contexts are cancelled so that long running
+// handlers (e.g. streams) can stop. When ctx expires the remaining connections are closed
+// and the ctx error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closed.Store(true)
+	s.cancel(ErrServerClosed)
+	err := s.listener.Close()
+
+	ticker := time.NewTicker(SHUTDOWN_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdleConns returns the number of connections still active
+func (s *Server) closeIdleConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, sc := range s.h2conns {
+		// GOAWAY is sent once, the connection is closed when its open streams end
+		go sc.Shutdown()
+		delete(s.h2conns, conn)
+	}
+	for conn, state := range s.conns {
+		if state == connIdle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns)
+}
+
+// setConnState tracks the connection, it returns false when the server is shutting down and the
+// connection must not be used anymore: it can't become idle, nor active once Shutdown has closed it
+func (s *Server) setConnState(conn net.Conn, state connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, tracked := s.conns[conn]; s.closed.Load() && (state == connIdle || !tracked) {
+		return false
+	}
+	s.conns[conn] = state
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
 }
 
 func (s *Server) listen() {
+	var backoff time.Duration
 	for {
 		conn, err := s.listener.Accept()
-		if s.closed {
+		if s.closed.Load() || errors.Is(err, net.ErrClosed) {
+			if conn != nil {
+				conn.Close()
+			}
 			fmt.Println("Server closed")
 			break
 		} else if err != nil {
-			log.Fatal("Connection Error: ", err)
+			// e.g. EMFILE (too many open files): wait for some connection to be released and retry
+			if backoff == 0 {
+				backoff = ACCEPT_MIN_BACKOFF
+			} else {
+				backoff = min(backoff*2, ACCEPT_MAX_BACKOFF)
+			}
+			slog.Warn("Accept error, retrying", "err", err, "backoff", backoff)
+			time.Sleep(backoff)
 			continue
 		}
+		backoff = 0
 
 		slog.Info("New clinet", "addr", conn.RemoteAddr())
 
@@ -77,26 +326,297 @@ func (s *Server) listen() {
 	}
 }
 
+// handle serves the requests of a single connection until the client or the handler
+// asks to close it, or until a timeout expires
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+	// a hijacked connection belongs to the handler
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			conn.Close()
+		}
+	}()
+	defer s.untrackConn(conn)
 
-	resp := &response.Response{Writer: conn}
-	request, err := request.RequestFromReader(conn)
+	if !s.setConnState(conn, connIdle) {
+		return
+	}
 
-	if err != nil {
-		fmt.Printf("Request error: %v", err)
-		hErr := &HandlerError{
-			StatusCode: &response.BAD_REQUEST,
-			Message:    []byte(err.Error()),
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		setDeadline(conn.SetDeadline, s.headerTimeout())
+		if err := tlsConn.Handshake(); err != nil {
+			logClose(conn, "TLS handshake failed", err)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+		if state.NegotiatedProtocol == http2.ALPN_PROTOCOL {
+			s.serveHTTP2(conn, s.newHTTP2Conn(conn, conn, tlsState))
+			return
+		}
+	}
+
+	var rd io.Reader = conn
+	if tlsState == nil && !s.noHTTP2 {
+		// prior knowledge: the client starts with the HTTP/2 preface instead of a request
+		setDeadline(conn.SetReadDeadline, s.headerTimeout())
+		sniffed, h2, err := sniffPreface(conn)
+		if h2 {
+			s.serveHTTP2(conn, s.newHTTP2Conn(conn, io.MultiReader(bytes.NewReader(sniffed), conn), nil))
+			return
+		}
+		if err != nil && len(sniffed) == 0 {
+			if !errors.Is(err, io.EOF) {
+				logClose(conn, "read header timeout", err)
+			}
+			return
+		}
+		rd = io.MultiReader(bytes.NewReader(sniffed), conn)
+	}
+
+	connCtx, cancelConn := context.WithCancelCause(s.ctx)
+	defer cancelConn(nil)
+	cr := &connReader{conn: conn, r: rd}
+	reader := request.NewReader(cr)
+	reader.Limits = s.limits
+	reader.Strict = s.strict
+	writer := &connWriter{conn: conn}
+
+	for first := true; ; first = false {
+		// a new connection must send its first request within the header timeout,
+		// a keep-alive connection can wait idleTimeout for the next one
+		wait := s.idleTimeout
+		if first {
+			wait = s.headerTimeout()
+		}
+		setDeadline(conn.SetReadDeadline, wait)
+		if err := reader.WaitRequest(); err != nil {
+			// EOF: the client closed the connection, closed: idle connection closed by Shutdown
+			if !errors.Is(err, io.EOF) && !s.closed.Load() {
+				logClose(conn, "idle timeout", err)
+			}
+			return
+		}
+		// the request has started: Shutdown drains it instead of closing the connection
+		if !s.setConnState(conn, connActive) {
+			return
+		}
+
+		start := time.Now()
+		setDeadline(conn.SetReadDeadline, s.headerTimeout())
+		req, err := reader.ReadRequest()
+
+		resp := &response.Response{Writer: writer}
+
+		if err != nil {
+			if s.closed.Load() {
+				return
+			}
+			if isTimeout(err) {
+				logClose(conn, "read header timeout", err)
+				s.writeError(conn, resp, &HandlerError{StatusCode: &response.REQUEST_TIMEOUT})
+				return
+			}
+			fmt.Printf("Request error: %v", err)
+			hErr := &HandlerError{
+				StatusCode: requestErrorStatus(err),
+				Message:    []byte(err.Error()),
+			}
+			s.writeError(conn, resp, hErr)
+			return
+		}
+
+		// ReadTimeout covers the whole request (body included), WriteTimeout the response
+		conn.SetReadDeadline(time.Time{})
+		if s.readTimeout > 0 {
+			conn.SetReadDeadline(start.Add(s.readTimeout))
+		}
+		setDeadline(conn.SetWriteDeadline, s.writeTimeout)
+
+		req.TLS = tlsState
+		req.RemoteAddr = conn.RemoteAddr().String()
+		// during shutdown the current response is the last one
+		resp.KeepAlive = req.KeepAlive() && !s.closed.Load()
+		resp.Head = req.RequestLine.Method == "HEAD"
+		resp.RequestVersion = req.RequestLine.HttpVersion
+		resp.OnHijack = func() (net.Conn, *bufio.Reader, error) {
+			hijacked = true
+			s.untrackConn(conn)
+			cr.stopWatch()
+			conn.SetDeadline(time.Time{})
+			// bytes sent by the client after the request (e.g. the first WebSocket frames) come first
+			return conn, bufio.NewReader(io.MultiReader(bytes.NewReader(reader.Buffered()), cr)), nil
+		}
+
+		if tlsState == nil && !s.noHTTP2 && isH2CUpgrade(req) {
+			s.upgradeHTTP2(conn, reader, resp, req)
+			return
+		}
+
+		// the client going away is noticed once the body is read, the next bytes belong to another request
+		ctx, cancel := s.requestContext(connCtx)
+		req.SetContext(ctx)
+		gone := func() { cancelConn(ErrClientGone) }
+		if req.Body == request.NoBody {
+			cr.watch(gone)
+		} else {
+			req.Body = &watchedBody{ReadCloser: req.Body, onEOF: func() { cr.watch(gone) }}
+		}
+
+		hErr, panicked := s.serve(resp, req)
+		cr.stopWatch()
+		cancel()
+		if hijacked {
+			if hErr != nil {
+				slog.Error("Handler error after hijacking the connection", "status", hErr.StatusCode.Code, "message", string(hErr.Message))
+			}
+			return
+		}
+		if panicked {
+			// the state of the connection is unknown (unread body, partial response)
+			return
+		}
+
+		// the unread part of the body must be discarded before reading the next request
+		bodyErr := req.Body.Close()
+		s.finish(resp, req, hErr, bodyErr)
+		if resp.State() != response.ResponseDone {
+			// the client can't find the end of an incomplete response
+			resp.KeepAlive = false
+		}
+
+		if bodyErr != nil {
+			if isTimeout(bodyErr) {
+				logClose(conn, "read timeout", bodyErr)
+			} else {
+				logClose(conn, "request body error", bodyErr)
+			}
+			return
+		}
+		if writer.err != nil {
+			if isTimeout(writer.err) {
+				logClose(conn, "write timeout", writer.err)
+			} else {
+				logClose(conn, "write error", writer.err)
+			}
+			return
+		}
+		conn.SetWriteDeadline(time.Time{})
+
+		if !resp.KeepAlive || !s.setConnState(conn, connIdle) {
+			return
+		}
+	}
+}
+
+// serve runs the handler recovering from panics: the stack is logged and, when nothing
+// has been written yet, the client gets 500 Internal Server Error
+func (s *Server) serve(resp *response.Response, req *request.Request) (hErr *HandlerError, panicked bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			panicked = true
+			slog.Error("Handler panic", "method", req.RequestLine.Method, "target", req.RequestLine.RequestTarget, "panic", p, "stack", string(debug.Stack()))
+			if !resp.Started() {
+				resp.Reset()
+				resp.KeepAlive = false
+				(&HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR}).Write(resp)
+			}
+		}
+	}()
+	return s.handler(resp, req), false
+}
+
+// finish completes the response once the handler returns: an error is written as an error page
+// when nothing has been sent yet, otherwise the buffered body and the trailers are sent
+func (s *Server) finish(resp *response.Response, req *request.Request, hErr *HandlerError, bodyErr error) {
+	if hErr == nil {
+		if err := resp.Finish(); err != nil {
+			// buffered body, terminating chunk and trailers
+			slog.Error("Finishing response", "err", err)
 		}
-		hErr.Write(resp)
 		return
 	}
+	// the status comes from the body error, the headers of the error (e.g. a request ID) are kept
+	if isTimeout(bodyErr) {
+		hErr = &HandlerError{StatusCode: &response.REQUEST_TIMEOUT, Headers: hErr.Headers}
+	} else if errors.Is(bodyErr, request.ErrBodyTooLarge) {
+		hErr = &HandlerError{StatusCode: &response.CONTENT_TOO_LARGE, Message: []byte(bodyErr.Error()), Headers: hErr.Headers}
+	}
+	req.PrintRequest()
+	if resp.Started() {
+		// the status line is already on the wire, a second response would corrupt the stream
+		slog.Error("Handler error after the response started", "status", hErr.StatusCode.Code, "state", resp.State(), "message", string(hErr.Message))
+		resp.KeepAlive = false
+	} else {
+		// the body buffered by Write is replaced by the error page
+		resp.Reset()
+		if err := hErr.Write(resp); err != nil {
+			slog.Error("Writing error response", "err", err)
+		}
+	}
+}
+
+// writeError sends an error response to a request that didn't reach the handler
+func (s *Server) writeError(conn net.Conn, resp *response.Response, hErr *HandlerError) {
+	setDeadline(conn.SetWriteDeadline, s.writeTimeout)
+	hErr.Write(resp)
+}
+
+// requestErrorStatus maps the parser errors to the response status
+func requestErrorStatus(err error) *response.StatusCode {
+	switch {
+	case errors.Is(err, request.ErrRequestLineTooLong):
+		return &response.URI_TOO_LONG
+	case errors.Is(err, request.ErrHeadersTooLarge):
+		return &response.REQUEST_HEADER_FIELDS_TOO_LARGE
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return &response.CONTENT_TOO_LARGE
+	default:
+		return &response.BAD_REQUEST
+	}
+}
 
-	hErr := s.handler(resp, request)
+// headerTimeout falls back to readTimeout when readHeaderTimeout is not set
+func (s *Server) headerTimeout() time.Duration {
+	if s.readHeaderTimeout > 0 {
+		return s.readHeaderTimeout
+	}
+	return s.readTimeout
+}
+
+// setDeadline sets a deadline d from now, a zero d removes it
+func setDeadline(set func(time.Time) error, d time.Duration) {
+	if d > 0 {
+		set(time.Now().Add(d))
+	} else {
+		set(time.Time{})
+	}
+}
 
-	if hErr != nil {
-		request.PrintRequest()
-		hErr.Write(resp)
+func isTimeout(err error) bool {
+	var nErr net.Error
+	return errors.As(err, &nErr) && nErr.Timeout()
+}
+
+func logClose(conn net.Conn, reason string, err error) {
+	slog.Info("Closing connection", "addr", conn.RemoteAddr(), "reason", reason, "err", err)
+}
+
+// connWriter keeps the first write error (e.g. a WriteTimeout while the handler streams the response)
+type connWriter struct {
+	conn net.Conn
+	err  error
+}
+
+func (w *connWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.conn.Write(p)
+	if err != nil {
+		w.err = err
 	}
+	return n, err
 }
@@ -0,0 +1,590 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"http/components/request"
+	"http/components/response"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler Handler, opts ...Option) *Server {
+	t.Helper()
+	s, err := Serve(0, handler, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dial(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readResponse reads a single response with a Content-Length body
+func readResponse(t *testing.T, r *bufio.Reader) (status string, hdrs map[string]string, body string) {
+	t.Helper()
+	status, err := r.ReadString('\n')
+	require.NoError(t, err)
+	hdrs = map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		k, v, _ := strings.Cut(line, ": ")
+		hdrs[strings.ToLower(k)] = v
+	}
+	var length int
+	fmt.Sscanf(hdrs["content-length"], "%d", &length)
+	buf := make([]byte, length)
+	_, err = io.ReadFull(r, buf)
+	require.NoError(t, err)
+	return strings.TrimRight(status, "\r\n"), hdrs, string(buf)
+}
+
+func echoTarget(res *response.Response, req *request.Request) *HandlerError {
+	res.WriteResponse(&response.OK, nil, []byte(req.RequestLine.RequestTarget))
+	return nil
+}
+
+func TestServerKeepAlive(t *testing.T) {
+	s := startServer(t, echoTarget)
+
+	t.Run("should serve several requests on the same connection", func(t *testing.T) {
+		conn := dial(t, s)
+		r := bufio.NewReader(conn)
+
+		for _, target := range []string{"/one", "/two", "/three"} {
+			fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost\r\n\r\n", target)
+			status, hdrs, body := readResponse(t, r)
+			assert.Equal(t, "HTTP/1.1 200 OK", status)
+			assert.Equal(t, "keep-alive", hdrs["connection"])
+			assert.Equal(t, target, body)
+		}
+	})
+
+	t.Run("should answer pipelined requests in order", func(t *testing.T) {
+		conn := dial(t, s)
+		r := bufio.NewReader(conn)
+
+		fmt.Fprint(conn, "GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n\r\n")
+		_, _, body := readResponse(t, r)
+		assert.Equal(t, "/a", body)
+		_, _, body = readResponse(t, r)
+		assert.Equal(t, "/b", body)
+	})
+
+	t.Run("should close the connection on Connection: close", func(t *testing.T) {
+		conn := dial(t, s)
+		r := bufio.NewReader(conn)
+
+		fmt.Fprint(conn, "GET /bye HTTP/1.1\r\nConnection: close\r\n\r\n")
+		_, hdrs, _ := readResponse(t, r)
+		assert.Equal(t, "close", hdrs["connection"])
+		_, err := r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("should close HTTP/1.0 connections by default", func(t *testing.T) {
+		conn := dial(t, s)
+		r := bufio.NewReader(conn)
+
+		fmt.Fprint(conn, "GET /old HTTP/1.0\r\n\r\n")
+		_, hdrs, _ := readResponse(t, r)
+		assert.Equal(t, "close", hdrs["connection"])
+		_, err := r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	s := startServer(t, echoTarget, WithIdleTimeout(50*time.Millisecond))
+	conn := dial(t, s)
+	r := bufio.NewReader(conn)
+
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\n\r\n")
+	readResponse(t, r)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServerRequestBody(t *testing.T) {
+	s := startServer(t, func(res *response.Response, req *request.Request) *HandlerError {
+		if req.RequestLine.RequestTarget == "/ignore" {
+			res.WriteResponse(&response.OK, nil, []byte("ignored"))
+			return nil
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return &HandlerError{StatusCode: &response.BAD_REQUEST, Message: []byte(err.Error())}
+		}
+		res.WriteResponse(&response.OK, nil, body)
+		return nil
+	})
+	conn := dial(t, s)
+	r := bufio.NewReader(conn)
+
+	fmt.Fprint(conn, "POST /echo HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello")
+	_, _, body := readResponse(t, r)
+	assert.Equal(t, "hello", body)
+
+	// the unread body must not be parsed as the next request
+	fmt.Fprint(conn, "POST /ignore HTTP/1.1\r\nContent-Length: 5\r\n\r\nGET /")
+	_, _, body = readResponse(t, r)
+	assert.Equal(t, "ignored", body)
+
+	fmt.Fprint(conn, "POST /echo HTTP/1.1\r\nContent-Length: 3\r\n\r\nbye")
+	_, _, body = readResponse(t, r)
+	assert.Equal(t, "bye", body)
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(res *response.Response, req *request.Request) *HandlerError {
+				calls = append(calls, name)
+				return next(res, req)
+			}
+		}
+	}
+	deny := func(next Handler) Handler {
+		return func(res *response.Response, req *request.Request) *HandlerError {
+			return &HandlerError{StatusCode: &response.BAD_REQUEST}
+		}
+	}
+	handler := func(res *response.Response, req *request.Request) *HandlerError {
+		calls = append(calls, "handler")
+		return nil
+	}
+
+	hErr := Chain(trace("a"), trace("b"))(handler)(nil, nil)
+	assert.Nil(t, hErr)
+	assert.Equal(t, []string{"a", "b", "handler"}, calls)
+
+	calls = nil
+	hErr = Chain(trace("a"), deny, trace("b"))(handler)(nil, nil)
+	require.NotNil(t, hErr)
+	assert.Equal(t, response.BAD_REQUEST, *hErr.StatusCode)
+	assert.Equal(t, []string{"a"}, calls)
+}
+
+func TestServerShutdown(t *testing.T) {
+	t.Run("should drain active connections and close idle ones", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		s, err := Serve(0, func(res *response.Response, req *request.Request) *HandlerError {
+			if req.RequestLine.RequestTarget == "/slow" {
+				close(started)
+				<-release
+			}
+			res.WriteResponse(&response.OK, nil, []byte("done"))
+			return nil
+		})
+		require.NoError(t, err)
+
+		idle := dial(t, s)
+		idleReader := bufio.NewReader(idle)
+		fmt.Fprint(idle, "GET / HTTP/1.1\r\n\r\n")
+		readResponse(t, idleReader)
+
+		active := dial(t, s)
+		fmt.Fprint(active, "GET /slow HTTP/1.1\r\n\r\n")
+		<-started
+
+		shutdown := make(chan error)
+		go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+		// idle connection is closed without waiting
+		_, err = idleReader.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+
+		// new connections are refused
+		_, err = net.Dial("tcp", s.Addr().String())
+		assert.Error(t, err)
+
+		select {
+		case <-shutdown:
+			t.Fatal("shutdown returned before the active response was sent")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(release)
+		r := bufio.NewReader(active)
+		_, _, body := readResponse(t, r)
+		assert.Equal(t, "done", body)
+		_, err = r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+		assert.NoError(t, <-shutdown)
+	})
+
+	t.Run("should drain a request whose headers are being read", func(t *testing.T) {
+		s, err := Serve(0, echoTarget)
+		require.NoError(t, err)
+		conn := dial(t, s)
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "GET /first HTTP/1.1\r\n\r\n")
+		readResponse(t, r)
+
+		// the next request is only partly sent when the server shuts down
+		fmt.Fprint(conn, "GET /second HT")
+		time.Sleep(50 * time.Millisecond)
+		shutdown := make(chan error)
+		go func() { shutdown <- s.Shutdown(context.Background()) }()
+		time.Sleep(50 * time.Millisecond)
+
+		fmt.Fprint(conn, "TP/1.1\r\n\r\n")
+		status, hdrs, body := readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+		assert.Equal(t, "close", hdrs["connection"])
+		assert.Equal(t, "/second", body)
+		assert.NoError(t, <-shutdown)
+	})
+
+	t.Run("should force close connections when the context expires", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		defer close(release)
+		s, err := Serve(0, func(res *response.Response, req *request.Request) *HandlerError {
+			close(started)
+			<-release
+			return nil
+		})
+		require.NoError(t, err)
+
+		conn := dial(t, s)
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\n\r\n")
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+
+		_, err = bufio.NewReader(conn).ReadByte()
+		assert.Error(t, err)
+	})
+}
+
+func TestServerTimeouts(t *testing.T) {
+	t.Run("should answer 408 to slow request headers", func(t *testing.T) {
+		s := startServer(t, echoTarget, WithReadHeaderTimeout(50*time.Millisecond))
+		conn := dial(t, s)
+		r := bufio.NewReader(conn)
+
+		// slowloris: the request line never ends
+		fmt.Fprint(conn, "GET /slow HT")
+		status, hdrs, _ := readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 408 Request Timeout", status)
+		assert.Equal(t, "close", hdrs["connection"])
+		_, err := r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("should close new connections without requests after the header timeout", func(t *testing.T) {
+		s := startServer(t, echoTarget, WithReadHeaderTimeout(50*time.Millisecond))
+		conn := dial(t, s)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err := bufio.NewReader(conn).ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("should answer 408 to slow request bodies", func(t *testing.T) {
+		s := startServer(t, func(res *response.Response, req *request.Request) *HandlerError {
+			if _, err := io.ReadAll(req.Body); err != nil {
+				return &HandlerError{StatusCode: &response.BAD_REQUEST, Message: []byte(err.Error())}
+			}
+			res.WriteResponse(&response.OK, nil, []byte("read"))
+			return nil
+		}, WithReadTimeout(100*time.Millisecond))
+		conn := dial(t, s)
+		r := bufio.NewReader(conn)
+
+		fmt.Fprint(conn, "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc")
+		status, _, _ := readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 408 Request Timeout", status)
+		_, err := r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("should close the connection when the write timeout expires", func(t *testing.T) {
+		s := startServer(t, func(res *response.Response, req *request.Request) *HandlerError {
+			time.Sleep(100 * time.Millisecond)
+			res.WriteResponse(&response.OK, nil, []byte("too late"))
+			return nil
+		}, WithWriteTimeout(50*time.Millisecond))
+		conn := dial(t, s)
+
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\n\r\n")
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err := bufio.NewReader(conn).ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestServerLimits(t *testing.T) {
+	s := startServer(t, echoTarget, WithLimits(request.Limits{MaxRequestLine: 64, MaxHeaderBytes: 128, MaxHeaderCount: 10, MaxBodyBytes: 16}))
+
+	tests := []struct {
+		name, request, status string
+	}{
+		{"request line", "GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\n\r\n", "HTTP/1.1 414 URI Too Long"},
+		{"headers", "GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", 200) + "\r\n\r\n", "HTTP/1.1 431 Request Header Fields Too Large"},
+		{"body", "POST / HTTP/1.1\r\nContent-Length: 9999999999\r\n\r\n", "HTTP/1.1 413 Content Too Large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dial(t, s)
+			fmt.Fprint(conn, tt.request)
+			status, _, _ := readResponse(t, bufio.NewReader(conn))
+			assert.Equal(t, tt.status, status)
+		})
+	}
+}
+
+func TestServerStrictParsing(t *testing.T) {
+	s := startServer(t, echoTarget, WithStrictParsing())
+	conn := dial(t, s)
+	r := bufio.NewReader(conn)
+
+	fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG")
+	status, hdrs, _ := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 400 Bad Request", status)
+	assert.Equal(t, "close", hdrs["connection"])
+}
+
+func TestServerPanicRecovery(t *testing.T) {
+	s := startServer(t, func(res *response.Response, req *request.Request) *HandlerError {
+		switch req.RequestLine.RequestTarget {
+		case "/panic":
+			panic("boom")
+		case "/panic-after-write":
+			res.WriteResponse(&response.OK, nil, []byte("partial"))
+			panic("boom")
+		}
+		return echoTarget(res, req)
+	})
+
+	t.Run("should answer 500 when nothing was written", func(t *testing.T) {
+		conn := dial(t, s)
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "GET /panic HTTP/1.1\r\n\r\n")
+		status, hdrs, _ := readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 500 Internal Server Error", status)
+		assert.Equal(t, "close", hdrs["connection"])
+	})
+
+	t.Run("should only close the connection when the response already started", func(t *testing.T) {
+		conn := dial(t, s)
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "GET /panic-after-write HTTP/1.1\r\n\r\n")
+		status, _, body := readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+		assert.Equal(t, "partial", body)
+		_, err := r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("should keep serving after a panic", func(t *testing.T) {
+		conn := dial(t, s)
+		fmt.Fprint(conn, "GET /alive HTTP/1.1\r\n\r\n")
+		_, _, body := readResponse(t, bufio.NewReader(conn))
+		assert.Equal(t, "/alive", body)
+	})
+}
+
+func TestServerResponseState(t *testing.T) {
+	t.Run("error after the response started is not written", func(t *testing.T) {
+		s := startServer(t, func(res *response.Response, req *request.Request) *HandlerError {
+			res.WriteResponse(&response.OK, nil, []byte("partial"))
+			return &HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR}
+		})
+		conn := dial(t, s)
+		r := bufio.NewReader(conn)
+
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		status, _, body := readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 200 OK", status)
+		assert.Equal(t, "partial", body)
+
+		// no second status line, the connection is closed instead
+		_, err := r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("handler that writes nothing gets an empty 200", func(t *testing.T) {
+		s := startServer(t, func(res *response.Response, req *request.Request) *HandlerError {
+			return nil
+		})
+		conn := dial(t, s)
+		r := bufio.NewReader(conn)
+
+		for range 2 {
+			fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			status, hdrs, body := readResponse(t, r)
+			assert.Equal(t, "HTTP/1.1 200 OK", status)
+			assert.Equal(t, "keep-alive", hdrs["connection"])
+			assert.Empty(t, body)
+		}
+	})
+
+	t.Run("incomplete body closes the connection", func(t *testing.T) {
+		s := startServer(t, func(res *response.Response, req *request.Request) *HandlerError {
+			res.WriteStatusLine(&response.OK)
+			res.WriteHeaders(response.GetDefaultHeaders(10))
+			res.WriteBody([]byte("short"))
+			return nil
+		})
+		conn := dial(t, s)
+
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		data, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.True(t, strings.HasSuffix(string(data), "\r\n\r\nshort"))
+	})
+}
+
+func TestServerAutoFraming(t *testing.T) {
+	s := startServer(t, func(res *response.Response, req *request.Request) *HandlerError {
+		switch req.URL.Path {
+		case "/large":
+			for range 3 {
+				res.Write([]byte(strings.Repeat("x", response.BODY_BUFFER_SIZE)))
+			}
+		case "/error":
+			res.Write([]byte("buffered"))
+			return &HandlerError{StatusCode: &response.BAD_REQUEST, Message: []byte("replaced")}
+		default:
+			res.Write([]byte("small"))
+		}
+		return nil
+	})
+	conn := dial(t, s)
+	r := bufio.NewReader(conn)
+
+	fmt.Fprint(conn, "GET /small HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	_, hdrs, body := readResponse(t, r)
+	assert.Equal(t, "5", hdrs["content-length"])
+	assert.Equal(t, "small", body)
+
+	fmt.Fprint(conn, "GET /large HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	_, hdrs, _ = readResponse(t, r)
+	assert.Equal(t, "chunked", hdrs["transfer-encoding"])
+	assert.Equal(t, "keep-alive", hdrs["connection"])
+	var decoded int
+	for {
+		var size int
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		fmt.Sscanf(line, "%x", &size)
+		if size == 0 {
+			r.ReadString('\n')
+			break
+		}
+		_, err = io.CopyN(io.Discard, r, int64(size)+2)
+		require.NoError(t, err)
+		decoded += size
+	}
+	assert.Equal(t, 3*response.BODY_BUFFER_SIZE, decoded)
+
+	// the connection is still usable and the buffered body is replaced by the error page
+	fmt.Fprint(conn, "GET /error HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	status, _, body := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 400 Bad Request", status)
+	assert.NotContains(t, body, "buffered")
+}
+
+func TestServerHijack(t *testing.T) {
+	s := startServer(t, func(res *response.Response, req *request.Request) *HandlerError {
+		conn, rd, err := res.Hijack()
+		if err != nil {
+			return &HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR}
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		line, _ := rd.ReadString('\n')
+		fmt.Fprint(conn, "echo: "+line)
+		return nil
+	})
+	conn := dial(t, s)
+	r := bufio.NewReader(conn)
+
+	// the line sent with the request is already buffered by the server and must reach the handler
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nhello\n")
+	status, _ := r.ReadString('\n')
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+	}
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "echo: hello\n", line)
+
+	// the server doesn't write anything else once the handler closes the connection
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	t.Run("not after the headers", func(t *testing.T) {
+		errs := make(chan error, 1)
+		s := startServer(t, func(res *response.Response, req *request.Request) *HandlerError {
+			res.WriteStatusLine(&response.OK)
+			_, _, err := res.Hijack()
+			errs <- err
+			return nil
+		})
+		conn := dial(t, s)
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		assert.ErrorIs(t, <-errs, response.ErrWriteOrder)
+	})
+}
+
+// flakyListener fails the first Accept calls like a process out of file descriptors
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServerAcceptRetry(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{
+		handler:  echoTarget,
+		listener: &flakyListener{Listener: listener, failures: 3},
+		conns:    map[net.Conn]connState{},
+		limits:   request.DefaultLimits,
+	}
+	s.ctx, s.cancel = context.WithCancelCause(context.Background())
+	go s.listen()
+	t.Cleanup(func() { s.Close() })
+
+	conn := dial(t, s)
+	fmt.Fprint(conn, "GET /after-errors HTTP/1.1\r\n\r\n")
+	_, _, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "/after-errors", body)
+}
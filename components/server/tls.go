@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"http/components/http2"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Certificate files are checked for changes at most once per interval during the handshakes
+const CERT_RELOAD_INTERVAL = 10 * time.Second
+
+type certPair struct {
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+// CertStore holds the server certificates loaded from disk.
+// The certificate is selected by the SNI name sent by the client and
+// files are reloaded when they change, without restarting the server.
+type CertStore struct {
+	// CheckInterval limits how often files are checked for changes, 0 checks on every handshake
+	CheckInterval time.Duration
+
+	mu        sync.RWMutex
+	pairs     []*certPair
+	lastCheck time.Time
+}
+
+func NewCertStore() *CertStore {
+	return &CertStore{CheckInterval: CERT_RELOAD_INTERVAL}
+}
+
+// Add loads a certificate/key pair (PEM). The first pair is used when no other certificate matches the SNI name.
+func (cs *CertStore) Add(certFile, keyFile string) error {
+	pair := &certPair{certFile: certFile, keyFile: keyFile}
+	if err := pair.load(); err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	cs.pairs = append(cs.pairs, pair)
+	cs.mu.Unlock()
+	return nil
+}
+
+// Reload loads again the pairs whose files changed on disk.
+// A pair that fails to load keeps serving the previous certificate.
+func (cs *CertStore) Reload() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.lastCheck = time.Now()
+	var err error
+	for _, pair := range cs.pairs {
+		if !pair.changed() {
+			continue
+		}
+		if lErr := pair.load(); lErr != nil {
+			err = lErr
+		} else {
+			slog.Info("Certificate reloaded", "cert", pair.certFile)
+		}
+	}
+	return err
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	check := time.Since(cs.lastCheck) >= cs.CheckInterval
+	cs.mu.RUnlock()
+	if check {
+		if err := cs.Reload(); err != nil {
+			slog.Warn("Certificate reload failed", "err", err)
+		}
+	}
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	if len(cs.pairs) == 0 {
+		return nil, fmt.Errorf("no certificate available")
+	}
+	if hello.ServerName != "" {
+		for _, pair := range cs.pairs {
+			if pair.cert.Leaf != nil && pair.cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return pair.cert, nil
+			}
+		}
+	}
+	return cs.pairs[0].cert, nil
+}
+
+func (p *certPair) load() error {
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return err
+	}
+	p.cert = &cert
+	p.modTime = p.lastModTime()
+	return nil
+}
+
+func (p *certPair) changed() bool {
+	return !p.lastModTime().Equal(p.modTime)
+}
+
+func (p *certPair) lastModTime() time.Time {
+	var last time.Time
+	for _, f := range []string{p.certFile, p.keyFile} {
+		if info, err := os.Stat(f); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
+
+// LoadCertPool reads PEM certificates, e.g. the CAs used to verify client certificates
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, f := range files {
+		pem, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificate in %s", f)
+		}
+	}
+	return pool, nil
+}
+
+// WithTLSConfig serves HTTPS with the given configuration
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// WithClientAuth enables client certificate verification (mTLS) against the CAs in pool,
+// e.g. tls.RequireAndVerifyClientCert or tls.VerifyClientCertIfGiven. The pool is only optional
+// for the modes that don't verify the certificate (tls.RequestClientCert, tls.RequireAnyClientCert),
+// Serve fails without it for the others.
+func WithClientAuth(auth tls.ClientAuthType, pool *x509.CertPool) Option {
+	return func(s *Server) {
+		if pool == nil && (auth == tls.VerifyClientCertIfGiven || auth == tls.RequireAndVerifyClientCert) {
+			s.optErr = fmt.Errorf("client auth %v requires a pool of client CAs", auth)
+			return
+		}
+		s.clientAuth = auth
+		s.clientCAs = pool
+	}
+}
+
+// ServeTLS is like Serve but serves HTTPS with the certificate and key files.
+// The files are reloaded when they change, use WithTLSConfig and a CertStore for SNI with several certificates.
+func ServeTLS(port uint16, certFile, keyFile string, handler Handler, opts ...Option) (*Server, error) {
+	store := NewCertStore()
+	if err := store.Add(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return Serve(port, handler, append([]Option{WithTLSConfig(&tls.Config{GetCertificate: store.GetCertificate})}, opts...)...)
+}
+
+func (s *Server) buildTLSConfig() *tls.Config {
+	config := s.tlsConfig.Clone()
+	// set even without a pool, a mode that requires a certificate must never turn into no client auth
+	if s.clientAuth != tls.NoClientCert {
+		config.ClientAuth = s.clientAuth
+	}
+	if s.clientCAs != nil {
+		config.ClientCAs = s.clientCAs
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if config.NextProtos == nil && !s.noHTTP2 {
+		config.NextProtos = []string{http2.ALPN_PROTOCOL, "http/1.1"}
+	}
+	return config
+}
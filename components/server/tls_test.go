@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"http/components/request"
+	"http/components/response"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert generates a self-signed certificate for the DNS names and writes cert/key PEM files in dir
+func writeCert(t *testing.T, dir, name string, serial int64, dnsNames ...string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              dnsNames,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return certFile, keyFile, cert
+}
+
+func tlsEcho(res *response.Response, req *request.Request) *HandlerError {
+	body := "no tls"
+	if req.TLS != nil {
+		body = fmt.Sprintf("%s %d", req.TLS.ServerName, len(req.TLS.PeerCertificates))
+	}
+	res.WriteResponse(&response.OK, nil, []byte(body))
+	return nil
+}
+
+// tlsGet sends a GET over TLS and returns the serial of the server certificate and the response body
+func tlsGet(t *testing.T, s *Server, config *tls.Config) (int64, string) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", s.Addr().String(), config)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	_, _, body := readResponse(t, bufio.NewReader(conn))
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), body
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeCert(t, dir, "localhost", 1, "localhost")
+
+	s, err := ServeTLS(0, certFile, keyFile, tlsEcho)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	serial, body := tlsGet(t, s, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	assert.Equal(t, int64(1), serial)
+	assert.Equal(t, "localhost 0", body)
+}
+
+func TestCertStore(t *testing.T) {
+	dir := t.TempDir()
+	aCert, aKey, a := writeCert(t, dir, "a", 1, "a.example.com")
+	bCert, bKey, b := writeCert(t, dir, "b", 2, "*.b.example.com")
+
+	store := NewCertStore()
+	store.CheckInterval = 0
+	require.NoError(t, store.Add(aCert, aKey))
+	require.NoError(t, store.Add(bCert, bKey))
+
+	s := startServer(t, tlsEcho, WithTLSConfig(&tls.Config{GetCertificate: store.GetCertificate}))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(a)
+	roots.AddCert(b)
+
+	t.Run("should select the certificate by SNI", func(t *testing.T) {
+		serial, body := tlsGet(t, s, &tls.Config{RootCAs: roots, ServerName: "a.example.com"})
+		assert.Equal(t, int64(1), serial)
+		assert.Equal(t, "a.example.com 0", body)
+
+		serial, _ = tlsGet(t, s, &tls.Config{RootCAs: roots, ServerName: "api.b.example.com"})
+		assert.Equal(t, int64(2), serial)
+	})
+
+	t.Run("should reload certificates changed on disk", func(t *testing.T) {
+		_, _, c := writeCert(t, dir, "a", 3, "a.example.com")
+		// make sure the modification time changes on coarse-grained filesystems
+		future := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(aCert, future, future))
+		roots.AddCert(c)
+
+		serial, _ := tlsGet(t, s, &tls.Config{RootCAs: roots, ServerName: "a.example.com"})
+		assert.Equal(t, int64(3), serial)
+	})
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, serverCert := writeCert(t, dir, "localhost", 1, "localhost")
+	clientCertFile, clientKeyFile, _ := writeCert(t, dir, "client", 2)
+
+	pool, err := LoadCertPool(clientCertFile)
+	require.NoError(t, err)
+
+	s, err := ServeTLS(0, certFile, keyFile, tlsEcho, WithClientAuth(tls.RequireAndVerifyClientCert, pool))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert)
+
+	t.Run("should accept a verified client certificate", func(t *testing.T) {
+		clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		require.NoError(t, err)
+		_, body := tlsGet(t, s, &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: []tls.Certificate{clientCert}})
+		assert.Equal(t, "localhost 1", body)
+	})
+
+	t.Run("should reject clients without certificate", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost"})
+		if err == nil {
+			defer conn.Close()
+			// with TLS 1.3 the client learns about the rejection on the first read
+			fmt.Fprint(conn, "GET / HTTP/1.1\r\n\r\n")
+			_, err = bufio.NewReader(conn).ReadString('\n')
+		}
+		assert.Error(t, err)
+	})
+}
+
+func TestClientAuthWithoutPool(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, serverCert := writeCert(t, dir, "localhost", 1, "localhost")
+	clientCertFile, clientKeyFile, _ := writeCert(t, dir, "client", 2)
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert)
+
+	s, err := ServeTLS(0, certFile, keyFile, tlsEcho, WithClientAuth(tls.RequireAnyClientCert, nil))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	t.Run("should accept any client certificate", func(t *testing.T) {
+		clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		require.NoError(t, err)
+		_, body := tlsGet(t, s, &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: []tls.Certificate{clientCert}})
+		assert.Equal(t, "localhost 1", body)
+	})
+
+	t.Run("should reject clients without certificate", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost"})
+		if err == nil {
+			defer conn.Close()
+			fmt.Fprint(conn, "GET / HTTP/1.1\r\n\r\n")
+			_, err = bufio.NewReader(conn).ReadString('\n')
+		}
+		assert.Error(t, err)
+	})
+
+	t.Run("should require a pool to verify the certificates", func(t *testing.T) {
+		for _, auth := range []tls.ClientAuthType{tls.VerifyClientCertIfGiven, tls.RequireAndVerifyClientCert} {
+			_, err := ServeTLS(0, certFile, keyFile, tlsEcho, WithClientAuth(auth, nil))
+			assert.Error(t, err, auth)
+		}
+	})
+}
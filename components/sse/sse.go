@@ -0,0 +1,238 @@
+package sse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A comment is sent when the stream is idle for this long, it keeps proxies from closing
+// the connection and reveals a disconnected client
+const DEFAULT_HEARTBEAT = 15 * time.Second
+
+const CONTENT_TYPE = "text/event-stream"
+
+var (
+	ErrClientGone   = errors.New("sse: client disconnected")
+	ErrStreamClosed = errors.New("sse: stream closed")
+	// the request context was cancelled, it wraps the cause (e.g. server.ErrServerClosed)
+	ErrCanceled = errors.New("sse: request canceled")
+)
+
+// Event is a message of the stream, only Data is required
+type Event struct {
+	ID    string
+	Event string
+	// Data can span several lines, each one is sent in its own data field
+	Data string
+	// Retry tells the client how long to wait before reconnecting
+	Retry time.Duration
+}
+
+// EventStream writes events on a chunked text/event-stream response. Its methods can be called
+// from several goroutines, the handler must not write to the response directly.
+type EventStream struct {
+	res         *response.Response
+	lastEventID string
+	heartbeat   time.Duration
+
+	mu       sync.Mutex
+	lastSend time.Time
+	closed   bool
+	err      error
+	done     chan struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+	// stops watching the request context
+	unwatch func() bool
+}
+
+type Option func(*EventStream)
+
+// WithHeartbeat changes the idle time before a heartbeat comment, 0 disables the heartbeat
+func WithHeartbeat(d time.Duration) Option {
+	return func(s *EventStream) {
+		s.heartbeat = d
+	}
+}
+
+// NewEventStream commits the headers of the stream. The handler must Close it before returning.
+func NewEventStream(res *response.Response, req *request.Request, opts ...Option) (*EventStream, *server.HandlerError) {
+	s := &EventStream{
+		res:         res,
+		lastEventID: req.Headers.Get("Last-Event-ID"),
+		heartbeat:   DEFAULT_HEARTBEAT,
+		done:        make(chan struct{}),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if res.Started() {
+		return nil, &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte("Response already started")}
+	}
+	res.Header().Set(headers.CONTENT_TYPE, CONTENT_TYPE)
+	res.Header().Set("Cache-Control", "no-cache")
+	// the events are flushed one by one, Flush selects chunked encoding
+	if err := res.Flush(); err != nil {
+		return nil, &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte(err.Error())}
+	}
+	s.lastSend = time.Now()
+
+	if s.heartbeat > 0 {
+		go s.keepAlive()
+	} else {
+		close(s.stopped)
+	}
+	ctx := req.Context()
+	s.unwatch = context.AfterFunc(ctx, func() { s.cancel(context.Cause(ctx)) })
+	return s, nil
+}
+
+// LastEventID is the id of the last event received by a reconnecting client, empty on the first connection
+func (s *EventStream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once a write fails because the client went away, or when the request context
+// is cancelled (the client closed the connection, the server shuts down or the request timed out)
+func (s *EventStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Send writes an event and flushes it to the client
+func (s *EventStream) Send(ev Event) error {
+	data, err := encode(ev)
+	if err != nil {
+		return err
+	}
+	return s.write(data)
+}
+
+// Comment writes a comment line, ignored by the client
+func (s *EventStream) Comment(text string) error {
+	var b bytes.Buffer
+	for _, line := range splitLines(text) {
+		fmt.Fprintf(&b, ": %s\n", line)
+	}
+	b.WriteString("\n")
+	return s.write(b.Bytes())
+}
+
+// Close stops the heartbeat, the server terminates the chunked body when the handler returns
+func (s *EventStream) Close() {
+	s.unwatch()
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+	}
+	s.mu.Unlock()
+	<-s.stopped
+}
+
+func (s *EventStream) write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.closed {
+		return ErrStreamClosed
+	}
+	_, err := s.res.Write(data)
+	if err == nil {
+		err = s.res.Flush()
+	}
+	if err != nil {
+		// a write error on the connection means the client is gone, the stream can't recover
+		s.err = fmt.Errorf("%w: %w", ErrClientGone, err)
+		close(s.done)
+		return s.err
+	}
+	s.lastSend = time.Now()
+	return nil
+}
+
+// cancel ends the stream, the next writes return ErrClientGone when the server noticed
+// the client closing the connection, ErrCanceled otherwise
+func (s *EventStream) cancel(cause error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	if errors.Is(cause, server.ErrClientGone) {
+		s.err = fmt.Errorf("%w: %w", ErrClientGone, cause)
+	} else {
+		s.err = fmt.Errorf("%w: %w", ErrCanceled, cause)
+	}
+	close(s.done)
+}
+
+// keepAlive sends a heartbeat comment when nothing has been sent for a heartbeat period
+func (s *EventStream) keepAlive() {
+	defer close(s.stopped)
+	timer := time.NewTimer(s.heartbeat)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.done:
+			return
+		case <-timer.C:
+		}
+		s.mu.Lock()
+		idle := time.Since(s.lastSend)
+		s.mu.Unlock()
+		if idle >= s.heartbeat {
+			s.Comment("heartbeat")
+			idle = 0
+		}
+		timer.Reset(s.heartbeat - idle)
+	}
+}
+
+// encode formats an event: a field per line, the data split on every line break, a blank line to dispatch it
+func encode(ev Event) ([]byte, error) {
+	if strings.ContainsAny(ev.ID, "\r\n\x00") {
+		return nil, fmt.Errorf("sse: invalid event id %q", ev.ID)
+	}
+	if strings.ContainsAny(ev.Event, "\r\n") {
+		return nil, fmt.Errorf("sse: invalid event name %q", ev.Event)
+	}
+
+	var b bytes.Buffer
+	if ev.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", ev.ID)
+	}
+	if ev.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", ev.Event)
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", ev.Retry.Milliseconds())
+	}
+	for _, line := range splitLines(ev.Data) {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	return b.Bytes(), nil
+}
+
+// splitLines splits on CRLF, CR and LF, the line breaks of the event stream format
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.Split(s, "\n")
+}
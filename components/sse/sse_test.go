@@ -0,0 +1,146 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"http/components/client"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler server.Handler) string {
+	t.Helper()
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s.Addr().String()
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   Event
+		want string
+	}{
+		{"data only", Event{Data: "hello"}, "data: hello\n\n"},
+		{"all fields", Event{ID: "7", Event: "update", Data: "x", Retry: 3 * time.Second}, "id: 7\nevent: update\nretry: 3000\ndata: x\n\n"},
+		{"multi-line data", Event{Data: "a\nb\r\nc\rd"}, "data: a\ndata: b\ndata: c\ndata: d\n\n"},
+		{"empty data", Event{ID: "1"}, "id: 1\ndata: \n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := encode(tt.ev)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(data))
+		})
+	}
+
+	_, err := encode(Event{ID: "1\n2", Data: "x"})
+	assert.Error(t, err)
+	_, err = encode(Event{Event: "a\rb", Data: "x"})
+	assert.Error(t, err)
+}
+
+func TestEventStream(t *testing.T) {
+	addr := startServer(t, func(res *response.Response, req *request.Request) *server.HandlerError {
+		stream, hErr := NewEventStream(res, req, WithHeartbeat(20*time.Millisecond))
+		if hErr != nil {
+			return hErr
+		}
+		defer stream.Close()
+		stream.Send(Event{ID: "6", Data: "resumed after " + stream.LastEventID()})
+		time.Sleep(70 * time.Millisecond)
+		stream.Send(Event{Event: "bye", Data: "line 1\nline 2"})
+		return nil
+	})
+
+	c := client.New(client.WithTimeout(5 * time.Second))
+	req, err := client.NewRequest("GET", "http://"+addr+"/events", nil)
+	require.NoError(t, err)
+	req.Headers.Set("Last-Event-ID", "5")
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, CONTENT_TYPE, resp.Headers.Get("Content-Type"))
+	assert.Equal(t, "no-cache", resp.Headers.Get("Cache-Control"))
+	assert.Equal(t, "chunked", resp.Headers.Get("Transfer-Encoding"))
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(body), "id: 6\ndata: resumed after 5\n\n"), string(body))
+	assert.Contains(t, string(body), ": heartbeat\n\n")
+	assert.True(t, strings.HasSuffix(string(body), "event: bye\ndata: line 1\ndata: line 2\n\n"), string(body))
+}
+
+func TestEventStreamDisconnect(t *testing.T) {
+	gone := make(chan error, 1)
+	addr := startServer(t, func(res *response.Response, req *request.Request) *server.HandlerError {
+		stream, hErr := NewEventStream(res, req, WithHeartbeat(10*time.Millisecond))
+		if hErr != nil {
+			return hErr
+		}
+		defer stream.Close()
+		select {
+		case <-stream.Done():
+			gone <- stream.Send(Event{Data: "too late"})
+		case <-time.After(5 * time.Second):
+			gone <- nil
+		}
+		return nil
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	fmt.Fprint(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", status)
+	conn.Close()
+
+	assert.ErrorIs(t, <-gone, ErrClientGone)
+}
+
+func TestEventStreamShutdown(t *testing.T) {
+	canceled := make(chan error, 1)
+	s, err := server.Serve(0, func(res *response.Response, req *request.Request) *server.HandlerError {
+		stream, hErr := NewEventStream(res, req, WithHeartbeat(0))
+		if hErr != nil {
+			return hErr
+		}
+		defer stream.Close()
+		select {
+		case <-stream.Done():
+			canceled <- stream.Send(Event{Data: "too late"})
+		case <-time.After(5 * time.Second):
+			canceled <- nil
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+
+	// Shutdown waits for the stream, which ends with the request context
+	require.NoError(t, s.Shutdown(context.Background()))
+	err = <-canceled
+	assert.ErrorIs(t, err, ErrCanceled)
+	assert.ErrorIs(t, err, server.ErrServerClosed)
+}
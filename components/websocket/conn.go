@@ -0,0 +1,288 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"http/components/request"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = MessageType(opText)
+	BinaryMessage MessageType = MessageType(opBinary)
+)
+
+// CloseCode is the status code of a close frame (RFC 6455 section 7.4.1)
+type CloseCode uint16
+
+const (
+	CloseNormal             CloseCode = 1000
+	CloseGoingAway          CloseCode = 1001
+	CloseProtocolError      CloseCode = 1002
+	CloseUnsupportedData    CloseCode = 1003
+	CloseNoStatus           CloseCode = 1005 // never sent, the close frame had no code
+	CloseAbnormal           CloseCode = 1006 // never sent, the connection dropped without a close frame
+	CloseInvalidPayload     CloseCode = 1007
+	ClosePolicyViolation    CloseCode = 1008
+	CloseMessageTooBig      CloseCode = 1009
+	CloseMandatoryExtension CloseCode = 1010
+	CloseInternalError      CloseCode = 1011
+)
+
+// Messages bigger than this are rejected with 1009 unless changed with WithMaxMessageSize
+const DEFAULT_MAX_MESSAGE_SIZE = 1 << 20
+
+// Close waits this long for the close frame of the peer
+const CLOSE_TIMEOUT = 5 * time.Second
+
+var ErrClosed = errors.New("websocket: connection closed")
+
+// CloseError is returned by ReadMessage when the connection is closed, with the code sent by the peer
+// or the one sent to the peer after a protocol violation
+type CloseError struct {
+	Code   CloseCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Reason)
+}
+
+func protocolError(reason string) *CloseError {
+	return &CloseError{Code: CloseProtocolError, Reason: reason}
+}
+
+// Conn is a WebSocket connection. ReadMessage must be called from a single goroutine,
+// writes can be concurrent.
+type Conn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	isServer bool
+	// Subprotocol negotiated in the handshake
+	Subprotocol string
+
+	maxMessageSize int64
+	fragmentSize   int
+	onPong         func(data []byte)
+	// handshake options
+	subprotocols []string
+	checkOrigin  func(req *request.Request) bool
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+type Option func(*Conn)
+
+// WithMaxMessageSize limits the size of a message after reassembling its fragments
+func WithMaxMessageSize(n int64) Option {
+	return func(c *Conn) {
+		c.maxMessageSize = n
+	}
+}
+
+// WithFragmentSize splits the messages written in fragments of n bytes, 0 sends every message in a single frame
+func WithFragmentSize(n int) Option {
+	return func(c *Conn) {
+		c.fragmentSize = n
+	}
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, isServer bool, opts ...Option) *Conn {
+	c := &Conn{conn: conn, br: br, isServer: isServer, maxMessageSize: DEFAULT_MAX_MESSAGE_SIZE}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// NetConn returns the underlying connection, e.g. to set deadlines
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// SetPongHandler is called with the payload of every pong received by ReadMessage
+func (c *Conn) SetPongHandler(h func(data []byte)) {
+	c.onPong = h
+}
+
+// ReadMessage returns the next data message, reassembling its fragments. Pings are answered
+// and pongs handled in the meantime. A close frame (or a protocol violation) ends the connection
+// with a *CloseError.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	var (
+		msgType MessageType
+		message []byte
+		started bool
+	)
+	for {
+		f, err := readFrame(c.br, c.isServer, c.maxMessageSize-int64(len(message)))
+		if err != nil {
+			var closeErr *CloseError
+			if errors.As(err, &closeErr) {
+				c.fail(closeErr)
+			}
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case opPing:
+			if err := c.writeControl(opPong, f.payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			if c.onPong != nil {
+				c.onPong(f.payload)
+			}
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(f.payload)
+		case opText, opBinary:
+			if started {
+				return 0, nil, c.fail(protocolError("new message before the end of a fragmented one"))
+			}
+			started = true
+			msgType = MessageType(f.opcode)
+		case opContinuation:
+			if !started {
+				return 0, nil, c.fail(protocolError("continuation frame without a message"))
+			}
+		}
+
+		message = append(message, f.payload...)
+		if f.fin {
+			if msgType == TextMessage && !utf8.Valid(message) {
+				return 0, nil, c.fail(&CloseError{Code: CloseInvalidPayload, Reason: "invalid UTF-8 in text message"})
+			}
+			return msgType, message, nil
+		}
+	}
+}
+
+// WriteMessage sends a text or binary message, fragmented when WithFragmentSize is set
+func (c *Conn) WriteMessage(msgType MessageType, data []byte) error {
+	if msgType != TextMessage && msgType != BinaryMessage {
+		return fmt.Errorf("websocket: invalid message type %d", msgType)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+
+	op := opcode(msgType)
+	for {
+		chunk, fin := data, true
+		if c.fragmentSize > 0 && len(data) > c.fragmentSize {
+			chunk, fin = data[:c.fragmentSize], false
+		}
+		if err := writeFrame(c.conn, fin, op, chunk, !c.isServer); err != nil {
+			return err
+		}
+		if fin {
+			return nil
+		}
+		data = data[len(chunk):]
+		op = opContinuation
+	}
+}
+
+// Ping sends a ping, the pong is delivered to the handler set with SetPongHandler
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > MAX_CONTROL_PAYLOAD {
+		return fmt.Errorf("websocket: ping payload longer than %d bytes", MAX_CONTROL_PAYLOAD)
+	}
+	return c.writeControl(opPing, data)
+}
+
+// Close starts the closing handshake: it sends a close frame, waits for the one of the peer
+// (discarding the data messages still in flight) and closes the connection.
+// It reads from the connection, so it must not run while ReadMessage is waiting.
+func (c *Conn) Close(code CloseCode, reason string) error {
+	if err := c.sendClose(code, reason); err != nil {
+		c.conn.Close()
+		return err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(CLOSE_TIMEOUT))
+	for {
+		f, err := readFrame(c.br, c.isServer, -1)
+		if err != nil || f.opcode == opClose {
+			break
+		}
+	}
+	return c.conn.Close()
+}
+
+func (c *Conn) writeControl(op opcode, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	return writeFrame(c.conn, true, op, payload, !c.isServer)
+}
+
+func (c *Conn) sendClose(code CloseCode, reason string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	c.closeSent = true
+	var payload []byte
+	if code != CloseNoStatus {
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+		if len(payload) > MAX_CONTROL_PAYLOAD {
+			payload = payload[:MAX_CONTROL_PAYLOAD]
+		}
+	}
+	return writeFrame(c.conn, true, opClose, payload, !c.isServer)
+}
+
+// handleClose answers a close frame with the same code and closes the connection
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(protocolError("close frame with a 1 byte payload"))
+	case len(payload) >= 2:
+		closeErr.Code = CloseCode(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(protocolError(fmt.Sprintf("invalid close code %d", closeErr.Code)))
+		}
+		if !utf8.ValidString(closeErr.Reason) {
+			return c.fail(&CloseError{Code: CloseInvalidPayload, Reason: "invalid UTF-8 in close reason"})
+		}
+	}
+	c.sendClose(closeErr.Code, "")
+	c.conn.Close()
+	return closeErr
+}
+
+// fail closes the connection after a violation, the peer gets the close code
+func (c *Conn) fail(closeErr *CloseError) error {
+	c.sendClose(closeErr.Code, closeErr.Reason)
+	c.conn.Close()
+	return closeErr
+}
+
+// Codes that can be sent in a close frame, 3000-4999 are for libraries and applications
+func validCloseCode(code CloseCode) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
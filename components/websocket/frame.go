@@ -0,0 +1,151 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type opcode byte
+
+const (
+	opContinuation opcode = 0x0
+	opText         opcode = 0x1
+	opBinary       opcode = 0x2
+	opClose        opcode = 0x8
+	opPing         opcode = 0x9
+	opPong         opcode = 0xa
+)
+
+func (op opcode) isControl() bool {
+	return op&0x8 != 0
+}
+
+// Payload of ping, pong and close frames (RFC 6455 section 5.5)
+const MAX_CONTROL_PAYLOAD = 125
+
+// frame (RFC 6455 section 5.2):
+//
+//	FIN RSV1-3 opcode(4) | MASK payload-len(7) | extended length (16 or 64) | masking-key (32) | payload
+type frame struct {
+	fin     bool
+	opcode  opcode
+	payload []byte
+}
+
+// readFrame decodes a frame, the masking of the payload is checked against masked (frames from a client
+// are masked, frames from a server aren't). A payload bigger than maxPayload is rejected before reading it.
+func readFrame(r *bufio.Reader, masked bool, maxPayload int64) (*frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	f := &frame{fin: head[0]&0x80 != 0, opcode: opcode(head[0] & 0x0f)}
+	if head[0]&0x70 != 0 {
+		return nil, protocolError("reserved bits set without a negotiated extension")
+	}
+	switch f.opcode {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+	default:
+		return nil, protocolError(fmt.Sprintf("unknown opcode 0x%x", f.opcode))
+	}
+	if head[1]&0x80 == 0 && masked {
+		return nil, protocolError("client frames must be masked")
+	}
+	if head[1]&0x80 != 0 && !masked {
+		return nil, protocolError("server frames must not be masked")
+	}
+
+	length := int64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		if ext[0]&0x80 != 0 {
+			return nil, protocolError("payload length with the most significant bit set")
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if f.opcode.isControl() {
+		if length > MAX_CONTROL_PAYLOAD {
+			return nil, protocolError("control frame payload longer than 125 bytes")
+		}
+		if !f.fin {
+			return nil, protocolError("fragmented control frame")
+		}
+	} else if maxPayload >= 0 && length > maxPayload {
+		return nil, &CloseError{Code: CloseMessageTooBig, Reason: "message too big"}
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return nil, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		mask(f.payload, key)
+	}
+	return f, nil
+}
+
+// writeFrame encodes a frame, a client masks the payload with a random key
+func writeFrame(w io.Writer, fin bool, op opcode, payload []byte, masked bool) error {
+	buf := make([]byte, 0, 14+len(payload))
+	b0 := byte(op)
+	if fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	if masked {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf = append(buf, key[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		mask(buf[start:], key)
+	} else {
+		buf = append(buf, payload...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// mask applies (and removes) the masking key: byte i is XORed with key[i % 4]
+func mask(b []byte, key [4]byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
@@ -0,0 +1,78 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame(t *testing.T) {
+	t.Run("payload lengths", func(t *testing.T) {
+		for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+			payload := bytes.Repeat([]byte{'x'}, size)
+			for _, masked := range []bool{true, false} {
+				var buf bytes.Buffer
+				require.NoError(t, writeFrame(&buf, true, opBinary, payload, masked))
+
+				f, err := readFrame(bufio.NewReader(&buf), masked, -1)
+				require.NoError(t, err, "size %d", size)
+				assert.True(t, f.fin)
+				assert.Equal(t, opBinary, f.opcode)
+				assert.Equal(t, payload, f.payload)
+			}
+		}
+	})
+
+	t.Run("RFC 6455 masked example", func(t *testing.T) {
+		// single-frame masked text message "Hello" (section 5.7)
+		data := []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+		f, err := readFrame(bufio.NewReader(bytes.NewReader(data)), true, -1)
+		require.NoError(t, err)
+		assert.Equal(t, opText, f.opcode)
+		assert.Equal(t, "Hello", string(f.payload))
+	})
+
+	t.Run("masking is enforced", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, writeFrame(&buf, true, opText, []byte("hi"), false))
+		_, err := readFrame(bufio.NewReader(&buf), true, -1)
+		assertCloseCode(t, err, CloseProtocolError)
+
+		buf.Reset()
+		require.NoError(t, writeFrame(&buf, true, opText, []byte("hi"), true))
+		_, err = readFrame(bufio.NewReader(&buf), false, -1)
+		assertCloseCode(t, err, CloseProtocolError)
+	})
+
+	t.Run("invalid frames", func(t *testing.T) {
+		tests := map[string][]byte{
+			"reserved bit":       {0xc1, 0x80, 0, 0, 0, 0},
+			"unknown opcode":     {0x83, 0x80, 0, 0, 0, 0},
+			"fragmented control": {0x09, 0x80, 0, 0, 0, 0},
+			"control too long":   {0x89, 0xfe, 0x00, 0x7e},
+			"64 bit length sign": {0x82, 0xff, 0x80, 0, 0, 0, 0, 0, 0, 0},
+		}
+		for name, data := range tests {
+			_, err := readFrame(bufio.NewReader(bytes.NewReader(data)), true, -1)
+			assertCloseCode(t, err, CloseProtocolError, name)
+		}
+	})
+
+	t.Run("payload limit", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, writeFrame(&buf, true, opBinary, make([]byte, 200), true))
+		_, err := readFrame(bufio.NewReader(&buf), true, 100)
+		assertCloseCode(t, err, CloseMessageTooBig)
+	})
+}
+
+func assertCloseCode(t *testing.T, err error, code CloseCode, msgAndArgs ...any) {
+	t.Helper()
+	var closeErr *CloseError
+	if assert.ErrorAs(t, err, &closeErr, msgAndArgs...) {
+		assert.Equal(t, code, closeErr.Code, msgAndArgs...)
+	}
+}
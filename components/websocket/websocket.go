@@ -0,0 +1,218 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"http/components/headers"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Appended to Sec-WebSocket-Key to compute Sec-WebSocket-Accept (RFC 6455 section 4.2.2)
+const ACCEPT_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const VERSION = "13"
+
+const DEFAULT_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// WithSubprotocols lists the subprotocols supported by the server in order of preference,
+// or the ones offered by the client in Dial
+func WithSubprotocols(protocols ...string) Option {
+	return func(c *Conn) {
+		c.subprotocols = protocols
+	}
+}
+
+// WithCheckOrigin replaces the default check, which accepts a request without Origin
+// or with an Origin matching the Host header
+func WithCheckOrigin(check func(req *request.Request) bool) Option {
+	return func(c *Conn) {
+		c.checkOrigin = check
+	}
+}
+
+// Upgrade validates the opening handshake, hijacks the connection and answers 101 Switching Protocols.
+// On a HandlerError nothing has been written yet, the handler returns it.
+func Upgrade(res *response.Response, req *request.Request, opts ...Option) (*Conn, *server.HandlerError) {
+	c := newConn(nil, nil, true, opts...)
+	if c.checkOrigin == nil {
+		c.checkOrigin = sameOrigin
+	}
+
+	if req.RequestLine.Method != "GET" {
+		return nil, &server.HandlerError{StatusCode: &response.METHOD_NOT_ALLOWED, Message: []byte("WebSocket handshake must be a GET"),
+			Headers: headerOf("Allow", "GET")}
+	}
+	if !req.Headers.HasToken("Upgrade", "websocket") || !req.Headers.HasToken(headers.CONNECTION, "upgrade") {
+		return nil, &server.HandlerError{StatusCode: &response.BAD_REQUEST, Message: []byte("Not a WebSocket handshake")}
+	}
+	if req.Headers.Get("Sec-WebSocket-Version") != VERSION {
+		return nil, &server.HandlerError{StatusCode: &response.UPGRADE_REQUIRED, Message: []byte("Unsupported WebSocket version"),
+			Headers: headerOf("Sec-WebSocket-Version", VERSION)}
+	}
+	key := req.Headers.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, &server.HandlerError{StatusCode: &response.BAD_REQUEST, Message: []byte("Invalid Sec-WebSocket-Key")}
+	}
+	if !c.checkOrigin(req) {
+		return nil, &server.HandlerError{StatusCode: &response.FORBIDDEN, Message: []byte("Origin not allowed")}
+	}
+	c.Subprotocol = selectSubprotocol(c.subprotocols, req.Headers.Values("Sec-WebSocket-Protocol"))
+
+	if res.OnHijack == nil {
+		return nil, &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte(response.ErrNotHijackable.Error())}
+	}
+	h := res.Header()
+	h.Set("Upgrade", "websocket")
+	h.Set(headers.CONNECTION, "Upgrade")
+	h.Set("Sec-WebSocket-Accept", acceptKey(key))
+	if c.Subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", c.Subprotocol)
+	}
+	if err := res.WriteStatusLine(&response.SWITCHING_PROTOCOLS); err != nil {
+		return nil, &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte(err.Error())}
+	}
+	if err := res.WriteHeaders(h); err != nil {
+		return nil, &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte(err.Error())}
+	}
+	// the 101 is complete, the connection now carries frames
+	conn, br, err := res.Hijack()
+	if err != nil {
+		return nil, &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte(err.Error())}
+	}
+	c.conn, c.br = conn, br
+	return c, nil
+}
+
+// Dial opens a client connection to a ws:// or wss:// URL
+func Dial(rawURL string, opts ...Option) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: DEFAULT_HANDSHAKE_TIMEOUT}
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", hostPort(u, "80"))
+	case "wss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostPort(u, "443"), &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := newConn(conn, nil, false, opts...)
+	if err := c.handshake(u); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// handshake sends the opening request and checks the 101 response, the frames already
+// received after it are kept for ReadMessage
+func (c *Conn) handshake(u *url.URL) error {
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(raw[:])
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "GET %s %s\r\nHost: %s\r\n", u.RequestURI(), response.HTTP_VERSION, u.Host)
+	b.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(&b, "Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: %s\r\n", key, VERSION)
+	if len(c.subprotocols) > 0 {
+		fmt.Fprintf(&b, "Sec-WebSocket-Protocol: %s\r\n", strings.Join(c.subprotocols, ", "))
+	}
+	b.WriteString("\r\n")
+
+	c.conn.SetDeadline(time.Now().Add(DEFAULT_HANDSHAKE_TIMEOUT))
+	defer c.conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return err
+	}
+
+	rd := request.NewReader(c.conn)
+	line, err := rd.ReadLine()
+	if err != nil {
+		return err
+	}
+	h := headers.NewHeaders()
+	if err := rd.ReadHeaders(h); err != nil {
+		return err
+	}
+	if parts := strings.SplitN(string(line), " ", 3); len(parts) < 2 || parts[1] != "101" {
+		return fmt.Errorf("websocket: handshake refused: %q", line)
+	}
+	if !h.HasToken("Upgrade", "websocket") || !h.HasToken(headers.CONNECTION, "upgrade") {
+		return fmt.Errorf("websocket: missing upgrade in handshake response")
+	}
+	if h.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return fmt.Errorf("websocket: invalid Sec-WebSocket-Accept")
+	}
+	c.Subprotocol = h.Get("Sec-WebSocket-Protocol")
+	if c.Subprotocol != "" && !slices.Contains(c.subprotocols, c.Subprotocol) {
+		return fmt.Errorf("websocket: server selected an unknown subprotocol %q", c.Subprotocol)
+	}
+	c.br = bufio.NewReader(io.MultiReader(bytes.NewReader(rd.Buffered()), c.conn))
+	return nil
+}
+
+// acceptKey is base64(SHA-1(key + GUID))
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + ACCEPT_GUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// selectSubprotocol returns the first protocol of the server offered by the client
+func selectSubprotocol(supported []string, offered []string) string {
+	for _, protocol := range supported {
+		for _, value := range offered {
+			for _, candidate := range strings.Split(value, ",") {
+				if strings.TrimSpace(candidate) == protocol {
+					return protocol
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// sameOrigin protects against cross-site WebSocket hijacking, browsers always send Origin
+func sameOrigin(req *request.Request) bool {
+	origin := req.Headers.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Headers.Get("Host"))
+}
+
+func headerOf(k string, v string) *headers.Headers {
+	h := headers.NewHeaders()
+	h.Set(k, v)
+	return h
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,215 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"http/components/request"
+	"http/components/response"
+	"http/components/server"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoServer answers every message with the same message until the connection is closed
+func echoServer(t *testing.T, opts ...Option) string {
+	t.Helper()
+	s, err := server.Serve(0, func(res *response.Response, req *request.Request) *server.HandlerError {
+		ws, hErr := Upgrade(res, req, opts...)
+		if hErr != nil {
+			return hErr
+		}
+		for {
+			msgType, data, err := ws.ReadMessage()
+			if err != nil {
+				return nil
+			}
+			if err := ws.WriteMessage(msgType, data); err != nil {
+				return nil
+			}
+		}
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return "ws://" + s.Addr().String() + "/ws"
+}
+
+func dialEcho(t *testing.T, url string, opts ...Option) *Conn {
+	t.Helper()
+	ws, err := Dial(url, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { ws.conn.Close() })
+	ws.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return ws
+}
+
+// readClose returns the code of the close frame sent by the server
+func readClose(t *testing.T, ws *Conn) CloseCode {
+	t.Helper()
+	for {
+		f, err := readFrame(ws.br, false, -1)
+		require.NoError(t, err)
+		if f.opcode == opClose {
+			require.GreaterOrEqual(t, len(f.payload), 2)
+			return CloseCode(binary.BigEndian.Uint16(f.payload))
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	url := echoServer(t)
+	addr := strings.TrimSuffix(strings.TrimPrefix(url, "ws://"), "/ws")
+
+	t.Run("accept key", func(t *testing.T) {
+		// example of RFC 6455 section 1.3
+		assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+	})
+
+	tests := []struct {
+		name    string
+		headers string
+		status  string
+	}{
+		{"missing upgrade", "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", "400"},
+		{"unsupported version", "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 8\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", "426"},
+		{"invalid key", "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: short\r\n", "400"},
+		{"cross origin", "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nOrigin: http://evil.example\r\n", "403"},
+		{"accepted", "Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nOrigin: http://" + addr + "\r\n", "101"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer conn.Close()
+			fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s\r\n%s\r\n", addr, tt.headers)
+
+			r := bufio.NewReader(conn)
+			status, err := r.ReadString('\n')
+			require.NoError(t, err)
+			assert.Contains(t, status, " "+tt.status+" ")
+			if tt.status == "426" {
+				rest := make([]byte, 512)
+				n, _ := r.Read(rest)
+				assert.Contains(t, strings.ToLower(string(rest[:n])), "sec-websocket-version: 13")
+			}
+			if tt.status == "101" {
+				rest := make([]byte, 512)
+				n, _ := r.Read(rest)
+				assert.Contains(t, strings.ToLower(string(rest[:n])), "connection: upgrade\r\n")
+				assert.Contains(t, string(rest[:n]), "sec-websocket-accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+			}
+		})
+	}
+
+	t.Run("subprotocol", func(t *testing.T) {
+		url := echoServer(t, WithSubprotocols("v2.chat", "chat"))
+		ws := dialEcho(t, url, WithSubprotocols("chat", "v2.chat"))
+		assert.Equal(t, "v2.chat", ws.Subprotocol)
+	})
+}
+
+func TestConn(t *testing.T) {
+	url := echoServer(t, WithMaxMessageSize(1024))
+
+	t.Run("echo", func(t *testing.T) {
+		ws := dialEcho(t, url)
+		require.NoError(t, ws.WriteMessage(TextMessage, []byte("héllo")))
+		msgType, data, err := ws.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, TextMessage, msgType)
+		assert.Equal(t, "héllo", string(data))
+
+		payload := bytes.Repeat([]byte{0, 1, 2}, 300)
+		require.NoError(t, ws.WriteMessage(BinaryMessage, payload))
+		msgType, data, err = ws.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, BinaryMessage, msgType)
+		assert.Equal(t, payload, data)
+	})
+
+	t.Run("fragments are reassembled", func(t *testing.T) {
+		ws := dialEcho(t, url, WithFragmentSize(3))
+		require.NoError(t, ws.WriteMessage(TextMessage, []byte("fragmented message")))
+		// a ping between the fragments is answered without breaking the message
+		require.NoError(t, writeFrame(ws.conn, false, opText, []byte("ab"), true))
+		require.NoError(t, writeFrame(ws.conn, true, opPing, []byte("p"), true))
+		require.NoError(t, writeFrame(ws.conn, true, opContinuation, []byte("cd"), true))
+
+		pongs := make(chan string, 1)
+		ws.SetPongHandler(func(data []byte) { pongs <- string(data) })
+		_, data, err := ws.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "fragmented message", string(data))
+		_, data, err = ws.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "abcd", string(data))
+		assert.Equal(t, "p", <-pongs)
+	})
+
+	t.Run("closing handshake", func(t *testing.T) {
+		ws := dialEcho(t, url)
+		require.NoError(t, ws.Close(CloseNormal, "bye"))
+		assert.ErrorIs(t, ws.WriteMessage(TextMessage, []byte("late")), ErrClosed)
+	})
+
+	t.Run("close from the peer", func(t *testing.T) {
+		s, err := server.Serve(0, func(res *response.Response, req *request.Request) *server.HandlerError {
+			ws, hErr := Upgrade(res, req)
+			if hErr != nil {
+				return hErr
+			}
+			ws.Close(CloseGoingAway, "shutting down")
+			return nil
+		})
+		require.NoError(t, err)
+		defer s.Close()
+
+		ws := dialEcho(t, "ws://"+s.Addr().String()+"/")
+		_, _, err = ws.ReadMessage()
+		assertCloseCode(t, err, CloseGoingAway)
+		assert.Equal(t, "websocket: close 1001 shutting down", err.Error())
+	})
+
+	violations := []struct {
+		name  string
+		write func(c net.Conn) error
+		code  CloseCode
+	}{
+		{"unmasked frame", func(c net.Conn) error {
+			return writeFrame(c, true, opText, []byte("hi"), false)
+		}, CloseProtocolError},
+		{"message too big", func(c net.Conn) error {
+			return writeFrame(c, true, opBinary, make([]byte, 2000), true)
+		}, CloseMessageTooBig},
+		{"fragments too big", func(c net.Conn) error {
+			writeFrame(c, false, opBinary, make([]byte, 600), true)
+			return writeFrame(c, true, opContinuation, make([]byte, 600), true)
+		}, CloseMessageTooBig},
+		{"invalid UTF-8", func(c net.Conn) error {
+			return writeFrame(c, true, opText, []byte{0xff, 0xfe}, true)
+		}, CloseInvalidPayload},
+		{"continuation without message", func(c net.Conn) error {
+			return writeFrame(c, true, opContinuation, []byte("x"), true)
+		}, CloseProtocolError},
+		{"interleaved messages", func(c net.Conn) error {
+			writeFrame(c, false, opText, []byte("a"), true)
+			return writeFrame(c, true, opText, []byte("b"), true)
+		}, CloseProtocolError},
+		{"invalid close code", func(c net.Conn) error {
+			return writeFrame(c, true, opClose, []byte{0x03, 0xed}, true)
+		}, CloseProtocolError},
+	}
+	for _, tt := range violations {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := dialEcho(t, url)
+			require.NoError(t, tt.write(ws.conn))
+			assert.Equal(t, tt.code, readClose(t, ws))
+		})
+	}
+}
@@ -1,29 +1,55 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
+	"http/components/fileserver"
 	"http/components/headers"
+	"http/components/middleware"
 	"http/components/request"
 	"http/components/response"
+	"http/components/router"
 	"http/components/server"
+	"http/components/sse"
+	"http/components/websocket"
 	"log"
 	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const port = 3030
 
+const shutdownTimeout = 30 * time.Second
+
 func main() {
-	server, err := server.Serve(port, handler)
+	r := router.New()
+	r.Use(middleware.RequestID(), middleware.Logger(nil), middleware.Compress())
+	r.GET("/", handleIndex)
+	r.GET("/not", handleNotFound)
+	r.GET("/bad", handleBadRequest)
+	r.GET("/server-error", handleServerError)
+	r.GET("/chunked", handleChunked)
+	r.POST("/chunked", handleChunked)
+	r.GET("/chunked-trailer", handleChunkedTrailer)
+	r.GET("/binary", handleBinary)
+	r.HEAD("/binary", handleBinary)
+	assets := fileserver.FileServer("assets", fileserver.WithIndex(), fileserver.WithListing())
+	r.GET("/assets/*", assets)
+	r.HEAD("/assets/*", assets)
+	r.GET("/ws", handleWebSocket)
+	r.GET("/events", handleEvents)
+
+	server, err := server.Serve(port, r.Handler)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
 	slog.Info("Server started on", "port", port)
 
 	// Common pattern for gracefully shutting down a server.
@@ -31,114 +57,91 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 	fmt.Println()
+
+	// in-flight responses (e.g. /binary) get some time to complete
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Server forced to stop", "err", err)
+		return
+	}
 	slog.Info("Server gracefully stopped")
 }
 
-func handler(res *response.Response, req *request.Request) *server.HandlerError {
-	switch req.RequestLine.RequestTarget {
-	case "/not":
-		return &server.HandlerError{StatusCode: &response.NOT_FOUND, Message: []byte("Nothing to say :(")}
-	case "/bad":
-		return &server.HandlerError{StatusCode: &response.BAD_REQUEST}
-	case "/server-error":
-		return &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte("My bad :|")}
-	case "/chunked":
-		req.PrintRequest()
-
-		// Step 1: write headers
-		heders := headers.NewHeaders()
-		heders.Set(headers.CONTENT_TYPE, "text/plain")
-		heders.Set("Transfer-Encoding", "chunked")
-		res.Write(&response.OK, heders, nil)
-
-		// Step 2: write chunk
-		size := 1024 // Byte
-		bigData := generateBigData(size)
-		cunckedSize := 100
-		var end int
-		for i := 0; i < len(bigData); i += cunckedSize {
-			end = i + cunckedSize
-			if end > len(bigData) {
-				end = len(bigData)
-			}
-			res.WriteChunkedBody(bigData[i:end])
-		}
-		// Step 3: close body
-		res.WriteChunkedBodyDone()
-	case "/chunked-trailer":
-		req.PrintRequest()
-
-		// Step 1: write headers
-		h := headers.NewHeaders()
-		h.Set(headers.CONTENT_TYPE, "text/plain")
-		h.Set("Transfer-Encoding", "chunked")
-		h.Set("Trailer", "x-content-sha256, x-content-length")
-		res.Write(&response.OK, h, nil)
-
-		// Step 2: write chunk
-		size := 1024 // Byte
-		bigData := generateBigData(size)
-		cunckedSize := 100
-		var end int
-		for i := 0; i < len(bigData); i += cunckedSize {
-			end = i + cunckedSize
-			if end > len(bigData) {
-				end = len(bigData)
-			}
-			res.WriteChunkedBody(bigData[i:end])
-		}
+func handleIndex(res *response.Response, req *request.Request) *server.HandlerError {
+	req.PrintRequest()
+	body := "Good!\n"
+	res.WriteResponse(&response.OK, nil, []byte(body))
+	return nil
+}
 
-		// Step 3: write trailer
-		trailer := headers.NewHeaders()
-		trailer.Set("X-Content-SHA256", sha256Encode(sha256.Sum256(bigData)))
-		trailer.Set("X-Content-Length", fmt.Sprintf("%d", len(bigData)))
-		res.WriteTrailers(trailer)
-
-	case "/binary":
-		req.PrintRequest()
-
-		// STEP 1: write Headers
-		h := headers.NewHeaders()
-		h.Set(headers.CONTENT_TYPE, "video/mp4")
-		h.Set("Transfer-Encoding", "chunked")
-		h.Set("Trailer", "x-content-length")
-		res.Write(&response.OK, h, nil)
-
-		// Step 2: write video
-		file, err := os.Open(filepath.Join("assets", "test.mp4"))
-		defer file.Close()
-		if err != nil {
-			fmt.Println(err)
-		}
-		fileInfo, err := file.Stat()
-		if err != nil {
-			fmt.Println(err)
-			break
-		}
+func handleNotFound(res *response.Response, req *request.Request) *server.HandlerError {
+	return &server.HandlerError{StatusCode: &response.NOT_FOUND, Message: []byte("Nothing to say :(")}
+}
 
-		size := fileInfo.Size()
-		buffer := make([]byte, 1024)
-		for {
-			_, err := file.Read(buffer)
-			if err != nil {
-				break
-			}
-			res.WriteChunkedBody(buffer)
-		}
+func handleBadRequest(res *response.Response, req *request.Request) *server.HandlerError {
+	return &server.HandlerError{StatusCode: &response.BAD_REQUEST}
+}
 
-		// Step 3: write trailer
-		trailer := headers.NewHeaders()
-		trailer.Set("X-Content-Length", fmt.Sprintf("%d", size))
-		res.WriteTrailers(trailer)
+func handleServerError(res *response.Response, req *request.Request) *server.HandlerError {
+	return &server.HandlerError{StatusCode: &response.INTERNAL_SERVER_ERROR, Message: []byte("My bad :|")}
+}
 
-	default:
-		req.PrintRequest()
-		body := "Good!\n"
-		res.Write(&response.OK, nil, []byte(body))
+func handleChunked(res *response.Response, req *request.Request) *server.HandlerError {
+	req.PrintRequest()
+
+	// Step 1: set headers, Flush sends them and switches the body to chunked encoding
+	res.Header().Set(headers.CONTENT_TYPE, "text/plain")
+	res.Flush()
+
+	// Step 2: write chunk
+	size := 1024 // Byte
+	bigData := generateBigData(size)
+	cunckedSize := 100
+	var end int
+	for i := 0; i < len(bigData); i += cunckedSize {
+		end = i + cunckedSize
+		if end > len(bigData) {
+			end = len(bigData)
+		}
+		res.Write(bigData[i:end])
 	}
+	// the server terminates the body when the handler returns
 	return nil
 }
 
+func handleChunkedTrailer(res *response.Response, req *request.Request) *server.HandlerError {
+	req.PrintRequest()
+
+	// Step 1: set headers, announced trailers require chunked encoding
+	res.Header().Set(headers.CONTENT_TYPE, "text/plain")
+	res.Header().Set(headers.TRAILER, "x-content-sha256, x-content-length")
+
+	// Step 2: write chunk
+	size := 1024 // Byte
+	bigData := generateBigData(size)
+	cunckedSize := 100
+	var end int
+	for i := 0; i < len(bigData); i += cunckedSize {
+		end = i + cunckedSize
+		if end > len(bigData) {
+			end = len(bigData)
+		}
+		res.Write(bigData[i:end])
+	}
+
+	// Step 3: set trailer, sent after the last chunk
+	res.Trailer().Set("X-Content-SHA256", sha256Encode(sha256.Sum256(bigData)))
+	res.Trailer().Set("X-Content-Length", fmt.Sprintf("%d", len(bigData)))
+	return nil
+}
+
+// Range requests let the browser seek the video
+func handleBinary(res *response.Response, req *request.Request) *server.HandlerError {
+	req.PrintRequest()
+	return fileserver.ServeFile(res, req, filepath.Join("assets", "test.mp4"))
+}
+
 // NETCAT command to test chunk data
 // printf "POST /chunked HTTP/1.1\r\nHost: localhost:3030\r\nContent-Type: application/json\r\nContent-Length: 55\r\n\r\n{\"type\": \"dark mode\", \"size\": \"medium\",\"billy\":\"ballo\"}" | nc localhost 3030
 func generateBigData(size int) []byte {
@@ -157,3 +160,42 @@ func sha256Encode(bytes [32]byte) string {
 	}
 	return b.String()
 }
+
+func handleWebSocket(res *response.Response, req *request.Request) *server.HandlerError {
+	ws, hErr := websocket.Upgrade(res, req)
+	if hErr != nil {
+		return hErr
+	}
+	for {
+		msgType, data, err := ws.ReadMessage()
+		if err != nil {
+			return nil
+		}
+		if err := ws.WriteMessage(msgType, data); err != nil {
+			return nil
+		}
+	}
+}
+
+// handleEvents sends a tick every second, a reconnecting client resumes after Last-Event-ID
+func handleEvents(res *response.Response, req *request.Request) *server.HandlerError {
+	stream, hErr := sse.NewEventStream(res, req)
+	if hErr != nil {
+		return hErr
+	}
+	defer stream.Close()
+
+	id, _ := strconv.Atoi(stream.LastEventID())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range 10 {
+		select {
+		case <-stream.Done():
+			return nil
+		case t := <-ticker.C:
+			id++
+			stream.Send(sse.Event{ID: strconv.Itoa(id), Event: "tick", Data: t.Format(time.RFC3339)})
+		}
+	}
+	return nil
+}